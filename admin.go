@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultOverrideTTL is how long an override lasts if the request doesn't say
+const DefaultOverrideTTL = 1 * time.Hour
+
+// AdminAPI serves the endpoints for pausing and resuming tailing, and for
+// changing the token limits, at runtime. Every request must have the Token
+// as a bearer token.
+//
+//	POST   /admin/pause?(pod|service|namespace)=<name>[&for=<duration>]
+//	POST   /admin/resume?(pod|service|namespace)=<name>
+//	POST   /admin/limit?service=<name>&tokens=<limit>[&for=<duration>]
+//	DELETE /admin/limit?service=<name>
+//	GET    /admin/overrides
+type AdminAPI struct {
+	Token      string
+	Overrides  *Overrides
+	DefaultTTL time.Duration
+}
+
+func NewAdminAPI(token string, overrides *Overrides) *AdminAPI {
+	return &AdminAPI{
+		Token:      token,
+		Overrides:  overrides,
+		DefaultTTL: DefaultOverrideTTL,
+	}
+}
+
+func (a *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !hasBearerToken(r, a.Token) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="logtailer"`)
+		adminError(w, http.StatusUnauthorized, "a valid bearer token is required")
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/admin/pause" && r.Method == http.MethodPost:
+		a.pause(w, r)
+	case r.URL.Path == "/admin/resume" && r.Method == http.MethodPost:
+		a.resume(w, r)
+	case r.URL.Path == "/admin/limit" && r.Method == http.MethodPost:
+		a.limit(w, r)
+	case r.URL.Path == "/admin/limit" && r.Method == http.MethodDelete:
+		a.unlimit(w, r)
+	case r.URL.Path == "/admin/overrides" && r.Method == http.MethodGet:
+		adminReply(w, http.StatusOK, a.Overrides.List())
+	default:
+		adminError(w, http.StatusNotFound, fmt.Sprintf("no such endpoint: %s %s", r.Method, r.URL.Path))
+	}
+}
+
+func (a *AdminAPI) pause(w http.ResponseWriter, r *http.Request) {
+	scope, target, err := scopeFrom(r)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ttl, err := a.ttlFrom(r)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	override, err := a.Overrides.Pause(scope, target, ttl)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	adminReply(w, http.StatusOK, override)
+}
+
+func (a *AdminAPI) resume(w http.ResponseWriter, r *http.Request) {
+	scope, target, err := scopeFrom(r)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !a.Overrides.Resume(scope, target) {
+		adminError(w, http.StatusNotFound, fmt.Sprintf("%s %s isn't paused", scope, target))
+		return
+	}
+
+	adminReply(w, http.StatusOK, map[string]string{"Resumed": scope + " " + target})
+}
+
+func (a *AdminAPI) limit(w http.ResponseWriter, r *http.Request) {
+	service := r.URL.Query().Get(ScopeService)
+
+	tokens, err := strconv.Atoi(r.URL.Query().Get("tokens"))
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "tokens must be a number")
+		return
+	}
+
+	ttl, err := a.ttlFrom(r)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	override, err := a.Overrides.Limit(service, tokens, ttl)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	adminReply(w, http.StatusOK, override)
+}
+
+func (a *AdminAPI) unlimit(w http.ResponseWriter, r *http.Request) {
+	service := r.URL.Query().Get(ScopeService)
+
+	if !a.Overrides.Unlimit(service) {
+		adminError(w, http.StatusNotFound, fmt.Sprintf("service %s doesn't have a limit override", service))
+		return
+	}
+
+	adminReply(w, http.StatusOK, map[string]string{"Unlimited": ScopeService + " " + service})
+}
+
+// scopeFrom returns the one scope, and what it names, from a request
+func scopeFrom(r *http.Request) (string, string, error) {
+	var scope, target string
+	for _, name := range []string{ScopePod, ScopeService, ScopeNamespace} {
+		value := r.URL.Query().Get(name)
+		if value == "" {
+			continue
+		}
+
+		if scope != "" {
+			return "", "", fmt.Errorf("only one of %s, %s or %s can be given", ScopePod, ScopeService, ScopeNamespace)
+		}
+		scope, target = name, value
+	}
+
+	if scope == "" {
+		return "", "", fmt.Errorf("one of %s, %s or %s must be given", ScopePod, ScopeService, ScopeNamespace)
+	}
+
+	return scope, target, nil
+}
+
+// ttlFrom returns how long the override in a request should last
+func (a *AdminAPI) ttlFrom(r *http.Request) (time.Duration, error) {
+	value := r.URL.Query().Get("for")
+	if value == "" {
+		return a.DefaultTTL, nil
+	}
+
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration for 'for': %s", err)
+	}
+
+	return ttl, nil
+}
+
+func adminReply(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func adminError(w http.ResponseWriter, status int, message string) {
+	adminReply(w, status, map[string]string{"Error": message})
+}
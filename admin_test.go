@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_AdminAPI(t *testing.T) {
+	Convey("AdminAPI", t, func() {
+		overrides := NewOverrides(nil)
+		api := NewAdminAPI("secret", overrides)
+
+		serve := func(method, url, token string) (int, map[string]interface{}) {
+			request := httptest.NewRequest(method, url, nil)
+			if token != "" {
+				request.Header.Set("Authorization", "Bearer "+token)
+			}
+
+			recorder := httptest.NewRecorder()
+			_ = LogCapture(func() { api.ServeHTTP(recorder, request) })
+
+			var body map[string]interface{}
+			_ = json.Unmarshal(recorder.Body.Bytes(), &body)
+			return recorder.Code, body
+		}
+
+		Convey("requires the token", func() {
+			code, body := serve("GET", "/admin/overrides", "")
+			So(code, ShouldEqual, 401)
+			So(body["Error"], ShouldNotBeEmpty)
+
+			code, _ = serve("GET", "/admin/overrides", "guess")
+			So(code, ShouldEqual, 401)
+
+			Convey("with the Bearer scheme", func() {
+				for _, header := range []string{"secret", "Basic secret", "bearer secret", "Bearersecret"} {
+					request := httptest.NewRequest("GET", "/admin/overrides", nil)
+					request.Header.Set("Authorization", header)
+
+					recorder := httptest.NewRecorder()
+					_ = LogCapture(func() { api.ServeHTTP(recorder, request) })
+					So(recorder.Code, ShouldEqual, 401)
+				}
+			})
+
+			Convey("and can't be used without one", func() {
+				api.Token = ""
+				code, _ := serve("GET", "/admin/overrides", "")
+				So(code, ShouldEqual, 401)
+			})
+		})
+
+		Convey("pauses and resumes pods", func() {
+			code, body := serve("POST", "/admin/pause?service=web&for=10m", "secret")
+			So(code, ShouldEqual, 200)
+			So(body["Kind"], ShouldEqual, OverridePause)
+			So(body["Scope"], ShouldEqual, ScopeService)
+			So(body["Target"], ShouldEqual, "web")
+			So(overrides.PausedFor(&Pod{ServiceName: "web"}), ShouldNotBeNil)
+
+			code, _ = serve("POST", "/admin/resume?service=web", "secret")
+			So(code, ShouldEqual, 200)
+			So(overrides.PausedFor(&Pod{ServiceName: "web"}), ShouldBeNil)
+
+			code, body = serve("POST", "/admin/resume?service=web", "secret")
+			So(code, ShouldEqual, 404)
+			So(body["Error"], ShouldEqual, "service web isn't paused")
+		})
+
+		Convey("pauses for an hour unless told otherwise", func() {
+			_, _ = serve("POST", "/admin/pause?namespace=default", "secret")
+
+			paused := overrides.PausedFor(&Pod{Namespace: "default"})
+			So(paused, ShouldNotBeNil)
+			So(paused.ExpiresAt.Sub(paused.CreatedAt), ShouldEqual, time.Hour)
+		})
+
+		Convey("changes and restores the token limit for a service", func() {
+			code, body := serve("POST", "/admin/limit?service=web&tokens=25", "secret")
+			So(code, ShouldEqual, 200)
+			So(body["TokenLimit"], ShouldEqual, 25)
+
+			limit, _ := overrides.LimitFor("web")
+			So(limit, ShouldEqual, 25)
+
+			code, _ = serve("DELETE", "/admin/limit?service=web", "secret")
+			So(code, ShouldEqual, 200)
+			_, ok := overrides.LimitFor("web")
+			So(ok, ShouldBeFalse)
+
+			code, _ = serve("DELETE", "/admin/limit?service=web", "secret")
+			So(code, ShouldEqual, 404)
+		})
+
+		Convey("lists the overrides", func() {
+			_, _ = serve("POST", "/admin/pause?pod=web-1", "secret")
+
+			request := httptest.NewRequest("GET", "/admin/overrides", nil)
+			request.Header.Set("Authorization", "Bearer secret")
+			recorder := httptest.NewRecorder()
+			api.ServeHTTP(recorder, request)
+
+			var list []Override
+			So(json.Unmarshal(recorder.Body.Bytes(), &list), ShouldBeNil)
+			So(len(list), ShouldEqual, 1)
+			So(list[0].Target, ShouldEqual, "web-1")
+		})
+
+		Convey("rejects bad requests", func() {
+			for _, url := range []string{
+				"/admin/pause",
+				"/admin/pause?service=web&namespace=default",
+				"/admin/pause?service=web&for=soon",
+				"/admin/limit?service=web&tokens=lots",
+				"/admin/limit?service=web&tokens=-1",
+				"/admin/limit?tokens=10",
+			} {
+				code, body := serve("POST", url, "secret")
+				So(code, ShouldEqual, 400)
+				So(body["Error"], ShouldNotBeEmpty)
+			}
+
+			code, _ := serve("GET", "/admin/pause?service=web", "secret")
+			So(code, ShouldEqual, 404)
+		})
+	})
+}
@@ -4,17 +4,23 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 	"sync"
 
 	"github.com/nxadm/tail"
 )
 
+// Meta is stored under keys with this prefix, which can't be a logfile
+const metaPrefix = "logtailer:"
+
 // A Cache is a JSON-persisted map that stores seekinfo for all the logfiles we
 // are currently tailing. It is used to prevent re-streaming entire existing
-// logfiles when the service is restarted.
+// logfiles when the service is restarted. Other state that we want to keep
+// across restarts can be stored alongside, as meta.
 type Cache struct {
 	lock      sync.RWMutex
 	store     map[string]*tail.SeekInfo
+	meta      map[string]json.RawMessage
 	storePath string
 }
 
@@ -23,6 +29,7 @@ type Cache struct {
 func NewCache(size int, storePath string) *Cache {
 	return &Cache{
 		store:     make(map[string]*tail.SeekInfo, size),
+		meta:      make(map[string]json.RawMessage),
 		storePath: storePath,
 	}
 }
@@ -48,6 +55,24 @@ func (c *Cache) Del(key string) {
 	delete(c.store, key)
 }
 
+// SetMeta stores other state under a name, to be persisted with the offsets.
+// It should be a JSON object, so that older versions, which expect everything
+// to be seekinfo, ignore it.
+func (c *Cache) SetMeta(name string, value json.RawMessage) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.meta[name] = value
+}
+
+// Meta returns the state stored under a name, nil if there isn't any
+func (c *Cache) Meta(name string) json.RawMessage {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.meta[name]
+}
+
 // Load reads the cache from the file back into memory
 func (c *Cache) Load() error {
 	c.lock.Lock()
@@ -58,11 +83,26 @@ func (c *Cache) Load() error {
 		return fmt.Errorf("failed to load cache from %s: %s", c.storePath, err)
 	}
 
-	err = json.Unmarshal(data, &c.store)
+	var stored map[string]json.RawMessage
+	err = json.Unmarshal(data, &stored)
 	if err != nil {
 		return fmt.Errorf("failed to unmarshal cache from %s: %s", c.storePath, err)
 	}
 
+	for key, value := range stored {
+		if strings.HasPrefix(key, metaPrefix) {
+			c.meta[strings.TrimPrefix(key, metaPrefix)] = value
+			continue
+		}
+
+		var seekInfo *tail.SeekInfo
+		err = json.Unmarshal(value, &seekInfo)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal cache from %s: %s", c.storePath, err)
+		}
+		c.store[key] = seekInfo
+	}
+
 	return nil
 }
 
@@ -71,7 +111,15 @@ func (c *Cache) Persist() error {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 
-	data, err := json.Marshal(c.store)
+	stored := make(map[string]interface{}, len(c.store)+len(c.meta))
+	for key, seekInfo := range c.store {
+		stored[key] = seekInfo
+	}
+	for name, value := range c.meta {
+		stored[metaPrefix+name] = value
+	}
+
+	data, err := json.Marshal(stored)
 	if err != nil {
 		return fmt.Errorf("failed to persist cache to %s: %s", c.storePath, err)
 	}
@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"encoding/json"
 	"io"
 	"os"
 	"testing"
@@ -34,6 +35,32 @@ func Test_EndToEnd(t *testing.T) {
 			So(newCache.Get(logFileName), ShouldResemble, origCache.Get(logFileName))
 		})
 
+		Convey("Meta is written and reloaded alongside the offsets", func() {
+			origCache := NewCache(5, cacheFile.Name())
+			origCache.Add(logFileName, &tail.SeekInfo{Offset: 10, Whence: io.SeekStart})
+			origCache.SetMeta("overrides", json.RawMessage(`{"Overrides":[]}`))
+
+			err = origCache.Persist()
+			So(err, ShouldBeNil)
+
+			newCache := NewCache(5, cacheFile.Name())
+			err = newCache.Load()
+			So(err, ShouldBeNil)
+
+			So(newCache.Get(logFileName), ShouldResemble, origCache.Get(logFileName))
+			So(string(newCache.Meta("overrides")), ShouldEqual, `{"Overrides":[]}`)
+			So(newCache.Get("logtailer:overrides"), ShouldBeNil)
+
+			Convey("and is ignored by anything expecting only offsets", func() {
+				data, err := os.ReadFile(cacheFile.Name())
+				So(err, ShouldBeNil)
+
+				var offsets map[string]*tail.SeekInfo
+				So(json.Unmarshal(data, &offsets), ShouldBeNil)
+				So(offsets[logFileName].Offset, ShouldEqual, 10)
+			})
+		})
+
 		Convey("Keys that are added are returned", func() {
 			cache := NewCache(5, cacheFile.Name())
 			sought := &tail.SeekInfo{Offset: 10, Whence: io.SeekStart}
@@ -23,11 +23,32 @@ var (
 
 // A Pod represents all the info we care about for a Kubernetes Pod
 type Pod struct {
-	Name        string
+	Name        string // The name of the pod's log directory
 	Namespace   string
 	ServiceName string
 	Environment string
 	Logs        []string
+
+	// These are only known when the pod was discovered from the Kubernetes API
+	PodName   string            `json:",omitempty"` // The actual name of the pod
+	UID       string            `json:",omitempty"`
+	NodeName  string            `json:",omitempty"`
+	Labels    map[string]string `json:",omitempty"`
+	OwnerKind string            `json:",omitempty"`
+	OwnerName string            `json:",omitempty"`
+
+	// Plain log files on the host, rather than a container's logs, have a
+	// fixed container name and are always tailed
+	HostLog   bool   `json:",omitempty"`
+	Container string `json:",omitempty"`
+
+	// Why the filter accepted the pod, if it can tell us, and what we decided
+	TailReason string       `json:",omitempty"`
+	Filter     *FilterState `json:",omitempty"`
+
+	// Containers we are not tailing because of the discovery rules or their
+	// annotations, and why
+	ExcludedContainers map[string]string `json:",omitempty"`
 }
 
 // A Discoverer finds Pods
@@ -36,11 +57,55 @@ type Discoverer interface {
 	LogFiles(pod string) ([]string, error)
 }
 
+// A NotifyingDiscoverer is a Discoverer that can also tell us when something
+// has changed, so we don't have to wait for the next discovery interval.
+type NotifyingDiscoverer interface {
+	Discoverer
+	Changes() <-chan struct{}
+}
+
+// A changeNotifier is embedded in the NotifyingDiscoverers to give them their
+// Changes channel
+type changeNotifier struct {
+	changes chan struct{}
+}
+
+func newChangeNotifier() changeNotifier {
+	// Buffer of one so that a burst of events becomes a single change
+	return changeNotifier{changes: make(chan struct{}, 1)}
+}
+
+// Changes returns the channel that is notified when something has changed
+func (n changeNotifier) Changes() <-chan struct{} {
+	return n.changes
+}
+
+// notify signals a change without blocking. If a change is already pending
+// we don't need another one.
+func (n changeNotifier) notify() {
+	select {
+	case n.changes <- struct{}{}:
+	default:
+	}
+}
+
+// closeChanges closes the Changes channel once there won't be any more
+func (n changeNotifier) closeChanges() {
+	close(n.changes)
+}
+
 // A DiscoveryFilter only passes through Pods that we should allow
 type DiscoveryFilter interface {
 	ShouldTailLogs(pod *Pod) (bool, error)
 }
 
+// A ContainerFilter is a DiscoveryFilter that can also decide which of a
+// Pod's containers we tail
+type ContainerFilter interface {
+	DiscoveryFilter
+	ContainerPolicy(pod *Pod) (*ContainerPolicy, error)
+}
+
 // A DirListDiscoverer finds new pods to potentitally tail by watching the logs
 // filesystem.
 type DirListDiscoverer struct {
@@ -69,11 +134,6 @@ func (d *DirListDiscoverer) Discover() ([]*Pod, error) {
 			continue
 		}
 
-		// Don't discover ourselves if we're running as a Pod!
-		if serviceName == "logtailer" {
-			continue
-		}
-
 		pods = append(pods, &Pod{
 			Name:        entry,
 			Namespace:   namespace,
@@ -20,15 +20,17 @@ func Test_Discover(t *testing.T) {
 	Convey("Discover()", t, func() {
 		disco := NewDirListDiscoverer(fixturesDir, "dev")
 
-		Convey("finds all the pods, but not ourselves", func() {
+		Convey("finds all the pods, including ourselves", func() {
 			capture := LogCapture(func() {
 				discovered, err := disco.Discover()
 				So(err, ShouldBeNil)
-				So(len(discovered), ShouldEqual, 7)
+				So(len(discovered), ShouldEqual, 8)
+
+				// Leaving ourselves out is up to the discovery rules
+				So(discovered[3].ServiceName, ShouldEqual, "logtailer")
 			})
 
 			So(capture, ShouldNotContainSubstring, "Error")
-			So(capture, ShouldNotContainSubstring, "logtailer")
 		})
 
 		Convey("fills out the details properly for each", func() {
@@ -45,10 +47,10 @@ func Test_Discover(t *testing.T) {
 				So(discovered[2].ServiceName, ShouldEqual, "kmtest")
 				So(discovered[2].Environment, ShouldEqual, "dev")
 
-				So(discovered[3].Name, ShouldEqual, "default_pipeline-comparator-749f97cb4b-w8w4r_e5f10cd8-fb8a-4ade-b402-9b33f34f017f")
-				So(discovered[3].Namespace, ShouldEqual, "default")
-				So(discovered[3].ServiceName, ShouldEqual, "pipeline-comparator")
-				So(discovered[3].Environment, ShouldEqual, "dev")
+				So(discovered[4].Name, ShouldEqual, "default_pipeline-comparator-749f97cb4b-w8w4r_e5f10cd8-fb8a-4ade-b402-9b33f34f017f")
+				So(discovered[4].Namespace, ShouldEqual, "default")
+				So(discovered[4].ServiceName, ShouldEqual, "pipeline-comparator")
+				So(discovered[4].Environment, ShouldEqual, "dev")
 			})
 
 			So(capture, ShouldNotContainSubstring, "Error")
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// An ExplainingFilter is a DiscoveryFilter that can also say why it accepted
+// or rejected a Pod
+type ExplainingFilter interface {
+	DiscoveryFilter
+	Check(pod *Pod) (bool, string, error)
+}
+
+// checkFilter asks a DiscoveryFilter about a Pod, along with the reason for
+// its decision, making one up for filters that can't explain themselves
+func checkFilter(filter DiscoveryFilter, pod *Pod) (bool, string, error) {
+	if explaining, ok := filter.(ExplainingFilter); ok {
+		return explaining.Check(pod)
+	}
+
+	shouldTail, err := filter.ShouldTailLogs(pod)
+	if err != nil {
+		return false, "", err
+	}
+
+	if !shouldTail {
+		return false, "filtered out by the pod filter", nil
+	}
+
+	return true, "", nil
+}
+
+// containerPolicyFrom returns the first ContainerPolicy any of the filters
+// has for the Pod
+func containerPolicyFrom(filters []DiscoveryFilter, pod *Pod) (*ContainerPolicy, error) {
+	for _, filter := range filters {
+		containers, ok := filter.(ContainerFilter)
+		if !ok {
+			continue
+		}
+
+		policy, err := containers.ContainerPolicy(pod)
+		if err != nil || policy != nil {
+			return policy, err
+		}
+	}
+
+	return nil, nil
+}
+
+// An AllFilter accepts a Pod when all of its Filters do
+type AllFilter struct {
+	Filters []DiscoveryFilter
+}
+
+func (f *AllFilter) ShouldTailLogs(pod *Pod) (bool, error) {
+	shouldTail, _, err := f.Check(pod)
+	return shouldTail, err
+}
+
+// Check stops at the first filter that rejects the Pod
+func (f *AllFilter) Check(pod *Pod) (bool, string, error) {
+	var reasons []string
+	for _, filter := range f.Filters {
+		shouldTail, reason, err := checkFilter(filter, pod)
+		if err != nil {
+			return false, "", err
+		}
+
+		if !shouldTail {
+			return false, reason, nil
+		}
+
+		if reason != "" {
+			reasons = append(reasons, reason)
+		}
+	}
+
+	return true, strings.Join(reasons, "; "), nil
+}
+
+func (f *AllFilter) ContainerPolicy(pod *Pod) (*ContainerPolicy, error) {
+	return containerPolicyFrom(f.Filters, pod)
+}
+
+// An AnyFilter accepts a Pod when any of its Filters do. If none of them do,
+// and one of them failed, we return the error.
+type AnyFilter struct {
+	Filters []DiscoveryFilter
+}
+
+func (f *AnyFilter) ShouldTailLogs(pod *Pod) (bool, error) {
+	shouldTail, _, err := f.Check(pod)
+	return shouldTail, err
+}
+
+// Check stops at the first filter that accepts the Pod
+func (f *AnyFilter) Check(pod *Pod) (bool, string, error) {
+	var reasons []string
+	var lastErr error
+	for _, filter := range f.Filters {
+		shouldTail, reason, err := checkFilter(filter, pod)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if shouldTail {
+			return true, reason, nil
+		}
+
+		if reason != "" {
+			reasons = append(reasons, reason)
+		}
+	}
+
+	if lastErr != nil {
+		return false, "", lastErr
+	}
+
+	return false, strings.Join(reasons, "; "), nil
+}
+
+func (f *AnyFilter) ContainerPolicy(pod *Pod) (*ContainerPolicy, error) {
+	return containerPolicyFrom(f.Filters, pod)
+}
+
+// A NotFilter accepts a Pod when its Filter rejects it
+type NotFilter struct {
+	Filter DiscoveryFilter
+}
+
+func (f *NotFilter) ShouldTailLogs(pod *Pod) (bool, error) {
+	shouldTail, _, err := f.Check(pod)
+	return shouldTail, err
+}
+
+func (f *NotFilter) Check(pod *Pod) (bool, string, error) {
+	shouldTail, reason, err := checkFilter(f.Filter, pod)
+	if err != nil {
+		return false, "", err
+	}
+
+	if reason == "" {
+		reason = "passed the pod filter"
+	}
+
+	return !shouldTail, "not (" + reason + ")", nil
+}
+
+// A NamespaceFilter accepts the Pods in the listed namespaces
+type NamespaceFilter struct {
+	Namespaces map[string]bool
+}
+
+func (f *NamespaceFilter) ShouldTailLogs(pod *Pod) (bool, error) {
+	return f.Namespaces[pod.Namespace], nil
+}
+
+func (f *NamespaceFilter) Check(pod *Pod) (bool, string, error) {
+	if f.Namespaces[pod.Namespace] {
+		return true, "namespace " + pod.Namespace + " is allowed", nil
+	}
+
+	return false, "namespace " + pod.Namespace + " is not allowed", nil
+}
+
+// A ServiceFilter accepts the Pods whose service name matches a regex
+type ServiceFilter struct {
+	Regexp *regexp.Regexp
+}
+
+func (f *ServiceFilter) ShouldTailLogs(pod *Pod) (bool, error) {
+	return f.Regexp.MatchString(pod.ServiceName), nil
+}
+
+func (f *ServiceFilter) Check(pod *Pod) (bool, string, error) {
+	if f.Regexp.MatchString(pod.ServiceName) {
+		return true, "service " + pod.ServiceName + " matches " + f.Regexp.String(), nil
+	}
+
+	return false, "service " + pod.ServiceName + " doesn't match " + f.Regexp.String(), nil
+}
+
+// ParseFilter builds a DiscoveryFilter from its configuration, which is made
+// up of:
+//
+//	all(<filter>, ...)       every one of the filters accepts the pod
+//	any(<filter>, ...)       at least one of them does
+//	not(<filter>)            the filter rejects the pod
+//	namespace=<ns>|<ns>...   the pod is in one of the namespaces
+//	service=~<regex>         the service name matches the regex
+//	<name>                   one of the named filters, e.g. pod-annotation
+//
+// For example:
+//
+//	any(pod-annotation, all(namespace=default|staging, not(service=~^test-)))
+func ParseFilter(spec string, named map[string]DiscoveryFilter) (DiscoveryFilter, error) {
+	parser := &filterParser{spec: spec, named: named}
+
+	filter, err := parser.parse()
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %w", spec, err)
+	}
+
+	parser.skipSpaces()
+	if parser.pos < len(spec) {
+		return nil, fmt.Errorf("invalid filter %q: unexpected %q at %d", spec, spec[parser.pos:], parser.pos)
+	}
+
+	return filter, nil
+}
+
+// filterParser is a small recursive descent parser for ParseFilter
+type filterParser struct {
+	spec  string
+	pos   int
+	named map[string]DiscoveryFilter
+}
+
+func (p *filterParser) skipSpaces() {
+	for p.pos < len(p.spec) && p.spec[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// term reads up to the next comma or closing paren that isn't part of a
+// regex, so that regexes can have groups, repeats like {1,3}, character
+// classes and escaped parens in them
+func (p *filterParser) term() (string, error) {
+	start := p.pos
+	var parens, braces int
+	var inClass bool
+
+	for ; p.pos < len(p.spec); p.pos++ {
+		char := p.spec[p.pos]
+
+		switch {
+		case char == '\\':
+			p.pos++ // Whatever is escaped is part of the term
+		case inClass:
+			inClass = char != ']'
+		case char == '[':
+			inClass = true
+		case char == '{':
+			braces++
+		case char == '}' && braces > 0:
+			braces--
+		case char == '(':
+			parens++
+		case char == ')':
+			if parens == 0 {
+				return strings.TrimSpace(p.spec[start:p.pos]), nil
+			}
+			parens--
+		case char == ',':
+			if parens == 0 && braces == 0 {
+				return strings.TrimSpace(p.spec[start:p.pos]), nil
+			}
+		}
+	}
+
+	term := strings.TrimSpace(p.spec[start:])
+	switch {
+	case parens > 0:
+		return "", fmt.Errorf("unclosed ( in %q", term)
+	case braces > 0:
+		return "", fmt.Errorf("unclosed { in %q", term)
+	case inClass:
+		return "", fmt.Errorf("unclosed [ in %q", term)
+	}
+
+	return term, nil
+}
+
+func (p *filterParser) parse() (DiscoveryFilter, error) {
+	p.skipSpaces()
+
+	for _, combinator := range []string{"all(", "any(", "not("} {
+		if strings.HasPrefix(p.spec[p.pos:], combinator) {
+			p.pos += len(combinator)
+			return p.combine(combinator[:3])
+		}
+	}
+
+	term, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	if term == "" {
+		return nil, errors.New("missing filter")
+	}
+
+	if pattern, ok := strings.CutPrefix(term, "service=~"); ok {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("bad service regex: %w", err)
+		}
+		return &ServiceFilter{Regexp: compiled}, nil
+	}
+
+	if namespaces, ok := strings.CutPrefix(term, "namespace="); ok {
+		filter := &NamespaceFilter{Namespaces: make(map[string]bool)}
+		for _, namespace := range strings.Split(namespaces, "|") {
+			filter.Namespaces[strings.TrimSpace(namespace)] = true
+		}
+		return filter, nil
+	}
+
+	if filter, ok := p.named[term]; ok {
+		return filter, nil
+	}
+
+	return nil, fmt.Errorf("unknown filter %q", term)
+}
+
+// combine parses the arguments of all(), any() or not()
+func (p *filterParser) combine(combinator string) (DiscoveryFilter, error) {
+	var filters []DiscoveryFilter
+	for {
+		filter, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+
+		p.skipSpaces()
+		if p.pos >= len(p.spec) {
+			return nil, fmt.Errorf("missing ) after %s(", combinator)
+		}
+
+		if p.spec[p.pos] == ',' {
+			p.pos++
+			continue
+		}
+
+		if p.spec[p.pos] != ')' {
+			return nil, fmt.Errorf("unexpected %q at %d", p.spec[p.pos:], p.pos)
+		}
+
+		p.pos++
+		break
+	}
+
+	switch combinator {
+	case "all":
+		return &AllFilter{Filters: filters}, nil
+	case "any":
+		return &AnyFilter{Filters: filters}, nil
+	default:
+		if len(filters) != 1 {
+			return nil, errors.New("not() takes a single filter")
+		}
+		return &NotFilter{Filter: filters[0]}, nil
+	}
+}
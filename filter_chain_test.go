@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ParseFilter(t *testing.T) {
+	Convey("ParseFilter()", t, func() {
+		annotated := &mockFilter{ShouldNotTailFor: map[string]bool{"default_unannotated": true}}
+		named := map[string]DiscoveryFilter{"pod-annotation": annotated}
+
+		pod := func(name, namespace, service string) *Pod {
+			return &Pod{Name: name, Namespace: namespace, ServiceName: service}
+		}
+
+		Convey("parses a named filter on its own", func() {
+			filter, err := ParseFilter("pod-annotation", named)
+			So(err, ShouldBeNil)
+			So(filter, ShouldEqual, annotated)
+		})
+
+		Convey("combines filters", func() {
+			filter, err := ParseFilter(
+				"any(pod-annotation, all(namespace=default|staging, not(service=~^(test|load)-)))", named,
+			)
+			So(err, ShouldBeNil)
+
+			Convey("accepting a pod when any of them do", func() {
+				shouldTail, reason, err := checkFilter(filter, pod("default_unannotated", "default", "chopper"))
+				So(err, ShouldBeNil)
+				So(shouldTail, ShouldBeTrue)
+				So(reason, ShouldEqual, "namespace default is allowed; not (service chopper doesn't match ^(test|load)-)")
+			})
+
+			Convey("rejecting a pod when none of them do, with all the reasons", func() {
+				shouldTail, reason, err := checkFilter(filter, pod("default_unannotated", "default", "test-chopper"))
+				So(err, ShouldBeNil)
+				So(shouldTail, ShouldBeFalse)
+				So(reason, ShouldEqual,
+					"filtered out by the pod filter; not (service test-chopper matches ^(test|load)-)",
+				)
+
+				shouldTail, reason, err = checkFilter(filter, pod("default_unannotated", "kube-system", "chopper"))
+				So(err, ShouldBeNil)
+				So(shouldTail, ShouldBeFalse)
+				So(reason, ShouldContainSubstring, "namespace kube-system is not allowed")
+			})
+
+			Convey("passing on errors unless another filter accepts the pod", func() {
+				named["pod-annotation"] = &erroringFilter{}
+				filter, err := ParseFilter("any(pod-annotation, namespace=default)", named)
+				So(err, ShouldBeNil)
+
+				shouldTail, err := filter.ShouldTailLogs(pod("default_chopper", "default", "chopper"))
+				So(err, ShouldBeNil)
+				So(shouldTail, ShouldBeTrue)
+
+				_, err = filter.ShouldTailLogs(pod("kube-system_chopper", "kube-system", "chopper"))
+				So(err, ShouldNotBeNil)
+
+				filter, err = ParseFilter("all(namespace=default, pod-annotation)", named)
+				So(err, ShouldBeNil)
+
+				_, err = filter.ShouldTailLogs(pod("default_chopper", "default", "chopper"))
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("keeps regexes with repeats and escaped parens in one piece", func() {
+			filter, err := ParseFilter(`all(service=~^[a-z]{1,3}-\(canary\)$, namespace=default)`, named)
+			So(err, ShouldBeNil)
+
+			shouldTail, _, err := checkFilter(filter, pod("default_abc", "default", "abc-(canary)"))
+			So(err, ShouldBeNil)
+			So(shouldTail, ShouldBeTrue)
+
+			shouldTail, _, err = checkFilter(filter, pod("default_abcd", "default", "abcd-(canary)"))
+			So(err, ShouldBeNil)
+			So(shouldTail, ShouldBeFalse)
+
+			filter, err = ParseFilter(`not(service=~^[,)])`, named)
+			So(err, ShouldBeNil)
+			So(filter.(*NotFilter).Filter.(*ServiceFilter).Regexp.String(), ShouldEqual, "^[,)]")
+		})
+
+		Convey("points at an unclosed paren in a regex", func() {
+			_, err := ParseFilter(`all(namespace=default, service=~^(test|load-`, named)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, `unclosed ( in "service=~^(test|load-"`)
+		})
+
+		Convey("passes on container policies from the filters it combines", func() {
+			policy := NewContainerPolicy(map[string]string{"community.com/TailLogs.envoy": "false"}, DefaultFilterKeys)
+			annotated.Policies = map[string]*ContainerPolicy{"default_chopper": policy}
+
+			filter, err := ParseFilter("all(namespace=default, pod-annotation)", named)
+			So(err, ShouldBeNil)
+
+			containers, ok := filter.(ContainerFilter)
+			So(ok, ShouldBeTrue)
+
+			found, err := containers.ContainerPolicy(pod("default_chopper", "default", "chopper"))
+			So(err, ShouldBeNil)
+			So(found, ShouldEqual, policy)
+		})
+
+		Convey("errors on bad filters", func() {
+			for _, spec := range []string{
+				"",
+				"nobody",
+				"all(pod-annotation",
+				"not(pod-annotation, namespace=default)",
+				"any(pod-annotation)x",
+				"all(not(pod-annotation)x)",
+				"service=~(",
+			} {
+				_, err := ParseFilter(spec, named)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
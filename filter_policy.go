@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// What we do with a new pod when the filter fails
+const (
+	FailOpen      = "open"       // Tail it
+	FailClosed    = "closed"     // Don't tail it
+	FailLastKnown = "last-known" // Do what we last decided for the service, or fail closed
+)
+
+const (
+	DefaultFilterRetryBackoff    = 5 * time.Second
+	DefaultFilterMaxRetryBackoff = 5 * time.Minute
+)
+
+// ValidFailurePolicy returns an error if the policy isn't one we know
+func ValidFailurePolicy(policy string) error {
+	switch policy {
+	case FailOpen, FailClosed, FailLastKnown:
+		return nil
+	default:
+		return fmt.Errorf("unknown filter failure policy %q, expected %s, %s or %s",
+			policy, FailOpen, FailClosed, FailLastKnown)
+	}
+}
+
+// FilterState is what we decided about tailing a pod, for the state server
+type FilterState struct {
+	Tailing   bool
+	CheckedAt time.Time
+	NextCheck time.Time `json:",omitempty"`
+	Failures  int       `json:",omitempty"`
+	LastError string    `json:",omitempty"`
+	Policy    string    `json:",omitempty"` // Set when the filter failed and the policy decided
+
+	// Pods to be tailed wait for a free slot when there are too many log files
+	Waiting      bool      `json:",omitempty"`
+	WaitingSince time.Time `json:",omitempty"`
+	Priority     int       `json:",omitempty"`
+	// Or because they were paused with the admin API
+	Paused bool `json:",omitempty"`
+}
+
+// A filterDecision records whether we decided to tail a pod, which of its
+// containers, and when. If the filter failed, we retry with backoff.
+type filterDecision struct {
+	tailing    bool
+	containers *ContainerPolicy // nil for all of them
+	checkedAt  time.Time
+
+	failures  int
+	lastError error
+	retryAt   time.Time
+	byPolicy  string // The failure policy, if it decided rather than the filter
+
+	// Waiting for fillSlots to start tailing it, and in what order
+	waiting       bool
+	paused        bool      // Waiting because it was paused
+	waitingSince  time.Time // When it first didn't fit
+	fromEnd       bool
+	queuedAt      time.Time
+	priority      int
+	namespaceRank int
+	files         int // How many log files we tail for it
+
+	pod *Pod // The one the state server sees
+}
+
+// due returns true if it's time to ask the filter about the pod again
+func (d *filterDecision) due(recheckInterval time.Duration) bool {
+	if d.failures > 0 && !time.Now().Before(d.retryAt) {
+		return true
+	}
+
+	return recheckInterval > 0 && time.Since(d.checkedAt) >= recheckInterval
+}
+
+// succeeded records that the filter worked this time
+func (d *filterDecision) succeeded() {
+	d.checkedAt = time.Now()
+	d.failures = 0
+	d.lastError = nil
+	d.byPolicy = ""
+}
+
+// failed records that the filter didn't work, and when to try again
+func (d *filterDecision) failed(err error, backoff time.Duration, maxBackoff time.Duration) {
+	d.checkedAt = time.Now()
+	d.failures++
+	d.lastError = err
+
+	// Doubles each time, up to the max
+	wait := backoff
+	for i := 1; i < d.failures && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+
+	d.retryAt = d.checkedAt.Add(wait)
+}
+
+// state returns a copy of the decision for the state server
+func (d *filterDecision) state(recheckInterval time.Duration) *FilterState {
+	state := &FilterState{
+		Tailing:   d.tailing,
+		CheckedAt: d.checkedAt,
+		Failures:  d.failures,
+		Policy:    d.byPolicy,
+		Waiting:   d.waiting,
+		Priority:  d.priority,
+		Paused:    d.paused,
+	}
+
+	if d.waiting {
+		state.WaitingSince = d.waitingSince
+	}
+
+	if d.lastError != nil {
+		state.LastError = d.lastError.Error()
+		state.NextCheck = d.retryAt
+	} else if recheckInterval > 0 {
+		state.NextCheck = d.checkedAt.Add(recheckInterval)
+	}
+
+	return state
+}
+
+// serviceKey is how we remember the last decision for a service
+func serviceKey(pod *Pod) string {
+	return pod.Namespace + "/" + pod.ServiceName
+}
+
+// decideOnFailure applies the FailurePolicy to a new pod that the filter
+// failed for, and returns whether to tail it and why
+func (t *PodTracker) decideOnFailure(pod *Pod, decision *filterDecision, err error) (bool, string) {
+	decision.failed(err, t.RetryBackoff, t.MaxRetryBackoff)
+	decision.byPolicy = t.FailurePolicy
+
+	switch t.FailurePolicy {
+	case FailOpen:
+		return true, "filter failed, failing open: " + err.Error()
+	case FailLastKnown:
+		if tailing, ok := t.lastKnown[serviceKey(pod)]; ok {
+			return tailing, "filter failed, using the last decision for the service: " + err.Error()
+		}
+	}
+
+	decision.byPolicy = FailClosed
+	return false, "filter failed, failing closed: " + err.Error()
+}
+
+// publish makes the decision visible on the pod for the state server
+func (t *PodTracker) publish(decision *filterDecision) {
+	if decision.pod == nil {
+		return
+	}
+
+	state := decision.state(t.RecheckInterval)
+	t.withLock(func() {
+		decision.pod.Filter = state
+	})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A HostLogSource is a set of plain log files on the host, outside of the pod
+// logs, e.g. the kubelet's or the API server's audit logs. They are sent with
+// the static metadata configured here.
+type HostLogSource struct {
+	ServiceName string
+	Container   string
+	Pattern     string
+}
+
+// ParseHostLogSources parses host log sources from their configuration, which
+// looks like:
+//
+//	<service name>[/<container>]=<glob pattern>
+//
+// The container defaults to the service name.
+func ParseHostLogSources(specs []string) ([]*HostLogSource, error) {
+	var sources []*HostLogSource
+	for _, spec := range specs {
+		name, pattern, ok := strings.Cut(spec, "=")
+		if !ok || name == "" || pattern == "" {
+			return nil, fmt.Errorf("host log source should be <service>[/<container>]=<pattern>, got %q", spec)
+		}
+
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad pattern for host log source %q: %w", spec, err)
+		}
+
+		serviceName, container, _ := strings.Cut(name, "/")
+		if container == "" {
+			container = serviceName
+		}
+
+		sources = append(sources, &HostLogSource{
+			ServiceName: serviceName,
+			Container:   container,
+			Pattern:     pattern,
+		})
+	}
+
+	return sources, nil
+}
+
+// PodName is the name we give the Pod for this source
+func (s *HostLogSource) PodName() string {
+	return "host_" + s.ServiceName + "_" + s.Container
+}
+
+// A GlobDiscoverer finds plain log files on the host that match the patterns
+// of the configured sources. Each source that has matching files is returned
+// as a Pod, so that it can be tailed like any other.
+type GlobDiscoverer struct {
+	Sources     []*HostLogSource
+	Environment string
+}
+
+func NewGlobDiscoverer(sources []*HostLogSource, environment string) *GlobDiscoverer {
+	return &GlobDiscoverer{
+		Sources:     sources,
+		Environment: environment,
+	}
+}
+
+// Discover returns a Pod for each source that currently has log files
+func (d *GlobDiscoverer) Discover() ([]*Pod, error) {
+	var pods []*Pod
+	for _, source := range d.Sources {
+		matches, err := filepath.Glob(source.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("discovery failed for %s: %w", source.Pattern, err)
+		}
+
+		if len(matches) == 0 {
+			continue
+		}
+
+		pods = append(pods, &Pod{
+			Name:        source.PodName(),
+			ServiceName: source.ServiceName,
+			Environment: d.Environment,
+			Container:   source.Container,
+			HostLog:     true,
+		})
+	}
+
+	return pods, nil
+}
+
+// LogFiles returns the files that currently match the pattern for a source.
+// Rotated copies of the live logs are left out, so that they aren't read
+// again from the beginning. The Tailer finishes a live log that it sees
+// rotated by following it to its new name.
+func (d *GlobDiscoverer) LogFiles(podName string) ([]string, error) {
+	for _, source := range d.Sources {
+		if source.PodName() != podName {
+			continue
+		}
+
+		matches, err := filepath.Glob(source.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find logs for %s: %w", podName, err)
+		}
+
+		return withoutRotatedCopies(matches), nil
+	}
+
+	return nil, fmt.Errorf("failed to find logs for %s: no such host log source", podName)
+}
+
+// withoutRotatedCopies removes the files that are rotated copies of another
+// of the files
+func withoutRotatedCopies(filenames []string) []string {
+	live := make([]string, 0, len(filenames))
+
+OUTER:
+	for _, filename := range filenames {
+		for _, other := range filenames {
+			if isRotatedCopy(filename, other) {
+				continue OUTER
+			}
+		}
+
+		live = append(live, filename)
+	}
+
+	return live
+}
+
+// A MultiDiscoverer combines the Pods from several Discoverers, e.g. the pod
+// logs and the host logs. Changes from any of them that can notify are passed
+// on.
+type MultiDiscoverer struct {
+	Discoverers []Discoverer
+
+	owners map[string]Discoverer // Which Discoverer found each Pod
+	lock   sync.Mutex
+	changeNotifier
+}
+
+func NewMultiDiscoverer(discoverers ...Discoverer) *MultiDiscoverer {
+	return &MultiDiscoverer{
+		Discoverers: discoverers,
+		owners:      make(map[string]Discoverer),
+
+		changeNotifier: newChangeNotifier(),
+	}
+}
+
+// Discover returns the Pods from all the Discoverers. If any of them fails we
+// return the error rather than a partial list, so that the PodTracker doesn't
+// drop the Pods we couldn't see this time.
+func (d *MultiDiscoverer) Discover() ([]*Pod, error) {
+	var pods []*Pod
+	owners := make(map[string]Discoverer)
+
+	for _, disco := range d.Discoverers {
+		discovered, err := disco.Discover()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pod := range discovered {
+			owners[pod.Name] = disco
+		}
+		pods = append(pods, discovered...)
+	}
+
+	d.lock.Lock()
+	d.owners = owners
+	d.lock.Unlock()
+
+	return pods, nil
+}
+
+// LogFiles asks the Discoverer that found the Pod for its logs
+func (d *MultiDiscoverer) LogFiles(podName string) ([]string, error) {
+	d.lock.Lock()
+	disco, ok := d.owners[podName]
+	d.lock.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("failed to find logs for %s: pod not discovered", podName)
+	}
+
+	return disco.LogFiles(podName)
+}
+
+// Run passes on changes from the Discoverers that can notify. The Changes
+// channel is closed once all of theirs are.
+func (d *MultiDiscoverer) Run() {
+	var wg sync.WaitGroup
+	for _, disco := range d.Discoverers {
+		notifier, ok := disco.(NotifyingDiscoverer)
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func(changes <-chan struct{}) {
+			defer wg.Done()
+			for range changes {
+				d.notify()
+			}
+		}(notifier.Changes())
+	}
+
+	go func() {
+		wg.Wait()
+		d.closeChanges()
+	}()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ParseHostLogSources(t *testing.T) {
+	Convey("ParseHostLogSources()", t, func() {
+		Convey("parses sources with and without a container", func() {
+			sources, err := ParseHostLogSources([]string{
+				"kubelet=/var/log/kubelet.log",
+				"kube-apiserver/audit=/var/log/kube-apiserver-audit*.log",
+			})
+
+			So(err, ShouldBeNil)
+			So(sources, ShouldResemble, []*HostLogSource{
+				{ServiceName: "kubelet", Container: "kubelet", Pattern: "/var/log/kubelet.log"},
+				{ServiceName: "kube-apiserver", Container: "audit", Pattern: "/var/log/kube-apiserver-audit*.log"},
+			})
+		})
+
+		Convey("errors on a bad source", func() {
+			_, err := ParseHostLogSources([]string{"/var/log/kubelet.log"})
+			So(err, ShouldNotBeNil)
+
+			_, err = ParseHostLogSources([]string{"kubelet=/var/log/[kubelet.log"})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func Test_GlobDiscoverer(t *testing.T) {
+	Convey("GlobDiscoverer", t, func() {
+		dir, err := os.MkdirTemp("", "hostlogs")
+		So(err, ShouldBeNil)
+		Reset(func() { os.RemoveAll(dir) })
+
+		for _, name := range []string{"kube-apiserver-audit.log", "kube-apiserver-audit-2022.log", "kubelet.log"} {
+			So(os.WriteFile(filepath.Join(dir, name), []byte{}, 0644), ShouldBeNil)
+		}
+
+		disco := NewGlobDiscoverer([]*HostLogSource{
+			{ServiceName: "kube-apiserver", Container: "audit", Pattern: filepath.Join(dir, "kube-apiserver-audit*.log")},
+			{ServiceName: "containerd", Container: "containerd", Pattern: filepath.Join(dir, "containerd.log")},
+		}, "dev")
+
+		Convey("returns a pod for each source with files", func() {
+			pods, err := disco.Discover()
+			So(err, ShouldBeNil)
+			So(len(pods), ShouldEqual, 1)
+
+			So(pods[0].Name, ShouldEqual, "host_kube-apiserver_audit")
+			So(pods[0].ServiceName, ShouldEqual, "kube-apiserver")
+			So(pods[0].Container, ShouldEqual, "audit")
+			So(pods[0].Environment, ShouldEqual, "dev")
+			So(pods[0].HostLog, ShouldBeTrue)
+		})
+
+		Convey("returns the files matching the pattern, without rotated copies", func() {
+			So(os.WriteFile(filepath.Join(dir, "kube-apiserver-audit-other.log"), []byte{}, 0644), ShouldBeNil)
+
+			logs, err := disco.LogFiles("host_kube-apiserver_audit")
+			So(err, ShouldBeNil)
+			So(logs, ShouldResemble, []string{
+				filepath.Join(dir, "kube-apiserver-audit-other.log"),
+				filepath.Join(dir, "kube-apiserver-audit.log"),
+			})
+		})
+
+		Convey("errors for a source it doesn't know", func() {
+			_, err := disco.LogFiles("host_kubelet_kubelet")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func Test_MultiDiscoverer(t *testing.T) {
+	Convey("MultiDiscoverer", t, func() {
+		pods := newMockDisco()
+		pods.Pods = []*Pod{{Name: "default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499"}}
+		pods.Logs = []string{"chopper/0.log"}
+
+		hostLogs := newMockDisco()
+		hostLogs.Pods = []*Pod{{Name: "host_kubelet_kubelet", HostLog: true}}
+		hostLogs.Logs = []string{"/var/log/kubelet.log"}
+
+		disco := NewMultiDiscoverer(pods, hostLogs)
+
+		Convey("returns the pods from all of them", func() {
+			discovered, err := disco.Discover()
+			So(err, ShouldBeNil)
+			So(len(discovered), ShouldEqual, 2)
+		})
+
+		Convey("gets the logs from the one that found the pod", func() {
+			_, err := disco.Discover()
+			So(err, ShouldBeNil)
+
+			logs, err := disco.LogFiles("host_kubelet_kubelet")
+			So(err, ShouldBeNil)
+			So(logs, ShouldResemble, []string{"/var/log/kubelet.log"})
+
+			_, err = disco.LogFiles("nobody")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("errors if any of them do", func() {
+			hostLogs.DiscoverShouldError = true
+
+			discovered, err := disco.Discover()
+			So(err, ShouldNotBeNil)
+			So(discovered, ShouldBeNil)
+		})
+
+		Convey("passes on changes", func() {
+			notifying := newMockNotifyingDisco()
+			disco := NewMultiDiscoverer(pods, notifying)
+			disco.Run()
+
+			notifying.changes <- struct{}{}
+			So(waitForChange(disco.Changes()), ShouldBeTrue)
+
+			close(notifying.changes)
+			_, ok := <-disco.Changes()
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultDiscoveryMaxAge is how long we can go without a discovery pass
+	// before we think the PodTracker has wedged
+	DefaultDiscoveryMaxAge = 1 * time.Minute
+
+	// If lines were dropped because they couldn't be sent this recently, the
+	// outputs aren't keeping up
+	outputStallWindow = 1 * time.Minute
+)
+
+// A CheckFunc looks at one part of the pipeline. It returns an error if that
+// part isn't working, and otherwise something about how it is doing.
+type CheckFunc func() (string, error)
+
+// CheckResult is how one check went, for the health endpoints
+type CheckResult struct {
+	Healthy bool
+	Message string `json:",omitempty"`
+}
+
+// HealthReport is what the health endpoints serve
+type HealthReport struct {
+	Healthy bool
+	Checks  map[string]CheckResult
+}
+
+// Health runs the checks for the /healthz and /readyz endpoints. Liveness
+// only uses the checks for things that restarting us would fix. Readiness
+// uses all of them.
+type Health struct {
+	lock   sync.RWMutex
+	checks []namedCheck
+}
+
+type namedCheck struct {
+	name     string
+	liveness bool
+	check    CheckFunc
+}
+
+func NewHealth() *Health {
+	return &Health{}
+}
+
+// Add adds a check, used for liveness as well as readiness if liveness is set
+func (h *Health) Add(name string, liveness bool, check CheckFunc) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.checks = append(h.checks, namedCheck{name: name, liveness: liveness, check: check})
+}
+
+// Report runs the checks, only the liveness ones if liveness is set
+func (h *Health) Report(liveness bool) HealthReport {
+	h.lock.RLock()
+	checks := append([]namedCheck(nil), h.checks...)
+	h.lock.RUnlock()
+
+	report := HealthReport{Healthy: true, Checks: make(map[string]CheckResult, len(checks))}
+	for _, check := range checks {
+		if liveness && !check.liveness {
+			continue
+		}
+
+		message, err := check.check()
+		if err != nil {
+			report.Healthy = false
+			report.Checks[check.name] = CheckResult{Message: err.Error()}
+			continue
+		}
+
+		report.Checks[check.name] = CheckResult{Healthy: true, Message: message}
+	}
+
+	return report
+}
+
+// Liveness serves the liveness checks, for /healthz
+func (h *Health) Liveness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.serve(w, true)
+	})
+}
+
+// Readiness serves all the checks, for /readyz
+func (h *Health) Readiness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.serve(w, false)
+	})
+}
+
+func (h *Health) serve(w http.ResponseWriter, liveness bool) {
+	report := h.Report(liveness)
+
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	err := json.NewEncoder(w).Encode(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// CheckDiscovery returns a check that the PodTracker has run a discovery pass
+// within maxAge, or since it was started if it hasn't run one yet
+func (t *PodTracker) CheckDiscovery(maxAge time.Duration) CheckFunc {
+	if maxAge <= 0 {
+		maxAge = DefaultDiscoveryMaxAge
+	}
+
+	return func() (string, error) {
+		synced := atomic.LoadInt64(&t.syncedAt)
+		if synced == 0 {
+			if since := time.Since(t.createdAt); since > maxAge {
+				return "", fmt.Errorf("no discovery pass yet, %s after starting", since.Round(time.Second))
+			}
+			return "waiting for the first discovery pass", nil
+		}
+
+		since := time.Since(time.Unix(0, synced))
+		if since > maxAge {
+			return "", fmt.Errorf("last discovery pass was %s ago", since.Round(time.Second))
+		}
+
+		return fmt.Sprintf("last discovery pass was %s ago", since.Round(time.Millisecond)), nil
+	}
+}
+
+// CheckCache returns a check that the last time we persisted the offset
+// cache, it worked
+func (t *PodTracker) CheckCache() CheckFunc {
+	return func() (string, error) {
+		t.persistLock.Lock()
+		defer t.persistLock.Unlock()
+
+		if t.persistedAt.IsZero() {
+			return "not persisted yet", nil
+		}
+
+		since := time.Since(t.persistedAt).Round(time.Millisecond)
+		if t.persistErr != nil {
+			return "", fmt.Errorf("persisting the cache failed %s ago: %s", since, t.persistErr)
+		}
+
+		return fmt.Sprintf("persisted %s ago", since), nil
+	}
+}
+
+// Check is a CheckFunc that the last time we listed the pods for the
+// metadata, it worked. It doesn't list them itself, so that the probes don't
+// hold up lookups or add to the load on the API server.
+func (c *PodMetadataCache) Check() (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.failedAt.After(c.fetchedAt) {
+		return "", fmt.Errorf("listing the pods failed %s ago: %s",
+			time.Since(c.failedAt).Round(time.Millisecond), c.failure)
+	}
+
+	if c.fetchedAt.IsZero() {
+		return "no metadata fetched yet", nil
+	}
+
+	return fmt.Sprintf("fetched the metadata for %d pods %s ago",
+		len(c.pods), time.Since(c.fetchedAt).Round(time.Millisecond)), nil
+}
+
+// CheckOutputs is a CheckFunc that the outputs are keeping up, meaning we
+// haven't recently had to drop lines because they couldn't be sent in time
+func CheckOutputs() (string, error) {
+	dropped := atomic.LoadInt64(&lastDroppedAt)
+	if dropped != 0 {
+		since := time.Since(time.Unix(0, dropped))
+		if since < outputStallWindow {
+			return "", fmt.Errorf("lines were dropped %s ago because they couldn't be sent in time",
+				since.Round(time.Second))
+		}
+	}
+
+	return "accepting lines", nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shimmur/logtailer/cache"
+	director "github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Health(t *testing.T) {
+	Convey("Health", t, func() {
+		health := NewHealth()
+
+		var broken error
+		health.Add("alive", true, func() (string, error) { return "still here", nil })
+		health.Add("ready", false, func() (string, error) { return "", broken })
+
+		serve := func(handler http.Handler) (int, HealthReport) {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+
+			var report HealthReport
+			So(json.Unmarshal(recorder.Body.Bytes(), &report), ShouldBeNil)
+			return recorder.Code, report
+		}
+
+		Convey("reports on every check when they pass", func() {
+			code, report := serve(health.Readiness())
+			So(code, ShouldEqual, 200)
+			So(report.Healthy, ShouldBeTrue)
+			So(report.Checks["alive"], ShouldResemble, CheckResult{Healthy: true, Message: "still here"})
+			So(report.Checks["ready"].Healthy, ShouldBeTrue)
+		})
+
+		Convey("is unavailable when a check fails, and says why", func() {
+			broken = errors.New("intentional test error")
+
+			code, report := serve(health.Readiness())
+			So(code, ShouldEqual, 503)
+			So(report.Healthy, ShouldBeFalse)
+			So(report.Checks["ready"], ShouldResemble, CheckResult{Message: "intentional test error"})
+
+			Convey("unless it's only a readiness check", func() {
+				code, report := serve(health.Liveness())
+				So(code, ShouldEqual, 200)
+				So(report.Checks, ShouldContainKey, "alive")
+				So(report.Checks, ShouldNotContainKey, "ready")
+			})
+		})
+	})
+}
+
+func Test_HealthChecks(t *testing.T) {
+	Convey("The health checks", t, func() {
+		looper := director.NewFreeLooper(director.ONCE, make(chan error))
+		tracker := NewPodTracker(looper, newMockDisco(), NewMockTailerFunc(&MockTailer{}), &mockFilter{})
+
+		Convey("for discovery", func() {
+			check := tracker.CheckDiscovery(time.Minute)
+
+			Convey("wait for the first pass", func() {
+				message, err := check()
+				So(err, ShouldBeNil)
+				So(message, ShouldEqual, "waiting for the first discovery pass")
+
+				tracker.createdAt = time.Now().Add(-2 * time.Minute)
+				_, err = check()
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldStartWith, "no discovery pass yet")
+			})
+
+			Convey("pass when discovery has run recently", func() {
+				_ = LogCapture(func() {
+					go tracker.Run()
+					So(looper.Wait(), ShouldBeNil)
+				})
+
+				message, err := check()
+				So(err, ShouldBeNil)
+				So(message, ShouldStartWith, "last discovery pass was")
+			})
+
+			Convey("fail when discovery has wedged", func() {
+				atomic.StoreInt64(&tracker.syncedAt, time.Now().Add(-2*time.Minute).UnixNano())
+
+				_, err := check()
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "last discovery pass was 2m0s ago")
+			})
+		})
+
+		Convey("for the cache", func() {
+			check := tracker.CheckCache()
+
+			message, err := check()
+			So(err, ShouldBeNil)
+			So(message, ShouldEqual, "not persisted yet")
+
+			Convey("pass when it was persisted", func() {
+				cacheFile, err := os.CreateTemp("", "seekInfoCache*")
+				So(err, ShouldBeNil)
+				Reset(func() { os.Remove(cacheFile.Name()) })
+
+				tracker.PersistOffsets(cache.NewCache(5, cacheFile.Name()))
+
+				message, err := check()
+				So(err, ShouldBeNil)
+				So(message, ShouldStartWith, "persisted")
+			})
+
+			Convey("fail when it couldn't be persisted", func() {
+				_ = LogCapture(func() {
+					tracker.PersistOffsets(cache.NewCache(5, "/nonexistent/logtailer.json"))
+				})
+
+				_, err := check()
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldStartWith, "persisting the cache failed")
+			})
+		})
+
+		Convey("for the filter", func() {
+			var requests int
+			server, client := fakeKubeAPI(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				fmt.Fprint(w, `{"items":[]}`)
+			})
+			Reset(server.Close)
+
+			metadata := NewPodMetadataCache(client, "beowulf", time.Minute)
+			pod := &Pod{Name: "default_chopper", Namespace: "default", ServiceName: "chopper"}
+
+			Convey("pass before anything has been fetched, without calling the API", func() {
+				message, err := metadata.Check()
+				So(err, ShouldBeNil)
+				So(message, ShouldEqual, "no metadata fetched yet")
+				So(requests, ShouldEqual, 0)
+			})
+
+			Convey("say how old the metadata is", func() {
+				_, err := metadata.ServicePods(pod, "ServiceName")
+				So(err, ShouldBeNil)
+
+				message, err := metadata.Check()
+				So(err, ShouldBeNil)
+				So(message, ShouldStartWith, "fetched the metadata for 0 pods")
+				So(requests, ShouldEqual, 1)
+			})
+
+			Convey("fail when the last list did", func() {
+				server.Close()
+
+				_, err := metadata.ServicePods(pod, "ServiceName")
+				So(err, ShouldNotBeNil)
+
+				_, err = metadata.Check()
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldStartWith, "listing the pods failed")
+
+				Convey("and pass again once one works", func() {
+					metadata.Store(nil)
+
+					_, err := metadata.Check()
+					So(err, ShouldBeNil)
+				})
+			})
+
+			Convey("don't call the API when the metadata is old", func() {
+				metadata.TTL = time.Nanosecond
+				metadata.Store(nil)
+
+				_, err := metadata.Check()
+				So(err, ShouldBeNil)
+				So(requests, ShouldEqual, 0)
+			})
+		})
+
+		Convey("for the outputs", func() {
+			previous := atomic.LoadInt64(&lastDroppedAt)
+			Reset(func() { atomic.StoreInt64(&lastDroppedAt, previous) })
+
+			atomic.StoreInt64(&lastDroppedAt, 0)
+			_, err := CheckOutputs()
+			So(err, ShouldBeNil)
+
+			(&fileStats{lines: metrics.linesFor("chopper")}).dropped()
+			_, err = CheckOutputs()
+			So(err, ShouldNotBeNil)
+
+			atomic.StoreInt64(&lastDroppedAt, time.Now().Add(-2*time.Minute).UnixNano())
+			_, err = CheckOutputs()
+			So(err, ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// An HTTPServer serves our endpoints on its own ServeMux, rather than on the
+// http.DefaultServeMux where anything we import can add to them. If it has a
+// Token, every request must have it as a bearer token, except for the public
+// endpoints. It serves TLS if it has a certificate and key.
+type HTTPServer struct {
+	Name     string
+	Addr     string // Empty or "off" to turn it off
+	Token    string
+	CertFile string
+	KeyFile  string
+
+	mux    *http.ServeMux
+	public map[string]bool // The patterns that don't need the Token
+}
+
+func NewHTTPServer(name, addr string) *HTTPServer {
+	return &HTTPServer{
+		Name:   name,
+		Addr:   addr,
+		mux:    http.NewServeMux(),
+		public: make(map[string]bool),
+	}
+}
+
+// NewPprofServer returns an HTTPServer for the pprof endpoints
+func NewPprofServer(addr string) *HTTPServer {
+	server := NewHTTPServer("pprof", addr)
+	server.HandleFunc("/debug/pprof/", pprof.Index)
+	server.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	server.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	server.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	server.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return server
+}
+
+func (s *HTTPServer) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+func (s *HTTPServer) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	s.mux.HandleFunc(pattern, handler)
+}
+
+// HandlePublic adds an endpoint that doesn't need the Token, e.g. for the
+// Kubernetes probes, or one that checks a token of its own
+func (s *HTTPServer) HandlePublic(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+	s.public[pattern] = true
+}
+
+// Enabled returns false if the server was turned off
+func (s *HTTPServer) Enabled() bool {
+	return s.Addr != "" && s.Addr != "off"
+}
+
+// Validate returns an error if the TLS settings don't make sense
+func (s *HTTPServer) Validate() error {
+	if (s.CertFile == "") != (s.KeyFile == "") {
+		return errors.New("TLS needs both a certificate and a key")
+	}
+
+	return nil
+}
+
+// ServeHTTP checks the Token before handing the request to the endpoint
+func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" {
+		if _, pattern := s.mux.Handler(r); !s.public[pattern] && !hasBearerToken(r, s.Token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="logtailer"`)
+			http.Error(w, "a valid bearer token is required", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	s.mux.ServeHTTP(w, r)
+}
+
+// Start serves the endpoints in the background, unless the server was
+// turned off
+func (s *HTTPServer) Start() {
+	if !s.Enabled() {
+		log.Infof("The %s server is turned off", s.Name)
+		return
+	}
+
+	server := &http.Server{Addr: s.Addr, Handler: s}
+
+	go func() {
+		var err error
+		if s.CertFile != "" {
+			log.Infof("Starting %s server on %s with TLS", s.Name, s.Addr)
+			err = server.ListenAndServeTLS(s.CertFile, s.KeyFile)
+		} else {
+			log.Infof("Starting %s server on %s", s.Name, s.Addr)
+			err = server.ListenAndServe()
+		}
+
+		if err != nil {
+			log.Errorf("The %s server failed: %s", s.Name, err)
+		}
+	}()
+}
+
+// hasBearerToken checks the bearer token on a request, without giving away
+// how much of it matched
+func hasBearerToken(r *http.Request, token string) bool {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" || given == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
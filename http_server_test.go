@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_HTTPServer(t *testing.T) {
+	Convey("HTTPServer", t, func() {
+		server := NewHTTPServer("state", ":8080")
+		server.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "pods") })
+		server.HandlePublic("/healthz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "ok")
+		}))
+
+		serve := func(path, token string) *httptest.ResponseRecorder {
+			request := httptest.NewRequest("GET", path, nil)
+			if token != "" {
+				request.Header.Set("Authorization", "Bearer "+token)
+			}
+
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, request)
+			return recorder
+		}
+
+		Convey("serves its own endpoints, and nothing else", func() {
+			So(serve("/state", "").Body.String(), ShouldEqual, "pods")
+			So(serve("/debug/pprof/", "").Code, ShouldEqual, 404)
+		})
+
+		Convey("requires the token when it has one", func() {
+			server.Token = "secret"
+
+			So(serve("/state", "").Code, ShouldEqual, 401)
+			So(serve("/state", "guess").Code, ShouldEqual, 401)
+			So(serve("/state", "secret").Body.String(), ShouldEqual, "pods")
+
+			Convey("as a bearer token, not on its own", func() {
+				request := httptest.NewRequest("GET", "/state", nil)
+				request.Header.Set("Authorization", "secret")
+
+				recorder := httptest.NewRecorder()
+				server.ServeHTTP(recorder, request)
+				So(recorder.Code, ShouldEqual, 401)
+			})
+
+			Convey("except for the public endpoints", func() {
+				So(serve("/healthz", "").Body.String(), ShouldEqual, "ok")
+			})
+		})
+
+		Convey("can be turned off", func() {
+			So(server.Enabled(), ShouldBeTrue)
+			So(NewHTTPServer("state", "").Enabled(), ShouldBeFalse)
+			So(NewHTTPServer("state", "off").Enabled(), ShouldBeFalse)
+		})
+
+		Convey("needs both a certificate and a key for TLS", func() {
+			So(server.Validate(), ShouldBeNil)
+
+			server.CertFile = "cert.pem"
+			So(server.Validate(), ShouldNotBeNil)
+
+			server.KeyFile = "key.pem"
+			So(server.Validate(), ShouldBeNil)
+		})
+
+		Convey("serves TLS", func() {
+			dir := t.TempDir()
+			server.CertFile, server.KeyFile = writeTestCert(dir)
+			server.Addr = freeAddress()
+
+			_ = LogCapture(server.Start)
+
+			client := &http.Client{
+				Timeout:   time.Second,
+				Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+			}
+
+			var resp *http.Response
+			var err error
+			for i := 0; i < 50; i++ {
+				resp, err = client.Get("https://" + server.Addr + "/state")
+				if err == nil {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+
+			body, _ := io.ReadAll(resp.Body)
+			So(string(body), ShouldEqual, "pods")
+		})
+	})
+
+	Convey("The pprof server serves the profiles", t, func() {
+		server := NewPprofServer("localhost:8081")
+
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/pprof/", nil))
+		So(recorder.Code, ShouldEqual, 200)
+	})
+}
+
+// freeAddress returns a local address nothing is listening on
+func freeAddress() string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().String()
+}
+
+// writeTestCert writes a self-signed certificate and its key to a directory
+func writeTestCert(dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	So(err, ShouldBeNil)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "logtailer"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	So(err, ShouldBeNil)
+
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	So(err, ShouldBeNil)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	So(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0600), ShouldBeNil)
+	So(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600), ShouldBeNil)
+
+	return certFile, keyFile
+}
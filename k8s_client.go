@@ -0,0 +1,246 @@
+package main
+
+// The bulk of this comes from https://github.com/NinesStack/sidecar
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cleanhttp "github.com/hashicorp/go-cleanhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// errResourceGone is returned when the API server no longer has the resource
+// version we asked to watch from, and we have to list again
+var errResourceGone = errors.New("resource version is too old")
+
+// A KubeClient makes authenticated requests to the Kubernetes API using the
+// service account credentials mounted into the pod, or those from a kubeconfig.
+// Service account tokens are rotated, so we read the token again whenever the
+// file changes.
+type KubeClient struct {
+	Timeout time.Duration
+
+	KubeHost string
+	KubePort int
+	// KubeScheme is http or https. If it isn't set, we use https for port 443.
+	KubeScheme string
+
+	basePath   string // From the kubeconfig server URL, when behind a proxy
+	tokenFile  string
+	token      string
+	tokenMtime time.Time
+	tokenLock  sync.Mutex
+	client     *http.Client
+}
+
+// NewKubeClient returns a configured KubeClient, or nil if the credentials
+// can't be read.
+func NewKubeClient(kubeHost string, kubePort int, timeout time.Duration, credsPath string) *KubeClient {
+	c := &KubeClient{
+		Timeout:   timeout,
+		KubeHost:  kubeHost,
+		KubePort:  kubePort,
+		tokenFile: credsPath + "/token",
+	}
+	// Cache the secret from the file
+	err := c.loadToken(true)
+	if err != nil {
+		log.Errorf("Failed to read serviceaccount token: %s", err)
+		return nil
+	}
+
+	// Get the SystemCertPool — on error we have empty pool
+	rootCAs, _ := x509.SystemCertPool()
+	if rootCAs == nil {
+		rootCAs = x509.NewCertPool()
+	}
+
+	certs, err := ioutil.ReadFile(credsPath + "/ca.crt")
+	if err != nil {
+		log.Warnf("Failed to load CA cert file: %s", err)
+	}
+
+	if ok := rootCAs.AppendCertsFromPEM(certs); !ok {
+		log.Warn("No certs appended! Using system certs only")
+	}
+
+	// Add the pool to the TLS config we'll use in the client.
+	c.setTLSConfig(&tls.Config{
+		RootCAs: rootCAs,
+	})
+
+	return c
+}
+
+// setTLSConfig sets up the timeout and TLS config on a clean HTTP client
+func (c *KubeClient) setTLSConfig(config *tls.Config) {
+	c.client = cleanhttp.DefaultClient()
+	c.client.Timeout = c.Timeout
+	c.client.Transport = &http.Transport{TLSClientConfig: config}
+}
+
+// loadToken reads the token from its file if the file has changed since we
+// last read it, or always if force is set. The kubelet replaces the file when
+// it rotates the token.
+func (c *KubeClient) loadToken(force bool) error {
+	if c.tokenFile == "" {
+		return nil
+	}
+
+	info, err := os.Stat(c.tokenFile)
+	if err != nil {
+		return err
+	}
+
+	c.tokenLock.Lock()
+	defer c.tokenLock.Unlock()
+
+	if !force && info.ModTime().Equal(c.tokenMtime) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(c.tokenFile)
+	if err != nil {
+		return err
+	}
+
+	// New line is illegal in tokens
+	c.token = strings.Replace(string(data), "\n", "", -1)
+	c.tokenMtime = info.ModTime()
+
+	return nil
+}
+
+// currentToken returns the token, having read it again if it changed. If we
+// can't read it, we carry on with the one we have.
+func (c *KubeClient) currentToken() string {
+	err := c.loadToken(false)
+	if err != nil {
+		log.Warnf("Failed to reload serviceaccount token, using the previous one: %s", err)
+	}
+
+	c.tokenLock.Lock()
+	defer c.tokenLock.Unlock()
+
+	return c.token
+}
+
+// newRequest builds an authenticated GET request for a path on the API
+func (c *KubeClient) newRequest(path string) (*http.Request, error) {
+	var scheme = c.KubeScheme
+	if scheme == "" {
+		scheme = "http"
+		if c.KubePort == 443 {
+			scheme = "https"
+		}
+	}
+
+	// Start with the path, then add the host and scheme
+	apiURL, err := url.Parse(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the path! %s: %w", path, err)
+	}
+	apiURL.Scheme = scheme
+	apiURL.Host = net.JoinHostPort(c.KubeHost, strconv.Itoa(c.KubePort))
+	apiURL.Path = c.basePath + apiURL.Path
+
+	req, err := http.NewRequest("GET", apiURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", "logtailer/"+Version)
+	if token := c.currentToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return req, nil
+}
+
+// do makes a request with the given client. If the API says we aren't
+// authorized, the token may have been rotated before we noticed, so we read
+// it again and retry once.
+func (c *KubeClient) do(ctx context.Context, client *http.Client, path string) (*http.Response, error) {
+	req, err := c.newRequest(path)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || c.tokenFile == "" {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	log.Warnf("Unauthorized by K8s API for '%s', reloading the token and retrying", path)
+	err = c.loadToken(true)
+	if err != nil {
+		log.Warnf("Failed to reload serviceaccount token: %s", err)
+	}
+
+	req, err = c.newRequest(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.Do(req.WithContext(ctx))
+}
+
+func (c *KubeClient) makeRequest(path string) ([]byte, error) {
+	resp, err := c.do(context.Background(), c.client, path)
+	if err != nil {
+		return []byte{}, fmt.Errorf("failed to fetch from K8s API '%s': %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 299 || resp.StatusCode < 200 {
+		return []byte{}, fmt.Errorf("got unexpected response code from %s: %d", path, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return []byte{}, fmt.Errorf("failed to read from K8s API '%s' response body: %w", path, err)
+	}
+
+	return body, nil
+}
+
+// streamRequest makes a long-running request, e.g. a watch, and returns the
+// response body for the caller to read from and close. The client timeout
+// doesn't apply, the server is expected to end the request or the context
+// to be cancelled.
+func (c *KubeClient) streamRequest(ctx context.Context, path string) (io.ReadCloser, error) {
+	streamClient := *c.client
+	streamClient.Timeout = 0
+
+	resp, err := c.do(ctx, &streamClient, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stream from K8s API '%s': %w", path, err)
+	}
+
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, fmt.Errorf("got %d from %s: %w", resp.StatusCode, path, errResourceGone)
+	}
+
+	if resp.StatusCode > 299 || resp.StatusCode < 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("got unexpected response code from %s: %d", path, resp.StatusCode)
+	}
+
+	return resp.Body, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_KubeClientTokens(t *testing.T) {
+	Convey("KubeClient service account tokens", t, func() {
+		dir := t.TempDir()
+		tokenFile := filepath.Join(dir, "token")
+		So(os.WriteFile(tokenFile, []byte("first-token\n"), 0644), ShouldBeNil)
+
+		var auths []string
+		server, client := fakeKubeAPI(func(w http.ResponseWriter, r *http.Request) {
+			auth := r.Header.Get("Authorization")
+			auths = append(auths, auth)
+
+			if auth != "Bearer second-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{}`)
+		})
+		Reset(server.Close)
+
+		client.tokenFile = tokenFile
+		So(client.loadToken(true), ShouldBeNil)
+
+		// Pretend it was written a while ago, so a rewrite changes the time
+		past := time.Now().Add(-time.Hour)
+		So(os.Chtimes(tokenFile, past, past), ShouldBeNil)
+		So(client.loadToken(true), ShouldBeNil)
+
+		Convey("reads the token again when the file changes", func() {
+			So(os.WriteFile(tokenFile, []byte("second-token\n"), 0644), ShouldBeNil)
+
+			_, err := client.makeRequest("/api/v1/pods")
+			So(err, ShouldBeNil)
+			So(auths, ShouldResemble, []string{"Bearer second-token"})
+		})
+
+		Convey("reads the token again and retries once on a 401", func() {
+			So(os.WriteFile(tokenFile, []byte("second-token\n"), 0644), ShouldBeNil)
+			So(os.Chtimes(tokenFile, past, past), ShouldBeNil)
+
+			var err error
+			capture := LogCapture(func() {
+				_, err = client.makeRequest("/api/v1/pods")
+			})
+			So(err, ShouldBeNil)
+			So(auths, ShouldResemble, []string{"Bearer first-token", "Bearer second-token"})
+			So(capture, ShouldContainSubstring, "reloading the token and retrying")
+		})
+
+		Convey("only retries once", func() {
+			_, err := client.makeRequest("/api/v1/pods")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "401")
+			So(auths, ShouldHaveLength, 2)
+		})
+
+		Convey("keeps the token it has if the file goes away", func() {
+			So(os.Remove(tokenFile), ShouldBeNil)
+
+			capture := LogCapture(func() {
+				So(client.currentToken(), ShouldEqual, "first-token")
+			})
+			So(capture, ShouldContainSubstring, "using the previous one")
+		})
+	})
+}
+
+// writeKubeconfig writes a kubeconfig for the server with the given user
+func writeKubeconfig(dir string, server *httptest.Server, user string) string {
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	config := fmt.Sprintf(`apiVersion: v1
+kind: Config
+current-context: debugging
+clusters:
+- name: beowulf
+  cluster:
+    server: %s/proxy
+    certificate-authority-data: %s
+contexts:
+- name: other
+  context:
+    cluster: nowhere
+    user: nobody
+- name: debugging
+  context:
+    cluster: beowulf
+    user: me
+users:
+- name: me
+  user:
+%s
+`, server.URL, base64.StdEncoding.EncodeToString(ca), user)
+
+	path := filepath.Join(dir, "config")
+	So(os.WriteFile(path, []byte(config), 0600), ShouldBeNil)
+
+	return path
+}
+
+// clientCertificate makes a self-signed client certificate and key
+func clientCertificate() ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	So(err, ShouldBeNil)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "logtailer-debugging"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	So(err, ShouldBeNil)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	So(err, ShouldBeNil)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func Test_NewKubeClientFromKubeconfig(t *testing.T) {
+	Convey("NewKubeClientFromKubeconfig()", t, func() {
+		dir := t.TempDir()
+
+		var requestedPath, auth, commonName string
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestedPath = r.URL.String()
+			auth = r.Header.Get("Authorization")
+			if len(r.TLS.PeerCertificates) > 0 {
+				commonName = r.TLS.PeerCertificates[0].Subject.CommonName
+			}
+			fmt.Fprint(w, `{}`)
+		}))
+		server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+		server.StartTLS()
+		Reset(server.Close)
+
+		Convey("uses the server, CA and token from the current context", func() {
+			path := writeKubeconfig(dir, server, "    token: my-token")
+
+			client, err := NewKubeClientFromKubeconfig(path, time.Second)
+			So(err, ShouldBeNil)
+			So(client.KubeScheme, ShouldEqual, "https")
+
+			_, err = client.makeRequest("/api/v1/pods?fieldSelector=spec.nodeName%3Dbeowulf")
+			So(err, ShouldBeNil)
+			So(requestedPath, ShouldEqual, "/proxy/api/v1/pods?fieldSelector=spec.nodeName%3Dbeowulf")
+			So(auth, ShouldEqual, "Bearer my-token")
+			So(commonName, ShouldBeEmpty)
+		})
+
+		Convey("uses a client certificate from files next to it", func() {
+			cert, key := clientCertificate()
+			So(os.WriteFile(filepath.Join(dir, "me.crt"), cert, 0600), ShouldBeNil)
+			So(os.WriteFile(filepath.Join(dir, "me.key"), key, 0600), ShouldBeNil)
+
+			path := writeKubeconfig(dir, server, "    client-certificate: me.crt\n    client-key: me.key")
+
+			client, err := NewKubeClientFromKubeconfig(path, time.Second)
+			So(err, ShouldBeNil)
+
+			_, err = client.makeRequest("/api/v1/pods")
+			So(err, ShouldBeNil)
+			So(auth, ShouldBeEmpty)
+			So(commonName, ShouldEqual, "logtailer-debugging")
+		})
+
+		Convey("skips files in the list that don't exist", func() {
+			path := writeKubeconfig(dir, server, "    token: my-token")
+
+			client, err := NewKubeClientFromKubeconfig(
+				filepath.Join(dir, "missing")+string(os.PathListSeparator)+path, time.Second,
+			)
+			So(err, ShouldBeNil)
+			So(client, ShouldNotBeNil)
+
+			_, err = NewKubeClientFromKubeconfig(filepath.Join(dir, "missing"), time.Second)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("errors on users it can't authenticate as", func() {
+			path := writeKubeconfig(dir, server, "    exec:\n      command: aws")
+
+			_, err := NewKubeClientFromKubeconfig(path, time.Second)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "has no token or client certificate")
+		})
+
+		Convey("errors when the current context doesn't exist", func() {
+			path := writeKubeconfig(dir, server, "    token: my-token")
+			data, err := os.ReadFile(path)
+			So(err, ShouldBeNil)
+			So(os.WriteFile(path, []byte(strings.Replace(string(data), "current-context: debugging", "current-context: gone", 1)), 0600), ShouldBeNil)
+
+			_, err = NewKubeClientFromKubeconfig(path, time.Second)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, `context "gone" not found`)
+		})
+	})
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// The kubelet puts this on the mirror pods of static pods, set to the
+	// hash of the pod's config
+	mirrorPodAnnotation = "kubernetes.io/config.mirror"
+)
+
+var (
+	// CronJobs name their Jobs <cronjob>-<scheduled time in minutes>
+	cronJobSuffixRegexp = regexp.MustCompile(`-[0-9]{8,}$`)
+)
+
+// K8sPodList is the part of a pod list from the Kubernetes API that we use
+type K8sPodList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []K8sPod `json:"items"`
+}
+
+// K8sPod is the part of a pod from the Kubernetes API that we use
+type K8sPod struct {
+	Metadata struct {
+		Name            string              `json:"name"`
+		Namespace       string              `json:"namespace"`
+		UID             string              `json:"uid"`
+		Labels          map[string]string   `json:"labels"`
+		Annotations     map[string]string   `json:"annotations"`
+		OwnerReferences []K8sOwnerReference `json:"ownerReferences"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+}
+
+// K8sOwnerReference points at the workload that created a pod
+type K8sOwnerReference struct {
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Controller bool   `json:"controller"`
+}
+
+// LogDir returns the name of the directory under /var/log/pods where the
+// kubelet puts this pod's logs. Static pods are logged under the hash of
+// their config, not the UID of the mirror pod that the API shows us.
+func (p *K8sPod) LogDir() string {
+	uid := p.Metadata.UID
+	if hash := p.Metadata.Annotations[mirrorPodAnnotation]; hash != "" {
+		uid = hash
+	}
+
+	return p.Metadata.Namespace + "_" + p.Metadata.Name + "_" + uid
+}
+
+// Owner returns the kind and name of the controller that owns the pod, if any
+func (p *K8sPod) Owner() (string, string) {
+	refs := p.Metadata.OwnerReferences
+	for _, ref := range refs {
+		if ref.Controller {
+			return ref.Kind, ref.Name
+		}
+	}
+
+	if len(refs) > 0 {
+		return refs[0].Kind, refs[0].Name
+	}
+
+	return "", ""
+}
+
+// ServiceName works out which service the pod belongs to. The service label
+// wins if it is there, otherwise we use the name of the workload that owns the
+// pod.
+func (p *K8sPod) ServiceName(serviceLabel string) string {
+	if name := p.Metadata.Labels[serviceLabel]; name != "" {
+		return name
+	}
+
+	kind, owner := p.Owner()
+	switch kind {
+	case "ReplicaSet":
+		// Deployments name their ReplicaSets <deployment>-<pod-template-hash>
+		if hash := p.Metadata.Labels["pod-template-hash"]; hash != "" {
+			return strings.TrimSuffix(owner, "-"+hash)
+		}
+		return owner
+	case "Job":
+		return cronJobSuffixRegexp.ReplaceAllString(owner, "")
+	case "Node":
+		// Static pods are named <name>-<node name>
+		return strings.TrimSuffix(p.Metadata.Name, "-"+p.Spec.NodeName)
+	case "":
+		return p.Metadata.Name
+	default:
+		// StatefulSets, DaemonSets and the like use their own names
+		return owner
+	}
+}
+
+// A K8sDiscoverer finds the pods on this node by asking the Kubernetes API,
+// rather than by parsing the names of the log directories. Logs are still
+// found on the filesystem.
+type K8sDiscoverer struct {
+	Dir           string
+	Environment   string
+	NodeName      string
+	RetryInterval time.Duration
+	ServiceLabel  string
+
+	// Metadata is given each list of pods, so it doesn't have to make its own
+	Metadata *PodMetadataCache
+
+	client   *KubeClient
+	dirs     *DirListDiscoverer
+	ctx      context.Context
+	quitFunc context.CancelFunc
+	changeNotifier
+}
+
+// NewK8sDiscoverer returns a K8sDiscoverer for the pods on the named node,
+// whose logs are in path.
+func NewK8sDiscoverer(client *KubeClient, nodeName, path, environment string) *K8sDiscoverer {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &K8sDiscoverer{
+		Dir:           path,
+		Environment:   environment,
+		NodeName:      nodeName,
+		RetryInterval: 5 * time.Second,
+		ServiceLabel:  DefaultFilterKeys.ServiceLabel,
+		client:        client,
+		dirs:          NewDirListDiscoverer(path, environment),
+		ctx:           ctx,
+		quitFunc:      cancel,
+
+		changeNotifier: newChangeNotifier(),
+	}
+}
+
+// podsPath is the API path for listing the pods on our node
+func (d *K8sDiscoverer) podsPath() string {
+	return "/api/v1/pods?fieldSelector=" + url.QueryEscape("spec.nodeName="+d.NodeName)
+}
+
+// Discover lists the pods on this node and returns those that have a log
+// directory
+func (d *K8sDiscoverer) Discover() ([]*Pod, error) {
+	body, err := d.client.makeRequest(d.podsPath())
+	if err != nil {
+		return nil, fmt.Errorf("discovery failed: %w", err)
+	}
+
+	var podList K8sPodList
+	err = json.Unmarshal(body, &podList)
+	if err != nil {
+		return nil, fmt.Errorf("discovery failed, unable to decode response from K8s: %w", err)
+	}
+
+	d.Metadata.Store(podList.Items)
+
+	var pods []*Pod
+	for _, item := range podList.Items {
+		logDir := item.LogDir()
+
+		// Scheduled, but the kubelet hasn't started it yet
+		if _, err := os.Stat(filepath.Join(d.Dir, logDir)); err != nil {
+			log.Debugf("No log directory yet for %s/%s", item.Metadata.Namespace, item.Metadata.Name)
+			continue
+		}
+
+		ownerKind, ownerName := item.Owner()
+
+		pods = append(pods, &Pod{
+			Name:        logDir,
+			Namespace:   item.Metadata.Namespace,
+			ServiceName: item.ServiceName(d.ServiceLabel),
+			Environment: d.Environment,
+			PodName:     item.Metadata.Name,
+			UID:         item.Metadata.UID,
+			NodeName:    item.Spec.NodeName,
+			Labels:      item.Metadata.Labels,
+			OwnerKind:   ownerKind,
+			OwnerName:   ownerName,
+		})
+	}
+
+	return pods, nil
+}
+
+// LogFiles retrieves all the current logs for the pod requested
+func (d *K8sDiscoverer) LogFiles(podName string) ([]string, error) {
+	return d.dirs.LogFiles(podName)
+}
+
+// Run watches the API for pods coming and going on this node and notifies
+// on the Changes channel. It runs in the background until Stop() is called.
+func (d *K8sDiscoverer) Run() {
+	go func() {
+		defer d.closeChanges()
+
+		var resourceVersion string
+		for {
+			var err error
+			if resourceVersion == "" {
+				resourceVersion, err = d.listVersion()
+			}
+			if err == nil {
+				resourceVersion, err = d.watch(resourceVersion)
+			}
+			if d.ctx.Err() != nil {
+				return
+			}
+
+			if errors.Is(err, errResourceGone) {
+				// We may have missed events, so discovery should take a fresh look
+				log.Infof("Watch of pods on %s expired, listing them again", d.NodeName)
+				resourceVersion = ""
+				d.notify()
+			} else if err != nil {
+				log.Warnf("Watching pods on %s failed, retrying: %s", d.NodeName, err)
+			}
+
+			select {
+			case <-d.ctx.Done():
+				return
+			case <-time.After(d.RetryInterval):
+			}
+		}
+	}()
+}
+
+// Stop ends the watch, which will close the Changes channel
+func (d *K8sDiscoverer) Stop() {
+	d.quitFunc()
+}
+
+// listVersion lists the pods on the node to find the resource version to
+// start watching from
+func (d *K8sDiscoverer) listVersion() (string, error) {
+	body, err := d.client.makeRequest(d.podsPath())
+	if err != nil {
+		return "", err
+	}
+
+	var podList K8sPodList
+	err = json.Unmarshal(body, &podList)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode pod list: %w", err)
+	}
+
+	return podList.Metadata.ResourceVersion, nil
+}
+
+// watch streams events about pods on the node, from the resource version
+// given, until the API server ends the request. We don't care what the events
+// are, discovery will find out. It returns the resource version to carry on
+// from next time.
+func (d *K8sDiscoverer) watch(resourceVersion string) (string, error) {
+	path := d.podsPath() + "&watch=true&timeoutSeconds=300&allowWatchBookmarks=true"
+	if resourceVersion != "" {
+		path += "&resourceVersion=" + url.QueryEscape(resourceVersion)
+	}
+
+	body, err := d.client.streamRequest(d.ctx, path)
+	if err != nil {
+		return resourceVersion, err
+	}
+	defer body.Close()
+
+	decoder := json.NewDecoder(body)
+	for {
+		// The object is a pod, or a Status for ERROR events
+		var event struct {
+			Type   string `json:"type"`
+			Object struct {
+				Code     int `json:"code"`
+				Metadata struct {
+					ResourceVersion string `json:"resourceVersion"`
+				} `json:"metadata"`
+			} `json:"object"`
+		}
+
+		err := decoder.Decode(&event)
+		if errors.Is(err, io.EOF) {
+			return resourceVersion, nil
+		}
+		if err != nil {
+			return resourceVersion, fmt.Errorf("unable to decode watch event: %w", err)
+		}
+
+		if event.Type == "ERROR" {
+			if event.Object.Code == http.StatusGone {
+				return "", errResourceGone
+			}
+			return resourceVersion, fmt.Errorf("got an error event from the watch: %d", event.Object.Code)
+		}
+
+		if version := event.Object.Metadata.ResourceVersion; version != "" {
+			resourceVersion = version
+		}
+
+		// Bookmarks only move the resource version on
+		if event.Type != "BOOKMARK" {
+			d.notify()
+		}
+	}
+}
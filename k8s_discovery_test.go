@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const podListFixture = `{"items":[
+	{"metadata":{"name":"chopper-f5b66c6bf-cgslk","namespace":"default","uid":"9df92617-0407-470e-8182-a506aa7e0499",
+		"labels":{"pod-template-hash":"f5b66c6bf","team":"choppers"},
+		"ownerReferences":[{"kind":"ReplicaSet","name":"chopper-f5b66c6bf","controller":true}]},
+	 "spec":{"nodeName":"beowulf"}},
+	{"metadata":{"name":"volume-backup-27831080-t4tp8","namespace":"default","uid":"96e91ffd-9f57-438f-a2aa-614dbcae7c04",
+		"ownerReferences":[{"kind":"Job","name":"volume-backup-27831080","controller":true}]},
+	 "spec":{"nodeName":"beowulf"}},
+	{"metadata":{"name":"envoy-l5sqg","namespace":"projectcontour","uid":"49fa45e4-e70c-4a4e-ac56-1e99cb6d36fb",
+		"labels":{"ServiceName":"contour-envoy"},
+		"ownerReferences":[{"kind":"DaemonSet","name":"envoy","controller":true}]},
+	 "spec":{"nodeName":"beowulf"}},
+	{"metadata":{"name":"not-started-yet","namespace":"default","uid":"00000000-0000-0000-0000-000000000000"},
+	 "spec":{"nodeName":"beowulf"}}
+]}`
+
+// fakeKubeAPI starts a local server standing in for the Kubernetes API and
+// returns a KubeClient pointed at it
+func fakeKubeAPI(handler http.HandlerFunc) (*httptest.Server, *KubeClient) {
+	server := httptest.NewServer(handler)
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	return server, NewKubeClient(host, portNum, 100*time.Millisecond, credsPath)
+}
+
+func Test_K8sDiscoverer(t *testing.T) {
+	Convey("K8sDiscoverer", t, func() {
+		var requestedPath string
+		var auth string
+
+		server, client := fakeKubeAPI(func(w http.ResponseWriter, r *http.Request) {
+			requestedPath = r.URL.String()
+			auth = r.Header.Get("Authorization")
+			fmt.Fprint(w, podListFixture)
+		})
+		Reset(server.Close)
+
+		disco := NewK8sDiscoverer(client, "beowulf", fixturesDir, "dev")
+
+		Convey("lists only the pods on this node", func() {
+			_, err := disco.Discover()
+			So(err, ShouldBeNil)
+			So(requestedPath, ShouldEqual, "/api/v1/pods?fieldSelector=spec.nodeName%3Dbeowulf")
+			So(auth, ShouldContainSubstring, "this would be a token")
+		})
+
+		Convey("returns pods that have log directories", func() {
+			pods, err := disco.Discover()
+			So(err, ShouldBeNil)
+			So(len(pods), ShouldEqual, 3)
+
+			So(pods[0].Name, ShouldEqual, "default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499")
+			So(pods[0].PodName, ShouldEqual, "chopper-f5b66c6bf-cgslk")
+			So(pods[0].Namespace, ShouldEqual, "default")
+			So(pods[0].UID, ShouldEqual, "9df92617-0407-470e-8182-a506aa7e0499")
+			So(pods[0].NodeName, ShouldEqual, "beowulf")
+			So(pods[0].Environment, ShouldEqual, "dev")
+			So(pods[0].Labels["team"], ShouldEqual, "choppers")
+			So(pods[0].OwnerKind, ShouldEqual, "ReplicaSet")
+			So(pods[0].OwnerName, ShouldEqual, "chopper-f5b66c6bf")
+		})
+
+		Convey("works out the service name from the owner or the labels", func() {
+			pods, err := disco.Discover()
+			So(err, ShouldBeNil)
+			So(len(pods), ShouldEqual, 3)
+
+			So(pods[0].ServiceName, ShouldEqual, "chopper")
+			So(pods[1].ServiceName, ShouldEqual, "volume-backup")
+			So(pods[2].ServiceName, ShouldEqual, "contour-envoy")
+		})
+
+		Convey("shares the pods it lists with the metadata", func() {
+			disco.Metadata = NewPodMetadataCache(client, "beowulf", time.Minute)
+
+			_, err := disco.Discover()
+			So(err, ShouldBeNil)
+			So(disco.Metadata.Stats().Pods, ShouldEqual, 4)
+			So(disco.Metadata.Stats().APICalls, ShouldEqual, 0)
+		})
+
+		Convey("finds log files on the filesystem", func() {
+			logs, err := disco.LogFiles("default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499")
+			So(err, ShouldBeNil)
+			So(len(logs), ShouldEqual, 4)
+		})
+
+		Convey("errors when the API does", func() {
+			server, client := fakeKubeAPI(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusForbidden)
+			})
+			Reset(server.Close)
+
+			disco := NewK8sDiscoverer(client, "beowulf", fixturesDir, "dev")
+			pods, err := disco.Discover()
+
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "discovery failed")
+			So(pods, ShouldBeNil)
+		})
+
+		Convey("notifies when the watch sees a change", func() {
+			server, client := fakeKubeAPI(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("watch") != "true" {
+					fmt.Fprint(w, podListFixture)
+					return
+				}
+				fmt.Fprintln(w, `{"type":"ADDED","object":{"metadata":{"name":"chopper-f5b66c6bf-cgslk"}}}`)
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+			})
+			Reset(server.Close)
+
+			disco := NewK8sDiscoverer(client, "beowulf", fixturesDir, "dev")
+			disco.Run()
+
+			changed := waitForChange(disco.Changes())
+
+			// Have to end the watch before the server can shut down
+			disco.Stop()
+			So(changed, ShouldBeTrue)
+		})
+
+		Convey("when the watch reconnects", func() {
+			lists, watchCount := 0, 0
+			watches := make(chan string, 10)
+
+			// Each list has a new resource version. The first watch sees one
+			// change, then ends how the test says.
+			endWatch := func(w http.ResponseWriter) {}
+			server, client := fakeKubeAPI(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("watch") != "true" {
+					lists += 1
+					fmt.Fprintf(w, `{"metadata":{"resourceVersion":"%d00"},"items":[]}`, lists)
+					return
+				}
+
+				watchCount += 1
+				watches <- r.URL.Query().Get("resourceVersion")
+				if watchCount > 1 {
+					<-r.Context().Done()
+					return
+				}
+				fmt.Fprintln(w, `{"type":"ADDED","object":{"metadata":{"name":"chopper","resourceVersion":"101"}}}`)
+				endWatch(w)
+			})
+			Reset(server.Close)
+
+			disco := NewK8sDiscoverer(client, "beowulf", fixturesDir, "dev")
+			disco.RetryInterval = time.Millisecond
+
+			nextWatch := func() string {
+				select {
+				case version := <-watches:
+					return version
+				case <-time.After(time.Second):
+					return "timed out"
+				}
+			}
+
+			Convey("carries on from the last resource version it saw", func() {
+				capture := LogCapture(func() {
+					disco.Run()
+					So(nextWatch(), ShouldEqual, "100")
+					So(nextWatch(), ShouldEqual, "101")
+					disco.Stop()
+				})
+
+				So(capture, ShouldNotContainSubstring, "failed")
+			})
+
+			Convey("lists again when the resource version has expired", func() {
+				endWatch = func(w http.ResponseWriter) {
+					fmt.Fprintln(w, `{"type":"ERROR","object":{"kind":"Status","code":410,"reason":"Expired"}}`)
+				}
+
+				capture := LogCapture(func() {
+					disco.Run()
+					So(nextWatch(), ShouldEqual, "100")
+					So(nextWatch(), ShouldEqual, "200")
+					disco.Stop()
+				})
+
+				So(capture, ShouldContainSubstring, "listing them again")
+			})
+		})
+
+		Convey("closes the channel when stopped", func() {
+			disco.RetryInterval = time.Millisecond
+			_ = LogCapture(func() {
+				disco.Run()
+				disco.Stop()
+
+				_, ok := <-disco.Changes()
+				So(ok, ShouldBeFalse)
+			})
+		})
+	})
+}
+
+func Test_K8sPodServiceName(t *testing.T) {
+	Convey("K8sPod.ServiceName()", t, func() {
+		pod := &K8sPod{}
+		pod.Metadata.Name = "kube-proxy-beowulf"
+		pod.Spec.NodeName = "beowulf"
+
+		Convey("handles static pods", func() {
+			pod.Metadata.OwnerReferences = append(pod.Metadata.OwnerReferences, K8sOwnerReference{Kind: "Node", Name: "beowulf", Controller: true})
+
+			So(pod.ServiceName("ServiceName"), ShouldEqual, "kube-proxy")
+		})
+
+		Convey("handles StatefulSets", func() {
+			pod.Metadata.Name = "postgres-0"
+			pod.Metadata.OwnerReferences = append(pod.Metadata.OwnerReferences, K8sOwnerReference{Kind: "StatefulSet", Name: "postgres", Controller: true})
+
+			So(pod.ServiceName("ServiceName"), ShouldEqual, "postgres")
+		})
+
+		Convey("falls back to the pod name for bare pods", func() {
+			pod.Metadata.Name = "debugging"
+
+			So(pod.ServiceName("ServiceName"), ShouldEqual, "debugging")
+		})
+	})
+}
+
+func Test_K8sPodLogDir(t *testing.T) {
+	Convey("K8sPod.LogDir()", t, func() {
+		pod := &K8sPod{}
+		pod.Metadata.Name = "chopper-f5b66c6bf-cgslk"
+		pod.Metadata.Namespace = "default"
+		pod.Metadata.UID = "9df92617-0407-470e-8182-a506aa7e0499"
+
+		Convey("uses the pod's UID", func() {
+			So(pod.LogDir(), ShouldEqual, "default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499")
+		})
+
+		Convey("uses the config hash for mirror pods", func() {
+			pod.Metadata.Name = "kube-apiserver-beowulf"
+			pod.Metadata.Namespace = "kube-system"
+			pod.Metadata.UID = "5b1a5d6e-3c0c-4d0f-9a38-2f4c8e0f9d11"
+			pod.Metadata.Annotations = map[string]string{
+				"kubernetes.io/config.hash":   "8d5e4a9a1b6b3c2f0e7d9c8b7a6f5e4d",
+				"kubernetes.io/config.mirror": "8d5e4a9a1b6b3c2f0e7d9c8b7a6f5e4d",
+			}
+
+			So(pod.LogDir(), ShouldEqual, "kube-system_kube-apiserver-beowulf_8d5e4a9a1b6b3c2f0e7d9c8b7a6f5e4d")
+		})
+	})
+}
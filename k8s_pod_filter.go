@@ -3,154 +3,212 @@ package main
 // The bulk of this comes from https://github.com/NinesStack/sidecar
 
 import (
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
-
-	cleanhttp "github.com/hashicorp/go-cleanhttp"
-	log "github.com/sirupsen/logrus"
 )
 
-type K8sPodsMetadata struct {
-	Items []struct {
-		Metadata struct {
-			Annotations struct {
-				CommunityComTailLogs string `json:"community.com/TailLogs"`
-			} `json:"annotations"`
-		} `json:"metadata"`
-	} `json:"items"`
+// FilterKeys are the label and annotation that the PodFilter looks at. Pods
+// belong to the service named by their ServiceLabel, and are tailed when the
+// Annotation is set to one of the Values. <Annotation>.<container> turns a
+// single container on or off, and <Annotation>Containers lists the only
+// containers to tail.
+type FilterKeys struct {
+	ServiceLabel string
+	Annotation   string
+	Values       []string
 }
 
-// A PodFilter calls out to the Kubernetes API and determines if annotations
-// are present on a pod that would enable us to track logs for that pod.
-type PodFilter struct {
-	Timeout time.Duration
+// DefaultFilterKeys are the ones we've always used
+var DefaultFilterKeys = &FilterKeys{
+	ServiceLabel: "ServiceName",
+	Annotation:   "community.com/TailLogs",
+	Values:       []string{"true"},
+}
 
-	KubeHost string
-	KubePort int
+// Enables returns true if the value of an annotation turns tailing on
+func (k *FilterKeys) Enables(value string) bool {
+	for _, accepted := range k.Values {
+		if strings.EqualFold(value, accepted) {
+			return true
+		}
+	}
 
-	token  string
-	client *http.Client
+	return false
 }
 
-func NewPodFilter(kubeHost string, kubePort int, timeout time.Duration, credsPath string) *PodFilter {
-	f := &PodFilter{
-		Timeout:  timeout,
-		KubeHost: kubeHost,
-		KubePort: kubePort,
-	}
-	// Cache the secret from the file
-	data, err := ioutil.ReadFile(credsPath + "/token")
-	if err != nil {
-		log.Errorf("Failed to read serviceaccount token: %s", err)
-		return nil
-	}
+// ContainerAnnotation is the annotation for a single container
+func (k *FilterKeys) ContainerAnnotation(container string) string {
+	return k.Annotation + "." + container
+}
 
-	// New line is illegal in tokens
-	f.token = strings.Replace(string(data), "\n", "", -1)
+// ContainersAnnotation is the annotation listing the only containers to tail
+func (k *FilterKeys) ContainersAnnotation() string {
+	return k.Annotation + "Containers"
+}
 
-	// Set up the timeout on a clean HTTP client
-	f.client = cleanhttp.DefaultClient()
-	f.client.Timeout = f.Timeout
+// PriorityAnnotation is the annotation that says which pods to tail first
+// when we can't tail all of them
+func (k *FilterKeys) PriorityAnnotation() string {
+	return k.Annotation + "Priority"
+}
 
-	// Get the SystemCertPool — on error we have empty pool
-	rootCAs, _ := x509.SystemCertPool()
-	if rootCAs == nil {
-		rootCAs = x509.NewCertPool()
-	}
+// A ContainerPolicy decides which of a pod's containers we tail, from its
+// per-container annotations. A nil ContainerPolicy tails all of them.
+type ContainerPolicy struct {
+	Containers map[string]bool // Turned on or off one at a time
+	Allowlist  map[string]bool // Only these, if there is one
 
-	certs, err := ioutil.ReadFile(credsPath + "/ca.crt")
-	if err != nil {
-		log.Warnf("Failed to load CA cert file: %s", err)
-	}
+	keys *FilterKeys
+}
 
-	if ok := rootCAs.AppendCertsFromPEM(certs); !ok {
-		log.Warn("No certs appended! Using system certs only")
+// NewContainerPolicy returns the ContainerPolicy from a pod's annotations, or
+// nil if it doesn't have any per-container annotations
+func NewContainerPolicy(annotations map[string]string, keys *FilterKeys) *ContainerPolicy {
+	policy := ContainerPolicy{keys: keys}
+
+	for key, value := range annotations {
+		if container, ok := strings.CutPrefix(key, keys.Annotation+"."); ok && container != "" {
+			if policy.Containers == nil {
+				policy.Containers = make(map[string]bool)
+			}
+			policy.Containers[container] = keys.Enables(value)
+		}
 	}
 
-	// Add the pool to the TLS config we'll use in the client.
-	config := &tls.Config{
-		RootCAs: rootCAs,
+	if allowed, ok := annotations[keys.ContainersAnnotation()]; ok {
+		policy.Allowlist = make(map[string]bool)
+		for _, container := range strings.Split(allowed, ",") {
+			if container = strings.TrimSpace(container); container != "" {
+				policy.Allowlist[container] = true
+			}
+		}
 	}
 
-	f.client.Transport = &http.Transport{TLSClientConfig: config}
+	if policy.Containers == nil && policy.Allowlist == nil {
+		return nil
+	}
 
-	return f
+	return &policy
 }
 
-func (f *PodFilter) makeRequest(path string) ([]byte, error) {
-	var scheme = "http"
-	if f.KubePort == 443 {
-		scheme = "https"
+// Allows returns whether a container should be tailed, and the reason when
+// it shouldn't. An annotation for the container itself beats the allowlist.
+func (p *ContainerPolicy) Allows(container string) (bool, string) {
+	if p == nil {
+		return true, ""
 	}
 
-	// Start with the path, then add the host and scheme
-	apiURL, err := url.Parse(path)
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse the path! %s: %w", path, err)
+	if enabled, ok := p.Containers[container]; ok {
+		if !enabled {
+			return false, "turned off by annotation " + p.keys.ContainerAnnotation(container)
+		}
+		return true, ""
 	}
-	apiURL.Scheme = scheme
-	apiURL.Host = fmt.Sprintf("%s:%d", f.KubeHost, f.KubePort)
 
-	req, err := http.NewRequest("GET", apiURL.String(), nil)
-	if err != nil {
-		return []byte{}, err
+	if p.Allowlist != nil && !p.Allowlist[container] {
+		return false, "not listed in annotation " + p.keys.ContainersAnnotation()
 	}
 
-	req.Header.Set("User-Agent", "logtailer/"+Version)
-	req.Header.Set("Authorization", "Bearer "+f.token)
+	return true, ""
+}
 
-	resp, err := f.client.Do(req)
-	if err != nil {
-		return []byte{}, fmt.Errorf("failed to fetch from K8s API '%s': %w", path, err)
-	}
-	defer resp.Body.Close()
+// A PodFilter calls out to the Kubernetes API and determines if annotations
+// are present on a pod that would enable us to track logs for that pod.
+type PodFilter struct {
+	*KubeClient
 
-	if resp.StatusCode > 299 || resp.StatusCode < 200 {
-		return []byte{}, fmt.Errorf("got unexpected response code from %s: %d", path, resp.StatusCode)
-	}
+	// Metadata, when set, is used instead of asking the API about each pod
+	Metadata *PodMetadataCache
+	// Keys are the label and annotation we look at
+	Keys *FilterKeys
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return []byte{}, fmt.Errorf("failed to read from K8s API '%s' response body: %w", path, err)
+func NewPodFilter(kubeHost string, kubePort int, timeout time.Duration, credsPath string) *PodFilter {
+	client := NewKubeClient(kubeHost, kubePort, timeout, credsPath)
+	if client == nil {
+		return nil
 	}
 
-	return body, nil
+	return &PodFilter{KubeClient: client, Keys: DefaultFilterKeys}
 }
 
-func (f *PodFilter) ShouldTailLogs(pod *Pod) (bool, error) {
+// servicePods fetches the metadata for all the pods of the same service
+func (f *PodFilter) servicePods(pod *Pod) ([]K8sPod, error) {
+	if f.Metadata != nil {
+		return f.Metadata.ServicePods(pod, f.Keys.ServiceLabel)
+	}
+
 	body, err := f.makeRequest(
-		"/api/v1/namespaces/" + pod.Namespace + "/pods?limit=100000&labelSelector=ServiceName%3D" + pod.ServiceName,
+		"/api/v1/namespaces/" + pod.Namespace + "/pods?limit=100000&labelSelector=" +
+			url.QueryEscape(f.Keys.ServiceLabel+"="+pod.ServiceName),
 	)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	var pods K8sPodsMetadata
+	var pods K8sPodList
 	err = json.Unmarshal(body, &pods)
 	if err != nil {
-		return false, fmt.Errorf("unable to decode response from K8s: %s", err)
+		return nil, fmt.Errorf("unable to decode response from K8s: %s", err)
+	}
+
+	return pods.Items, nil
+}
+
+func (f *PodFilter) ShouldTailLogs(pod *Pod) (bool, error) {
+	shouldTail, _, err := f.Check(pod)
+	return shouldTail, err
+}
+
+// Check looks for the annotation on the pods of the same service
+func (f *PodFilter) Check(pod *Pod) (bool, string, error) {
+	pods, err := f.servicePods(pod)
+	if err != nil {
+		return false, "", err
 	}
 
 	// We don't somehow know about this pod (yet)
-	if len(pods.Items) < 1 {
-		return false, nil
+	if len(pods) < 1 {
+		return false, "no pods found with label " + f.Keys.ServiceLabel + "=" + pod.ServiceName, nil
 	}
 
 	// If *ANY* of the pods enables logs, we enable for all of them
-	for _, pod := range pods.Items {
-		if pod.Metadata.Annotations.CommunityComTailLogs == "true" {
-			return true, nil
+	for _, pod := range pods {
+		if f.Keys.Enables(pod.Metadata.Annotations[f.Keys.Annotation]) {
+			return true, "pod " + pod.Metadata.Name + " has annotation " + f.Keys.Annotation, nil
 		}
 	}
 
-	return false, nil
+	return false, "no pods of the service have annotation " + f.Keys.Annotation, nil
+}
+
+// ContainerPolicy returns the ContainerPolicy for a pod. We use the pod's own
+// annotations when we can find it, and otherwise those of the first pod of
+// the service that enables logs, like ShouldTailLogs().
+func (f *PodFilter) ContainerPolicy(pod *Pod) (*ContainerPolicy, error) {
+	pods, err := f.servicePods(pod)
+	if err != nil {
+		return nil, err
+	}
+
+	var annotations map[string]string
+	for _, item := range pods {
+		if item.LogDir() == pod.Name || (pod.PodName != "" && item.Metadata.Name == pod.PodName) {
+			annotations = item.Metadata.Annotations
+			break
+		}
+
+		if annotations == nil && f.Keys.Enables(item.Metadata.Annotations[f.Keys.Annotation]) {
+			annotations = item.Metadata.Annotations
+		}
+	}
+
+	return NewContainerPolicy(annotations, f.Keys), nil
 }
 
 // A StubFilter is used when we fail to talk to Kubernetes, e.g. when
@@ -158,3 +216,107 @@ func (f *PodFilter) ShouldTailLogs(pod *Pod) (bool, error) {
 type StubFilter struct{}
 
 func (f *StubFilter) ShouldTailLogs(pod *Pod) (bool, error) { return true, nil }
+
+func (f *StubFilter) Check(pod *Pod) (bool, string, error) {
+	return true, "no access to Kubernetes, tailing everything", nil
+}
+
+// An UnavailableFilter is used when we can't talk to Kubernetes and aren't
+// failing open. It fails for every pod, so that the failure policy decides.
+type UnavailableFilter struct{}
+
+func (f *UnavailableFilter) ShouldTailLogs(pod *Pod) (bool, error) {
+	return false, errors.New("no access to Kubernetes")
+}
+
+// A NamespaceAnnotationFilter accepts the pods in namespaces that have the
+// annotation, so that a whole namespace can be tailed without annotating each
+// workload. A pod can still opt out by setting the annotation to something
+// else, when we have the pod metadata to tell.
+type NamespaceAnnotationFilter struct {
+	*KubeClient
+
+	Keys     *FilterKeys
+	Metadata *PodMetadataCache // Optional, for pods opting out
+	TTL      time.Duration     // How long we remember a namespace's annotations
+
+	lock       sync.Mutex
+	namespaces map[string]namespaceAnnotations
+}
+
+// namespaceAnnotations are the annotations on a namespace, and when we got them
+type namespaceAnnotations struct {
+	annotations map[string]string
+	fetchedAt   time.Time
+}
+
+func NewNamespaceAnnotationFilter(client *KubeClient, keys *FilterKeys, ttl time.Duration) *NamespaceAnnotationFilter {
+	return &NamespaceAnnotationFilter{
+		KubeClient: client,
+		Keys:       keys,
+		TTL:        ttl,
+		namespaces: make(map[string]namespaceAnnotations),
+	}
+}
+
+func (f *NamespaceAnnotationFilter) ShouldTailLogs(pod *Pod) (bool, error) {
+	shouldTail, _, err := f.Check(pod)
+	return shouldTail, err
+}
+
+func (f *NamespaceAnnotationFilter) Check(pod *Pod) (bool, string, error) {
+	annotations, err := f.annotationsFor(pod.Namespace)
+	if err != nil {
+		return false, "", err
+	}
+
+	if !f.Keys.Enables(annotations[f.Keys.Annotation]) {
+		return false, "namespace " + pod.Namespace + " doesn't have annotation " + f.Keys.Annotation, nil
+	}
+
+	if f.Metadata != nil {
+		item, ok, err := f.Metadata.Lookup(pod.Name)
+		if err != nil {
+			return false, "", err
+		}
+
+		if value, set := item.Metadata.Annotations[f.Keys.Annotation]; ok && set && !f.Keys.Enables(value) {
+			return false, "pod opted out of namespace " + pod.Namespace + " with annotation " + f.Keys.Annotation, nil
+		}
+	}
+
+	return true, "namespace " + pod.Namespace + " has annotation " + f.Keys.Annotation, nil
+}
+
+// annotationsFor returns the annotations on a namespace, asking the API if we
+// don't have them or they are too old
+func (f *NamespaceAnnotationFilter) annotationsFor(namespace string) (map[string]string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if cached, ok := f.namespaces[namespace]; ok && time.Since(cached.fetchedAt) < f.TTL {
+		return cached.annotations, nil
+	}
+
+	body, err := f.makeRequest("/api/v1/namespaces/" + namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var ns struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	err = json.Unmarshal(body, &ns)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode namespace from K8s: %s", err)
+	}
+
+	f.namespaces[namespace] = namespaceAnnotations{
+		annotations: ns.Metadata.Annotations,
+		fetchedAt:   time.Now(),
+	}
+
+	return ns.Metadata.Annotations, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"testing"
 	"time"
@@ -145,5 +146,158 @@ func Test_ShouldTailLogs(t *testing.T) {
 
 			So(shouldTail, ShouldBeTrue)
 		})
+
+		Convey("uses the configured label, annotation and values", func() {
+			var query string
+			httpmock.RegisterResponder("GET", "=~http://beowulf.example.com:80/api/v1/namespaces/the-awesome-place/pods.*",
+				func(req *http.Request) (*http.Response, error) {
+					query = req.URL.Query().Get("labelSelector")
+					return httpmock.NewStringResponse(200, `{"items":[{"metadata":{"annotations": {"example.com/logs":"Yes","community.com/TailLogs":"true"}}}]}`), nil
+				},
+			)
+
+			filter.Keys = &FilterKeys{
+				ServiceLabel: "app.kubernetes.io/name",
+				Annotation:   "example.com/logs",
+				Values:       []string{"yes", "on"},
+			}
+
+			shouldTail, err := filter.ShouldTailLogs(&Pod{ServiceName: "awesome-pod", Namespace: "the-awesome-place"})
+			So(err, ShouldBeNil)
+			So(shouldTail, ShouldBeTrue)
+			So(query, ShouldEqual, "app.kubernetes.io/name=awesome-pod")
+
+			filter.Keys.Values = []string{"true"}
+			shouldTail, err = filter.ShouldTailLogs(&Pod{ServiceName: "awesome-pod", Namespace: "the-awesome-place"})
+			So(err, ShouldBeNil)
+			So(shouldTail, ShouldBeFalse)
+		})
+	})
+}
+
+func Test_ContainerPolicy(t *testing.T) {
+	Convey("ContainerPolicy", t, func() {
+		Convey("is nil without any container annotations", func() {
+			policy := NewContainerPolicy(map[string]string{"community.com/TailLogs": "true"}, DefaultFilterKeys)
+			So(policy, ShouldBeNil)
+
+			allowed, _ := policy.Allows("chopper")
+			So(allowed, ShouldBeTrue)
+		})
+
+		Convey("turns off single containers", func() {
+			policy := NewContainerPolicy(map[string]string{
+				"community.com/TailLogs":          "true",
+				"community.com/TailLogs.logproxy": "false",
+			}, DefaultFilterKeys)
+
+			allowed, _ := policy.Allows("chopper")
+			So(allowed, ShouldBeTrue)
+
+			allowed, reason := policy.Allows("logproxy")
+			So(allowed, ShouldBeFalse)
+			So(reason, ShouldEqual, "turned off by annotation community.com/TailLogs.logproxy")
+		})
+
+		Convey("only allows the listed containers, unless turned on by their own annotation", func() {
+			policy := NewContainerPolicy(map[string]string{
+				"community.com/TailLogsContainers": "chopper, worker",
+				"community.com/TailLogs.envoy":     "true",
+			}, DefaultFilterKeys)
+
+			for _, container := range []string{"chopper", "worker", "envoy"} {
+				allowed, _ := policy.Allows(container)
+				So(allowed, ShouldBeTrue)
+			}
+
+			allowed, reason := policy.Allows("logproxy")
+			So(allowed, ShouldBeFalse)
+			So(reason, ShouldEqual, "not listed in annotation community.com/TailLogsContainers")
+		})
+
+		Convey("comes from the pod itself when the PodFilter knows its name", func() {
+			Reset(func() { httpmock.DeactivateAndReset() })
+
+			filter := NewPodFilter("beowulf.example.com", 80, 10*time.Millisecond, credsPath)
+			httpmock.ActivateNonDefault(filter.client)
+
+			httpmock.RegisterResponder("GET", "=~http://beowulf.example.com:80/api/v1/namespaces/the-awesome-place/pods.*",
+				httpmock.NewStringResponder(200, `{"items":[
+					{"metadata":{"name":"awesome-pod-1","annotations":{"community.com/TailLogs":"true","community.com/TailLogs.envoy":"false"}}},
+					{"metadata":{"name":"awesome-pod-2","annotations":{"community.com/TailLogs":"true","community.com/TailLogsContainers":"app"}}}
+				]}`),
+			)
+
+			pod := &Pod{
+				Name:        "the-awesome-place_awesome-pod-2_1234",
+				PodName:     "awesome-pod-2",
+				ServiceName: "awesome-pod",
+				Namespace:   "the-awesome-place",
+			}
+
+			policy, err := filter.ContainerPolicy(pod)
+			So(err, ShouldBeNil)
+			So(policy.Allowlist, ShouldResemble, map[string]bool{"app": true})
+
+			pod.PodName = ""
+			policy, err = filter.ContainerPolicy(pod)
+			So(err, ShouldBeNil)
+			So(policy.Containers, ShouldResemble, map[string]bool{"envoy": false})
+		})
+	})
+}
+
+func Test_NamespaceAnnotationFilter(t *testing.T) {
+	Convey("NamespaceAnnotationFilter", t, func() {
+		var requests int
+		server, client := fakeKubeAPI(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/api/v1/namespaces/default":
+				requests++
+				fmt.Fprint(w, `{"metadata":{"name":"default","annotations":{"community.com/TailLogs":"true"}}}`)
+			case "/api/v1/namespaces/kube-system":
+				fmt.Fprint(w, `{"metadata":{"name":"kube-system"}}`)
+			case "/api/v1/pods":
+				fmt.Fprint(w, `{"items":[{"metadata":{"name":"quiet","namespace":"default","uid":"1234",
+					"annotations":{"community.com/TailLogs":"false"}}}]}`)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		})
+		Reset(server.Close)
+
+		filter := NewNamespaceAnnotationFilter(client, DefaultFilterKeys, time.Minute)
+
+		Convey("accepts pods in annotated namespaces", func() {
+			shouldTail, reason, err := filter.Check(&Pod{Name: "default_chopper_5678", Namespace: "default"})
+			So(err, ShouldBeNil)
+			So(shouldTail, ShouldBeTrue)
+			So(reason, ShouldEqual, "namespace default has annotation community.com/TailLogs")
+
+			// From the cache the second time
+			_, _, err = filter.Check(&Pod{Name: "default_chopper_5678", Namespace: "default"})
+			So(err, ShouldBeNil)
+			So(requests, ShouldEqual, 1)
+		})
+
+		Convey("rejects pods in other namespaces", func() {
+			shouldTail, err := filter.ShouldTailLogs(&Pod{Name: "kube-system_coredns_5678", Namespace: "kube-system"})
+			So(err, ShouldBeNil)
+			So(shouldTail, ShouldBeFalse)
+		})
+
+		Convey("lets pods opt out", func() {
+			filter.Metadata = NewPodMetadataCache(client, "beowulf", time.Minute)
+
+			shouldTail, reason, err := filter.Check(&Pod{Name: "default_quiet_1234", Namespace: "default"})
+			So(err, ShouldBeNil)
+			So(shouldTail, ShouldBeFalse)
+			So(reason, ShouldContainSubstring, "opted out")
+		})
+
+		Convey("errors when the API does", func() {
+			_, err := filter.ShouldTailLogs(&Pod{Name: "nowhere_chopper_5678", Namespace: "nowhere"})
+			So(err, ShouldNotBeNil)
+		})
 	})
 }
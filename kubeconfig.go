@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// kubeconfig is the part of a kubeconfig file that we understand. Auth
+// plugins, e.g. for cloud providers, aren't supported.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+
+	Clusters []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+
+	dir string // Relative paths in the file are relative to where it is
+}
+
+// loadKubeconfig reads the kubeconfig files from a KUBECONFIG style list. As
+// with kubectl, files that don't exist are skipped and the first file to set
+// something wins.
+func loadKubeconfig(paths string) (*kubeconfig, error) {
+	merged := &kubeconfig{}
+
+	for _, path := range filepath.SplitList(paths) {
+		if path == "" {
+			continue
+		}
+
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read kubeconfig: %w", err)
+		}
+
+		var config kubeconfig
+		err = yaml.Unmarshal(data, &config)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse kubeconfig %s: %w", path, err)
+		}
+
+		if merged.dir == "" {
+			merged.dir = filepath.Dir(path)
+		}
+		if merged.CurrentContext == "" {
+			merged.CurrentContext = config.CurrentContext
+		}
+		merged.Clusters = append(merged.Clusters, config.Clusters...)
+		merged.Contexts = append(merged.Contexts, config.Contexts...)
+		merged.Users = append(merged.Users, config.Users...)
+	}
+
+	if merged.CurrentContext == "" {
+		return nil, errors.New("kubeconfig has no current-context")
+	}
+
+	return merged, nil
+}
+
+// resolve makes a path from the kubeconfig relative to where it is
+func (k *kubeconfig) resolve(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(k.dir, path)
+}
+
+// fileOrData returns the base64 data if there is any, or else the contents of
+// the file, or nil if there's neither
+func (k *kubeconfig) fileOrData(path, data string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+
+	if path == "" {
+		return nil, nil
+	}
+
+	return os.ReadFile(k.resolve(path))
+}
+
+// NewKubeClientFromKubeconfig returns a KubeClient for the current context of
+// the kubeconfig, authenticating with its bearer token or client certificate.
+// This is for running outside the cluster, e.g. for debugging.
+func NewKubeClientFromKubeconfig(paths string, timeout time.Duration) (*KubeClient, error) {
+	config, err := loadKubeconfig(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	var clusterName, userName string
+	var foundContext bool
+	for _, context := range config.Contexts {
+		if context.Name == config.CurrentContext {
+			clusterName, userName = context.Context.Cluster, context.Context.User
+			foundContext = true
+			break
+		}
+	}
+	if !foundContext {
+		return nil, fmt.Errorf("kubeconfig context %q not found", config.CurrentContext)
+	}
+
+	c := &KubeClient{Timeout: timeout}
+	tlsConfig := &tls.Config{}
+
+	// The cluster gives us the server and how to trust it
+	var foundCluster bool
+	for _, cluster := range config.Clusters {
+		if cluster.Name != clusterName {
+			continue
+		}
+		foundCluster = true
+
+		err = c.setServer(cluster.Cluster.Server)
+		if err != nil {
+			return nil, err
+		}
+
+		caCerts, err := config.fileOrData(cluster.Cluster.CertificateAuthority, cluster.Cluster.CertificateAuthorityData)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read certificate authority for cluster %s: %w", clusterName, err)
+		}
+
+		if caCerts != nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if ok := tlsConfig.RootCAs.AppendCertsFromPEM(caCerts); !ok {
+				return nil, fmt.Errorf("no certificates found in the certificate authority for cluster %s", clusterName)
+			}
+		}
+
+		tlsConfig.InsecureSkipVerify = cluster.Cluster.InsecureSkipTLSVerify
+		break
+	}
+	if !foundCluster {
+		return nil, fmt.Errorf("kubeconfig cluster %q not found", clusterName)
+	}
+
+	// The user gives us a token, or a client certificate
+	var foundUser bool
+	for _, user := range config.Users {
+		if user.Name != userName {
+			continue
+		}
+		foundUser = true
+
+		c.token = user.User.Token
+		if user.User.TokenFile != "" {
+			c.tokenFile = config.resolve(user.User.TokenFile)
+			err = c.loadToken(true)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read token for user %s: %w", userName, err)
+			}
+		}
+
+		cert, err := config.fileOrData(user.User.ClientCertificate, user.User.ClientCertificateData)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client certificate for user %s: %w", userName, err)
+		}
+
+		key, err := config.fileOrData(user.User.ClientKey, user.User.ClientKeyData)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client key for user %s: %w", userName, err)
+		}
+
+		if cert != nil || key != nil {
+			keyPair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, fmt.Errorf("bad client certificate for user %s: %w", userName, err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{keyPair}
+		}
+
+		if c.token == "" && len(tlsConfig.Certificates) == 0 {
+			return nil, fmt.Errorf("kubeconfig user %s has no token or client certificate", userName)
+		}
+		break
+	}
+	if !foundUser {
+		return nil, fmt.Errorf("kubeconfig user %q not found", userName)
+	}
+
+	c.setTLSConfig(tlsConfig)
+
+	return c, nil
+}
+
+// setServer sets where the API is from the server URL in a kubeconfig
+func (c *KubeClient) setServer(server string) error {
+	serverURL, err := url.Parse(server)
+	if err != nil || serverURL.Host == "" {
+		return fmt.Errorf("bad kubeconfig server %q", server)
+	}
+
+	c.KubeScheme = serverURL.Scheme
+	c.KubeHost = serverURL.Hostname()
+	c.basePath = strings.TrimSuffix(serverURL.Path, "/")
+
+	port := serverURL.Port()
+	if port == "" {
+		port = "443"
+		if c.KubeScheme == "http" {
+			port = "80"
+		}
+	}
+
+	c.KubePort, err = strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("bad kubeconfig server %q: %w", server, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How many records a viewer can fall behind before we skip some
+	viewerBuffer = 256
+	// How often we send a comment to keep an idle stream open
+	heartbeatInterval = 15 * time.Second
+)
+
+// liveTail is where the outputs mirror what they send, for the /tail endpoint
+var liveTail = NewLiveTail()
+
+// A TailRecord is a record as an output sent it, or would have done if the
+// service wasn't rate limited
+type TailRecord struct {
+	Data        []byte
+	RateLimited bool
+}
+
+// tailViewer is a client watching the records for a service, and optionally
+// one of its containers
+type tailViewer struct {
+	service   string
+	container string
+	records   chan *TailRecord
+	missed    int64 // Records skipped because the viewer fell behind
+}
+
+func (v *tailViewer) wants(service, container string) bool {
+	return v.service == service && (v.container == "" || v.container == container)
+}
+
+// LiveTail streams the records the outputs send to anyone watching, as
+// Server-Sent Events. Viewers never hold up delivery: when one falls behind,
+// records are skipped and it is told how many.
+type LiveTail struct {
+	lock    sync.RWMutex
+	viewers map[*tailViewer]struct{}
+	count   int32 // How many viewers there are, so outputs can check cheaply
+}
+
+func NewLiveTail() *LiveTail {
+	return &LiveTail{viewers: make(map[*tailViewer]struct{})}
+}
+
+// Watching returns true if anyone wants the records for a container. Outputs
+// use it to avoid formatting records for nobody.
+func (l *LiveTail) Watching(service, container string) bool {
+	if atomic.LoadInt32(&l.count) == 0 {
+		return false
+	}
+
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	for viewer := range l.viewers {
+		if viewer.wants(service, container) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Publish hands a record to everyone watching, without waiting for any of them
+func (l *LiveTail) Publish(service, container string, record *TailRecord) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	for viewer := range l.viewers {
+		if !viewer.wants(service, container) {
+			continue
+		}
+
+		select {
+		case viewer.records <- record:
+		default:
+			atomic.AddInt64(&viewer.missed, 1)
+		}
+	}
+}
+
+func (l *LiveTail) add(viewer *tailViewer) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.viewers[viewer] = struct{}{}
+	atomic.AddInt32(&l.count, 1)
+}
+
+func (l *LiveTail) remove(viewer *tailViewer) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.viewers, viewer)
+	atomic.AddInt32(&l.count, -1)
+}
+
+// ServeHTTP streams the records for the service, and optionally the
+// container, in the query until the client goes away. Records the rate
+// limiter held back are sent as "rate-limited" events.
+func (l *LiveTail) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	service := r.URL.Query().Get("service")
+	if service == "" {
+		http.Error(w, "a service is required", http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming isn't supported", http.StatusInternalServerError)
+		return
+	}
+
+	viewer := &tailViewer{
+		service:   service,
+		container: r.URL.Query().Get("container"),
+		records:   make(chan *TailRecord, viewerBuffer),
+	}
+	l.add(viewer)
+	defer l.remove(viewer)
+
+	log.Infof("Live tail of %s started for %s", service, r.RemoteAddr)
+	defer log.Infof("Live tail of %s stopped for %s", service, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	fmt.Fprintf(w, ": tailing service %s\n\n", service)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": still here\n\n")
+
+		case record := <-viewer.records:
+			if missed := atomic.SwapInt64(&viewer.missed, 0); missed > 0 {
+				fmt.Fprintf(w, "event: missed\ndata: %d\n\n", missed)
+			}
+
+			if record.RateLimited {
+				fmt.Fprint(w, "event: rate-limited\n")
+			}
+			fmt.Fprintf(w, "data: %s\n\n", record.Data)
+		}
+
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_LiveTail(t *testing.T) {
+	Convey("LiveTail", t, func() {
+		tail := NewLiveTail()
+
+		Convey("only hands records to the viewers that want them", func() {
+			all := &tailViewer{service: "chopper", records: make(chan *TailRecord, 2)}
+			envoy := &tailViewer{service: "chopper", container: "envoy", records: make(chan *TailRecord, 2)}
+			tail.add(all)
+			tail.add(envoy)
+
+			So(tail.Watching("chopper", "chopper"), ShouldBeTrue)
+			So(tail.Watching("bocaccio", "bocaccio"), ShouldBeFalse)
+
+			tail.Publish("chopper", "chopper", &TailRecord{Data: []byte("{}")})
+			So(len(all.records), ShouldEqual, 1)
+			So(len(envoy.records), ShouldEqual, 0)
+
+			tail.remove(all)
+			tail.remove(envoy)
+			So(tail.Watching("chopper", "chopper"), ShouldBeFalse)
+		})
+
+		Convey("skips records for viewers that fall behind", func() {
+			slow := &tailViewer{service: "chopper", records: make(chan *TailRecord, 1)}
+			tail.add(slow)
+
+			for i := 0; i < 3; i++ {
+				tail.Publish("chopper", "chopper", &TailRecord{Data: []byte("{}")})
+			}
+
+			So(len(slow.records), ShouldEqual, 1)
+			So(slow.missed, ShouldEqual, 2)
+		})
+
+		Convey("streams records as Server-Sent Events", func() {
+			server := httptest.NewServer(tail)
+			Reset(server.Close)
+
+			resp, err := http.Get(server.URL + "/tail?service=chopper&container=chopper")
+			So(err, ShouldBeNil)
+			Reset(func() { resp.Body.Close() })
+
+			So(resp.StatusCode, ShouldEqual, 200)
+			So(resp.Header.Get("Content-Type"), ShouldEqual, "text/event-stream")
+
+			reader := bufio.NewReader(resp.Body)
+			readEvent := func() string {
+				var lines []string
+				for {
+					line, err := reader.ReadString('\n')
+					So(err, ShouldBeNil)
+					if line == "\n" {
+						return strings.Join(lines, "")
+					}
+					lines = append(lines, line)
+				}
+			}
+
+			So(readEvent(), ShouldEqual, ": tailing service chopper\n")
+
+			tail.Publish("chopper", "chopper", &TailRecord{Data: []byte(`{"Payload":"sent"}`)})
+			So(readEvent(), ShouldEqual, "data: {\"Payload\":\"sent\"}\n")
+
+			tail.Publish("chopper", "chopper", &TailRecord{Data: []byte(`{"Payload":"held"}`), RateLimited: true})
+			So(readEvent(), ShouldEqual, "event: rate-limited\ndata: {\"Payload\":\"held\"}\n")
+
+			Convey("and stops watching when the viewer goes away", func() {
+				resp.Body.Close()
+
+				deadline := time.Now().Add(time.Second)
+				for tail.Watching("chopper", "chopper") && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+				}
+				So(tail.Watching("chopper", "chopper"), ShouldBeFalse)
+			})
+		})
+
+		Convey("requires a service", func() {
+			recorder := httptest.NewRecorder()
+			tail.ServeHTTP(recorder, httptest.NewRequest("GET", "/tail", nil))
+
+			So(recorder.Code, ShouldEqual, 400)
+		})
+	})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A logFormat is one of the on-disk formats container runtimes write logs in
+type logFormat int
+
+const (
+	formatUnknown logFormat = iota
+	formatCRI               // containerd, CRI-O
+	formatDocker            // Docker's json-file driver
+	formatPlain             // Host logs that we send just as they are
+)
+
+func (f logFormat) String() string {
+	switch f {
+	case formatCRI:
+		return "cri"
+	case formatDocker:
+		return "docker"
+	case formatPlain:
+		return "plain"
+	default:
+		return "unknown"
+	}
+}
+
+// detectLogFormat works out which format a log file is in from one of its
+// lines. Returns formatUnknown if it doesn't look like any we support.
+func detectLogFormat(text string) logFormat {
+	// Cheap check first, JSON lines can't be CRI lines
+	if strings.HasPrefix(text, "{") {
+		if _, err := parseDockerLine(text); err == nil {
+			return formatDocker
+		}
+		return formatUnknown
+	}
+
+	if _, err := parseCRILine(text); err == nil {
+		return formatCRI
+	}
+
+	return formatUnknown
+}
+
+// Parse turns a raw line from a log file in this format into a LogLine
+func (f logFormat) Parse(text string) (*LogLine, error) {
+	switch f {
+	case formatCRI:
+		return parseCRILine(text)
+	case formatDocker:
+		return parseDockerLine(text)
+	case formatPlain:
+		// No timestamp in the line, so the best we can do is when we read it
+		return &LogLine{Text: text, Timestamp: time.Now().UTC()}, nil
+	default:
+		return nil, fmt.Errorf("unknown log format")
+	}
+}
+
+const (
+	// containerd marks lines it had to split as partial with "P" and the
+	// final piece of the line, or any unsplit line, with "F"
+	partialTag = "P"
+	fullTag    = "F"
+)
+
+// parseCRILine parses a line in the CRI log format written by containerd,
+// which looks like:
+//
+//	2022-12-03T16:09:51.741778906Z stdout F the message
+func parseCRILine(text string) (*LogLine, error) {
+	fields := strings.SplitN(text, " ", 4)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("not a CRI log line, too few fields: %q", text)
+	}
+
+	timestamp, err := time.Parse(time.RFC3339Nano, fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("not a CRI log line, bad timestamp: %w", err)
+	}
+
+	stream := fields[1]
+	if stream != "stdout" && stream != "stderr" {
+		return nil, fmt.Errorf("not a CRI log line, unknown stream %q", stream)
+	}
+
+	tag := fields[2]
+	if tag != partialTag && tag != fullTag {
+		return nil, fmt.Errorf("not a CRI log line, unknown tag %q", tag)
+	}
+
+	var msg string
+	if len(fields) == 4 {
+		msg = fields[3]
+	}
+
+	return &LogLine{
+		Text:      msg,
+		Stream:    stream,
+		Timestamp: timestamp,
+		Partial:   tag == partialTag,
+	}, nil
+}
+
+// A dockerLogEntry is one line of a Docker json-file log
+type dockerLogEntry struct {
+	Log    string `json:"log"`
+	Stream string `json:"stream"`
+	Time   string `json:"time"`
+}
+
+// parseDockerLine parses a line in the format written by Docker's json-file
+// logging driver, which looks like:
+//
+//	{"log":"the message\n","stream":"stdout","time":"2022-12-03T16:09:51.741778906Z"}
+//
+// Docker splits long lines too. The pieces are the ones without a trailing
+// newline.
+func parseDockerLine(text string) (*LogLine, error) {
+	var entry dockerLogEntry
+	err := json.Unmarshal([]byte(text), &entry)
+	if err != nil {
+		return nil, fmt.Errorf("not a Docker log line: %w", err)
+	}
+
+	timestamp, err := time.Parse(time.RFC3339Nano, entry.Time)
+	if err != nil {
+		return nil, fmt.Errorf("not a Docker log line, bad timestamp: %w", err)
+	}
+
+	if entry.Stream != "stdout" && entry.Stream != "stderr" {
+		return nil, fmt.Errorf("not a Docker log line, unknown stream %q", entry.Stream)
+	}
+
+	return &LogLine{
+		Text:      strings.TrimSuffix(entry.Log, "\n"),
+		Stream:    entry.Stream,
+		Timestamp: timestamp,
+		Partial:   !strings.HasSuffix(entry.Log, "\n"),
+	}, nil
+}
+
+// A logDecoder turns the raw lines read from a container's logs into
+// LogLines. It works out the format from the first line it understands and
+// joins partial lines back together. It is owned by a single logPump, so it
+// is not thread-safe.
+type logDecoder struct {
+	filename  string
+	container string
+	format    logFormat
+	partials  *partialAssembler
+}
+
+// newLogDecoder returns a logDecoder for a log in the given format, or
+// formatUnknown to detect it
+func newLogDecoder(filename, container string, format logFormat, maxLineSize int) *logDecoder {
+	return &logDecoder{
+		filename:  filename,
+		container: container,
+		format:    format,
+		partials:  newPartialAssembler(maxLineSize),
+	}
+}
+
+// Decode parses a raw line and returns any lines that are now complete
+func (d *logDecoder) Decode(text string) []*LogLine {
+	// Work out what we're reading from the first line we understand
+	if d.format == formatUnknown {
+		d.format = detectLogFormat(text)
+		if d.format == formatUnknown {
+			// Wasn't a K8s log line!
+			log.Debugf("Skipping line in unknown format from %s", d.filename)
+			return nil
+		}
+		log.Debugf("Detected %s log format for %s", d.format, d.filename)
+	}
+
+	line, err := d.format.Parse(text)
+	if err != nil {
+		log.Debugf("Skipping line from %s: %s", d.filename, err)
+		return nil
+	}
+	line.Container = d.container
+
+	return d.partials.Add(line)
+}
+
+// Pending returns true while we're holding on to part of a line
+func (d *logDecoder) Pending() bool {
+	return d.partials.Pending()
+}
+
+// Flush returns whatever we have of a partial line
+func (d *logDecoder) Flush() []*LogLine {
+	return d.partials.Flush()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_parseCRILine(t *testing.T) {
+	Convey("parseCRILine()", t, func() {
+		Convey("parses a full line", func() {
+			line, err := parseCRILine("2022-12-03T16:09:51.741778906Z stdout F this is a test message")
+
+			So(err, ShouldBeNil)
+			So(line.Text, ShouldEqual, "this is a test message")
+			So(line.Stream, ShouldEqual, "stdout")
+			So(line.Timestamp, ShouldEqual, time.Date(2022, 12, 3, 16, 9, 51, 741778906, time.UTC))
+			So(line.Partial, ShouldBeFalse)
+		})
+
+		Convey("parses a partial line", func() {
+			line, err := parseCRILine("2022-12-03T16:09:51.741778906Z stderr P this is the start ")
+
+			So(err, ShouldBeNil)
+			So(line.Text, ShouldEqual, "this is the start ")
+			So(line.Stream, ShouldEqual, "stderr")
+			So(line.Partial, ShouldBeTrue)
+		})
+
+		Convey("handles timestamps with fewer digits", func() {
+			line, err := parseCRILine("2022-12-03T16:09:51.7417789Z stdout F this is a test message")
+
+			So(err, ShouldBeNil)
+			So(line.Timestamp, ShouldEqual, time.Date(2022, 12, 3, 16, 9, 51, 741778900, time.UTC))
+			So(line.Text, ShouldEqual, "this is a test message")
+		})
+
+		Convey("handles empty messages", func() {
+			line, err := parseCRILine("2022-12-03T16:09:51.741778906Z stdout F ")
+
+			So(err, ShouldBeNil)
+			So(line.Text, ShouldBeEmpty)
+		})
+
+		Convey("keeps spaces in the message", func() {
+			line, err := parseCRILine("2022-12-03T16:09:51.741778906Z stdout F   indented  ")
+
+			So(err, ShouldBeNil)
+			So(line.Text, ShouldEqual, "  indented  ")
+		})
+
+		Convey("errors on lines that aren't CRI lines", func() {
+			for _, text := range []string{
+				"this is a test message",
+				"not-a-time stdout F this is a test message",
+				"2022-12-03T16:09:51.741778906Z stdin F this is a test message",
+				"2022-12-03T16:09:51.741778906Z stdout X this is a test message",
+			} {
+				line, err := parseCRILine(text)
+
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "not a CRI log line")
+				So(line, ShouldBeNil)
+			}
+		})
+	})
+}
+
+func Test_parseDockerLine(t *testing.T) {
+	Convey("parseDockerLine()", t, func() {
+		Convey("parses a full line", func() {
+			line, err := parseDockerLine(`{"log":"this is a test message\n","stream":"stderr","time":"2022-12-03T16:09:51.741778906Z"}`)
+
+			So(err, ShouldBeNil)
+			So(line.Text, ShouldEqual, "this is a test message")
+			So(line.Stream, ShouldEqual, "stderr")
+			So(line.Timestamp, ShouldEqual, time.Date(2022, 12, 3, 16, 9, 51, 741778906, time.UTC))
+			So(line.Partial, ShouldBeFalse)
+		})
+
+		Convey("treats lines without a newline as partial", func() {
+			line, err := parseDockerLine(`{"log":"this is the start ","stream":"stdout","time":"2022-12-03T16:09:51.741778906Z"}`)
+
+			So(err, ShouldBeNil)
+			So(line.Text, ShouldEqual, "this is the start ")
+			So(line.Partial, ShouldBeTrue)
+		})
+
+		Convey("errors on lines that aren't Docker lines", func() {
+			for _, text := range []string{
+				"this is a test message",
+				`{"log":"this is a test message\n","stream":"stdout","time":"yesterday"}`,
+				`{"log":"this is a test message\n","time":"2022-12-03T16:09:51.741778906Z"}`,
+			} {
+				line, err := parseDockerLine(text)
+
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "not a Docker log line")
+				So(line, ShouldBeNil)
+			}
+		})
+	})
+}
+
+func Test_detectLogFormat(t *testing.T) {
+	Convey("detectLogFormat()", t, func() {
+		Convey("detects CRI lines", func() {
+			So(detectLogFormat("2022-12-03T16:09:51.741778906Z stdout F this is a test message"), ShouldEqual, formatCRI)
+		})
+
+		Convey("detects Docker lines", func() {
+			So(
+				detectLogFormat(`{"log":"this is a test message\n","stream":"stdout","time":"2022-12-03T16:09:51.741778906Z"}`),
+				ShouldEqual, formatDocker,
+			)
+		})
+
+		Convey("doesn't guess at anything else", func() {
+			So(detectLogFormat("this is a test message"), ShouldEqual, formatUnknown)
+			So(detectLogFormat(`{"msg":"this is a test message"}`), ShouldEqual, formatUnknown)
+		})
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"io/ioutil"
 	"regexp"
@@ -20,8 +21,16 @@ var (
 )
 
 type LogLine struct {
-	Text      string // The log line
-	Container string // The container name it came from
+	Text      string    // The log message, without the runtime's preamble
+	Container string    // The container name it came from
+	Stream    string    // Either stdout or stderr
+	Timestamp time.Time // When the container runtime recorded the line
+	Partial   bool      // Only part of a line, with the rest to follow
+
+	// Set by a RateLimitingLogger when it didn't pass the line on
+	RateLimited bool
+
+	stats *fileStats // Where the Tailer counts the line
 }
 
 type LogOutput interface {
@@ -29,9 +38,18 @@ type LogOutput interface {
 	Stop()
 }
 
+// A MirroringOutput can show the live tail what it would have sent for a
+// line that was held back before reaching it
+type MirroringOutput interface {
+	LogOutput
+	Mirror(line *LogLine)
+}
+
 type UDPSyslogger struct {
 	syslogger                  *log.Entry
+	service                    string // For mirroring to the liveTail
 	enableRegexLogLevelParsing bool
+	includeIngestTimestamp     bool
 }
 
 // extractLogLevel attempts to extract the log level from structured log formats (logfmt).
@@ -45,7 +63,9 @@ func extractLogLevel(logLine string) (string, bool) {
 	return "", false
 }
 
-func NewUDPSyslogger(labels map[string]string, address string, enableRegexLogLevelParsing bool) *UDPSyslogger {
+func NewUDPSyslogger(labels map[string]string, address string,
+	enableRegexLogLevelParsing bool, includeIngestTimestamp bool) *UDPSyslogger {
+
 	syslogger := log.New()
 
 	// We relay UDP syslog because we don't plan to ship it off the box and
@@ -53,10 +73,13 @@ func NewUDPSyslogger(labels map[string]string, address string, enableRegexLogLev
 	hook, err := loghooks.NewUDPHook(address)
 	if err != nil {
 		log.Errorf("Error adding hook: %s", err)
+	} else {
+		syslogger.Hooks.Add(hook)
 	}
 
-	syslogger.Hooks.Add(hook)
 	syslogger.SetFormatter(&log.JSONFormatter{
+		// Keep the full precision of the container runtime's timestamp
+		TimestampFormat: time.RFC3339Nano,
 		FieldMap: log.FieldMap{
 			log.FieldKeyTime:  "Timestamp",
 			log.FieldKeyLevel: "Level",
@@ -76,35 +99,67 @@ func NewUDPSyslogger(labels map[string]string, address string, enableRegexLogLev
 
 	return &UDPSyslogger{
 		syslogger:                  syslogger.WithFields(fields),
+		service:                    labels["ServiceName"],
 		enableRegexLogLevelParsing: enableRegexLogLevelParsing,
+		includeIngestTimestamp:     includeIngestTimestamp,
 	}
 }
 
-// relayLogs will watch a container and send the logs to Syslog
+// Log sends a line to Syslog, stamped with the time the container runtime
+// recorded it rather than the time we read it.
 func (sysl *UDPSyslogger) Log(line *LogLine) {
-	// Log lines all start like:
-	// 2022-12-03T16:09:51.741778906Z stdout F
+	logger, level := sysl.entryFor(line)
 
-	// Wasn't a K8s log line!
-	if len(line.Text) < 41 {
+	if liveTail.Watching(sysl.service, line.Container) {
+		sysl.mirror(logger, level, line)
+	}
+
+	logger.Log(level, line.Text)
+}
+
+// Mirror hands the record we would have sent for a line to the liveTail,
+// without sending it. It is used for the lines the rate limiter held back.
+func (sysl *UDPSyslogger) Mirror(line *LogLine) {
+	if !liveTail.Watching(sysl.service, line.Container) {
 		return
 	}
 
-	k8sFields := strings.Split(line.Text[0:40], " ")
-	descriptor := k8sFields[1]
+	logger, level := sysl.entryFor(line)
+	sysl.mirror(logger, level, line)
+}
 
-	lineTxt := line.Text
+// mirror formats a record the same way it is formatted for Syslog
+func (sysl *UDPSyslogger) mirror(logger *log.Entry, level log.Level, line *LogLine) {
+	record := logger.Dup()
+	record.Level = level
+	record.Message = line.Text
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
 
-	// Strip the K8s logging stuff from the log. Because the timestamp length
-	// changes sometimes, we check this. It's cheaper than a split on the full
-	// log line.
-	if lineTxt[39] == ' ' {
-		lineTxt = lineTxt[40:len(lineTxt)]
-	} else {
-		lineTxt = lineTxt[39:len(lineTxt)]
+	data, err := record.Bytes()
+	if err != nil {
+		log.Debugf("Unable to format a record for the live tail: %s", err)
+		return
 	}
 
-	logger := sysl.syslogger.WithField("Container", line.Container)
+	liveTail.Publish(sysl.service, line.Container, &TailRecord{
+		Data:        bytes.TrimRight(data, "\n"),
+		RateLimited: line.RateLimited,
+	})
+}
+
+// entryFor works out the fields and the level for a line
+func (sysl *UDPSyslogger) entryFor(line *LogLine) (*log.Entry, log.Level) {
+	descriptor := line.Stream
+	lineTxt := line.Text
+
+	logger := sysl.syslogger.WithField("Container", line.Container).WithTime(line.Timestamp)
+
+	// When catching up on a backlog, it's useful to know how far behind we are
+	if sysl.includeIngestTimestamp {
+		logger = logger.WithField("IngestTimestamp", time.Now().UTC().Format(time.RFC3339Nano))
+	}
 
 	// If regex log level parsing is enabled, try to extract the log level
 	// from structured logs (e.g., level=info)
@@ -113,14 +168,13 @@ func (sysl *UDPSyslogger) Log(line *LogLine) {
 			// Map to Error, Warn or Info based on severity
 			switch level {
 			case "panic", "fatal", "error":
-				logger.Error(lineTxt)
+				return logger, log.ErrorLevel
 			case "warning", "warn":
-				logger.Warn(lineTxt)
+				return logger, log.WarnLevel
 			default:
 				// info, debug, trace all go to Info
-				logger.Info(lineTxt)
+				return logger, log.InfoLevel
 			}
-			return
 		}
 	}
 
@@ -128,17 +182,15 @@ func (sysl *UDPSyslogger) Log(line *LogLine) {
 	// This is used when enhanced extraction is disabled or no structured level was found
 	lowerLine := strings.ToLower(lineTxt)
 	if descriptor == "stderr" || strings.Contains(lowerLine, "error") {
-		logger.Error(lineTxt)
-		return
+		return logger, log.ErrorLevel
 	}
 
 	// Support warning level by line-scraping as well
 	if strings.Contains(lowerLine, "warn") {
-		logger.Warn(lineTxt)
-		return
+		return logger, log.WarnLevel
 	}
 
-	logger.Info(lineTxt)
+	return logger, log.InfoLevel
 }
 
 // Stop would clean up any resources if we needed to manage any
@@ -151,6 +203,13 @@ type RateLimitingLogger struct {
 	limitReporter *reporter.LimitExceededReporter
 	output        LogOutput
 	limitKey      string
+
+	// Overrides can change the token limit for the service at runtime
+	Overrides *Overrides
+
+	tokenLimit     int
+	reportInterval time.Duration
+	appliedLimit   int // Only touched by Log()
 }
 
 func NewRateLimitingLogger(
@@ -171,11 +230,36 @@ func NewRateLimitingLogger(
 	}
 
 	return &RateLimitingLogger{
-		limitStore:    store,
-		limitReporter: limitReporter,
-		output:        output,
-		limitKey:      key,
+		limitStore:     store,
+		limitReporter:  limitReporter,
+		output:         output,
+		limitKey:       key,
+		tokenLimit:     tokenLimit,
+		reportInterval: reportInterval,
+		appliedLimit:   tokenLimit,
+	}
+}
+
+// applyOverrides changes the token limit if it was overridden, or when the
+// override is removed or expires
+func (logger *RateLimitingLogger) applyOverrides() {
+	limit := logger.tokenLimit
+	if override, ok := logger.Overrides.LimitFor(logger.limitKey); ok {
+		limit = override
+	}
+
+	if limit == logger.appliedLimit {
+		return
+	}
+
+	err := logger.limitStore.Set(context.Background(), logger.limitKey, uint64(limit), logger.reportInterval)
+	if err != nil {
+		log.Warnf("Unable to change the rate limit for %s to %d: %s", logger.limitKey, limit, err)
+		return
 	}
+
+	log.Infof("Rate limit for %s is now %d lines every %s", logger.limitKey, limit, logger.reportInterval)
+	logger.appliedLimit = limit
 }
 
 // isRateLimited compares the tracking key to the stored limit and returns
@@ -194,12 +278,20 @@ func (logger *RateLimitingLogger) isRateLimited() bool {
 
 // Log is a pass-through to the downstream LogOutput, but checks rate limiting status
 func (logger *RateLimitingLogger) Log(line *LogLine) {
+	logger.applyOverrides()
+
 	if !logger.isRateLimited() {
 		logger.output.Log(line)
 		return
 	}
 
+	line.RateLimited = true
 	logger.limitReporter.Incr()
+
+	// Anyone watching the live tail still gets to see what was held back
+	if mirror, ok := logger.output.(MirroringOutput); ok {
+		mirror.Mirror(line)
+	}
 }
 
 // Stop cleans up our resources on shutdown
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
@@ -50,6 +51,8 @@ func Test_UDPSyslogger(t *testing.T) {
 		ServiceName string    `json:"ServiceName"`
 		Timestamp   time.Time `json:"Timestamp"`
 		Container   string    `json:"Container"`
+
+		IngestTimestamp string `json:"IngestTimestamp"`
 	}{}
 
 	Convey("UDPSyslogger()", t, func() {
@@ -58,12 +61,12 @@ func Test_UDPSyslogger(t *testing.T) {
 			logger := NewUDPSyslogger(map[string]string{
 				"ServiceName": "bocaccio",
 				"Environment": "medieval",
-			}, "127.0.0.1:9714", enableRegexLogLevelParsing) // enhanced regex parsing disabled to test og mode
+			}, "127.0.0.1:9714", enableRegexLogLevelParsing, false) // enhanced regex parsing disabled to test og mode
 
 			logLine := "2022-12-06T12:20:28.418060579Z stdout F this is a test log line 💵 with UTF-8"
 
 			go func() {
-				logger.Log(&LogLine{Text: logLine, Container: "beowulf"})
+				logger.Log(criLine(logLine, "beowulf"))
 			}()
 
 			received, err := ListenUDP("127.0.0.1:9714")
@@ -75,23 +78,68 @@ func Test_UDPSyslogger(t *testing.T) {
 
 			So(theJson.Environment, ShouldEqual, "medieval")
 			So(theJson.ServiceName, ShouldEqual, "bocaccio")
-			So(theJson.Payload, ShouldEqual, logLine[40:len(logLine)])
-			So(theJson.Timestamp, ShouldNotBeEmpty)
+			So(theJson.Payload, ShouldEqual, "this is a test log line 💵 with UTF-8")
+			So(theJson.Timestamp, ShouldEqual, time.Date(2022, 12, 6, 12, 20, 28, 418060579, time.UTC))
+			So(theJson.IngestTimestamp, ShouldBeEmpty)
 			So(theJson.Container, ShouldEqual, "beowulf")
 		})
 
+		Convey("mirrors what it sends to anyone watching the live tail", func() {
+			viewer := &tailViewer{service: "bocaccio", records: make(chan *TailRecord, 1)}
+			liveTail.add(viewer)
+			Reset(func() { liveTail.remove(viewer) })
+
+			logger := NewUDPSyslogger(map[string]string{"ServiceName": "bocaccio"}, "127.0.0.1:9719", false, false)
+
+			go func() {
+				logger.Log(criLine("2022-12-06T12:20:28.418060579Z stderr F it broke", "beowulf"))
+			}()
+
+			received, err := ListenUDP("127.0.0.1:9719")
+			So(err, ShouldBeNil)
+
+			record := <-viewer.records
+			So(string(record.Data), ShouldEqual, strings.TrimRight(string(received), "\n"))
+			So(record.RateLimited, ShouldBeFalse)
+		})
+
+		Convey("adds the ingest timestamp when configured to", func() {
+			logger := NewUDPSyslogger(map[string]string{
+				"ServiceName": "bocaccio",
+				"Environment": "medieval",
+			}, "127.0.0.1:9718", false, true)
+
+			logLine := "2022-12-06T12:20:28.418060579Z stdout F this is a test log line"
+
+			go func() {
+				logger.Log(criLine(logLine, "beowulf"))
+			}()
+
+			received, err := ListenUDP("127.0.0.1:9718")
+			So(err, ShouldBeNil)
+			So(received, ShouldNotBeEmpty)
+
+			err = json.Unmarshal(received, &theJson)
+			So(err, ShouldBeNil)
+
+			So(theJson.Timestamp, ShouldEqual, time.Date(2022, 12, 6, 12, 20, 28, 418060579, time.UTC))
+			ingested, err := time.Parse(time.RFC3339Nano, theJson.IngestTimestamp)
+			So(err, ShouldBeNil)
+			So(ingested, ShouldHappenAfter, theJson.Timestamp)
+		})
+
 		Convey("correctly parses level from structured logs on stderr", func() {
 			enableRegexLogLevelParsing := true
 			logger := NewUDPSyslogger(map[string]string{
 				"ServiceName": "service",
 				"Environment": "prod",
-			}, "127.0.0.1:9715", enableRegexLogLevelParsing)
+			}, "127.0.0.1:9715", enableRegexLogLevelParsing, false)
 
 			// Info level info on stderr - should be logged as Info, not Error
 			infoLog := `2025-11-14T09:02:08.322480471Z stderr F time="2025-11-14T09:02:08Z" level=info msg="Started Worker" Namespace=default`
 
 			go func() {
-				logger.Log(&LogLine{Text: infoLog, Container: "worker"})
+				logger.Log(criLine(infoLog, "worker"))
 			}()
 
 			received, err := ListenUDP("127.0.0.1:9715")
@@ -110,13 +158,13 @@ func Test_UDPSyslogger(t *testing.T) {
 			logger := NewUDPSyslogger(map[string]string{
 				"ServiceName": "service",
 				"Environment": "prod",
-			}, "127.0.0.1:9716", enableRegexLogLevelParsing)
+			}, "127.0.0.1:9716", enableRegexLogLevelParsing, false)
 
 			// Warning level log on stderr
 			warnLog := `2025-11-14T09:36:09.227628554Z stderr F time="2025-11-14T09:36:09Z" level=warning msg="harvest failure" cmd=metric_data component=newrelic`
 
 			go func() {
-				logger.Log(&LogLine{Text: warnLog, Container: "worker"})
+				logger.Log(criLine(warnLog, "worker"))
 			}()
 
 			received, err := ListenUDP("127.0.0.1:9716")
@@ -134,13 +182,13 @@ func Test_UDPSyslogger(t *testing.T) {
 			logger := NewUDPSyslogger(map[string]string{
 				"ServiceName": "service",
 				"Environment": "prod",
-			}, "127.0.0.1:9717", enableRegexLogLevelParsing)
+			}, "127.0.0.1:9717", enableRegexLogLevelParsing, false)
 
 			// Error level log
 			errorLog := `2025-11-14T09:02:08.322480471Z stderr F time="2025-11-14T09:02:08Z" level=error msg="Connection failed" error="timeout"`
 
 			go func() {
-				logger.Log(&LogLine{Text: errorLog, Container: "worker"})
+				logger.Log(criLine(errorLog, "worker"))
 			}()
 
 			received, err := ListenUDP("127.0.0.1:9717")
@@ -159,13 +207,13 @@ func Test_UDPSyslogger(t *testing.T) {
 			logger := NewUDPSyslogger(map[string]string{
 				"ServiceName": "service",
 				"Environment": "prod",
-			}, "127.0.0.1:9717", enableRegexLogLevelParsing)
+			}, "127.0.0.1:9717", enableRegexLogLevelParsing, false)
 
 			// Error level log
 			errorLog := `2025-11-14T09:02:08.322480471Z stderr F time="2025-11-14T09:02:08Z" level="error" msg="Connection failed" error="timeout"`
 
 			go func() {
-				logger.Log(&LogLine{Text: errorLog, Container: "worker"})
+				logger.Log(criLine(errorLog, "worker"))
 			}()
 
 			received, err := ListenUDP("127.0.0.1:9717")
@@ -184,13 +232,13 @@ func Test_UDPSyslogger(t *testing.T) {
 			logger := NewUDPSyslogger(map[string]string{
 				"ServiceName": "service",
 				"Environment": "prod",
-			}, "127.0.0.1:9717", enableRegexLogLevelParsing)
+			}, "127.0.0.1:9717", enableRegexLogLevelParsing, false)
 
 			// Error level log
 			errorLog := `2025-11-14T09:02:08.322480471Z stderr F time="2025-11-14T09:02:08Z" level=unknown msg="Connection failed" error="timeout"`
 
 			go func() {
-				logger.Log(&LogLine{Text: errorLog, Container: "worker"})
+				logger.Log(criLine(errorLog, "worker"))
 			}()
 
 			received, err := ListenUDP("127.0.0.1:9717")
@@ -226,9 +274,60 @@ func Test_RateLimitingLogger(t *testing.T) {
 			So(mockUpstream.WasCalled, ShouldBeFalse)
 			So(mockUpstream.LastLogged, ShouldResemble, &LogLine{Text: "a line"})
 		})
+
+		Convey("shows the live tail what it held back", func() {
+			viewer := &tailViewer{service: "chopper", records: make(chan *TailRecord, 2)}
+			liveTail.add(viewer)
+			Reset(func() { liveTail.remove(viewer) })
+
+			output := NewUDPSyslogger(map[string]string{"ServiceName": "chopper"}, "127.0.0.1:9720", false, false)
+			logger := NewRateLimitingLogger(rptr, 1, time.Minute, "chopper", output)
+
+			logger.Log(&LogLine{Text: "a line", Container: "chopper"})
+			logger.Log(&LogLine{Text: "a line 2", Container: "chopper"})
+
+			sent, held := <-viewer.records, <-viewer.records
+			So(sent.RateLimited, ShouldBeFalse)
+			So(string(sent.Data), ShouldContainSubstring, `"Payload":"a line"`)
+			So(held.RateLimited, ShouldBeTrue)
+			So(string(held.Data), ShouldContainSubstring, `"Payload":"a line 2"`)
+		})
+
+		Convey("uses the token limit from the overrides", func() {
+			logger := NewRateLimitingLogger(rptr, 100, time.Minute, "chopper", mockUpstream)
+			logger.Overrides = NewOverrides(nil)
+
+			_ = LogCapture(func() {
+				_, err := logger.Overrides.Limit("chopper", 1, time.Hour)
+				So(err, ShouldBeNil)
+
+				logger.Log(&LogLine{Text: "a line"})
+				So(mockUpstream.WasCalled, ShouldBeTrue)
+
+				limited := &LogLine{Text: "a line 2"}
+				logger.Log(limited)
+				So(mockUpstream.LastLogged.Text, ShouldEqual, "a line")
+				So(limited.RateLimited, ShouldBeTrue)
+
+				So(logger.Overrides.Unlimit("chopper"), ShouldBeTrue)
+				logger.Log(&LogLine{Text: "a line 3"})
+				So(mockUpstream.LastLogged.Text, ShouldEqual, "a line 3")
+			})
+		})
 	})
 }
 
+// criLine parses a CRI log line for a test, the way the Tailer would
+func criLine(text string, container string) *LogLine {
+	line, err := parseCRILine(text)
+	if err != nil {
+		panic(err)
+	}
+	line.Container = container
+
+	return line
+}
+
 func ListenUDP(address string) ([]byte, error) {
 	pc, err := net.ListenPacket("udp", address)
 	if err != nil {
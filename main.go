@@ -2,14 +2,11 @@ package main
 
 import (
 	"errors"
-	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
-	_ "net/http/pprof"
-
 	"github.com/Shimmur/logtailer/cache"
 	"github.com/Shimmur/logtailer/reporter"
 	"github.com/kelseyhightower/envconfig"
@@ -28,10 +25,24 @@ const (
 )
 
 type Config struct {
-	Environment    string        `envconfig:"ENVIRONMENT" default:"dev"`
-	BasePath       string        `envconfig:"BASE_PATH" default:"/var/log/pods"`
-	DiscoInterval  time.Duration `envconfig:"DISCO_INTERVAL" default:"5s"`
-	MaxTrackedLogs int           `envconfig:"MAX_TRACKED_LOGS" default:"100"`
+	Environment     string        `envconfig:"ENVIRONMENT" default:"dev"`
+	BasePath        string        `envconfig:"BASE_PATH" default:"/var/log/pods"`
+	DiscoInterval   time.Duration `envconfig:"DISCO_INTERVAL" default:"5s"`
+	DiscoWatch      bool          `envconfig:"DISCO_WATCH" default:"true"`
+	DiscoMode       string        `envconfig:"DISCO_MODE" default:"dir"`
+	NodeName        string        `envconfig:"NODE_NAME"`
+	MaxTrackedLogs  int           `envconfig:"MAX_TRACKED_LOGS" default:"100"`
+	DrainGrace      time.Duration `envconfig:"DRAIN_GRACE_PERIOD" default:"10s"`
+	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"10s"`
+	FilterRecheck   time.Duration `envconfig:"FILTER_RECHECK_INTERVAL" default:"1m"`
+	DiscoveryMaxAge time.Duration `envconfig:"HEALTH_DISCOVERY_MAX_AGE" default:"1m"`
+
+	PriorityNamespaces []string `envconfig:"PRIORITY_NAMESPACES"`
+
+	HostLogs []string `envconfig:"HOST_LOGS"`
+
+	IncludeRules []string `envconfig:"INCLUDE_RULES"`
+	ExcludeRules []string `envconfig:"EXCLUDE_RULES"` // service=logtailer is always added
 
 	CacheFilePath      string        `envconfig:"CACHE_FILE_PATH" default:"/var/log/logtailer.json"`
 	CacheFlushInterval time.Duration `envconfig:"CACHE_FLUSH_INTERVAL" default:"3s"`
@@ -41,6 +52,14 @@ type Config struct {
 	NewRelicAccount string `envconfig:"NEW_RELIC_ACCOUNT"`
 	NewRelicKey     string `envconfig:"NEW_RELIC_LICENSE_KEY"`
 
+	AdminToken string `envconfig:"ADMIN_TOKEN"`
+
+	StateAddress     string `envconfig:"STATE_ADDRESS" default:":9476"`
+	StateToken       string `envconfig:"STATE_TOKEN"`
+	StateTLSCertFile string `envconfig:"STATE_TLS_CERT_FILE"`
+	StateTLSKeyFile  string `envconfig:"STATE_TLS_KEY_FILE"`
+	PprofAddress     string `envconfig:"PPROF_ADDRESS" default:"localhost:8081"`
+
 	TokenLimit    int           `envconfig:"TOKEN_LIMIT" default:"300"`
 	LimitInterval time.Duration `envconfig:"LIMIT_INTERVAL" default:"1m"`
 
@@ -48,8 +67,27 @@ type Config struct {
 	KubePort      int           `envconfig:"KUBERNETES_SERVICE_PORT" default:"8080"`
 	KubeTimeout   time.Duration `envconfig:"KUBERNETES_TIMEOUT" default:"3s"`
 	KubeCredsPath string        `envconfig:"KUBERNETES_CREDS_PATH" default:"/var/run/secrets/kubernetes.io/serviceaccount"`
+	KubeConfig    string        `envconfig:"KUBECONFIG"`
+	MetadataTTL   time.Duration `envconfig:"METADATA_TTL" default:"30s"`
+
+	ServiceLabel         string   `envconfig:"SERVICE_LABEL" default:"ServiceName"`
+	TailAnnotation       string   `envconfig:"TAIL_ANNOTATION" default:"community.com/TailLogs"`
+	TailAnnotationValues []string `envconfig:"TAIL_ANNOTATION_VALUES" default:"true"`
+	Filter               string   `envconfig:"FILTER" default:"pod-annotation"`
+
+	FilterFailurePolicy   string        `envconfig:"FILTER_FAILURE_POLICY" default:"closed"`
+	FilterRetryBackoff    time.Duration `envconfig:"FILTER_RETRY_BACKOFF" default:"5s"`
+	FilterMaxRetryBackoff time.Duration `envconfig:"FILTER_MAX_RETRY_BACKOFF" default:"5m"`
+
+	OutputLabels      []string          `envconfig:"OUTPUT_LABELS"`
+	OutputAnnotations []string          `envconfig:"OUTPUT_ANNOTATIONS"`
+	OutputFieldNames  map[string]string `envconfig:"OUTPUT_FIELD_NAMES"`
 
-	EnableRegexLogLevelParsing bool `envconfig:"ENABLE_REGEX_LOG_LEVEL_PARSING" default:false`
+	EnableRegexLogLevelParsing bool `envconfig:"ENABLE_REGEX_LOG_LEVEL_PARSING" default:"false"`
+	IncludeIngestTimestamp     bool `envconfig:"INCLUDE_INGEST_TIMESTAMP" default:"false"`
+
+	MaxLineSize         int           `envconfig:"MAX_LINE_SIZE" default:"262144"`
+	PartialFlushTimeout time.Duration `envconfig:"PARTIAL_FLUSH_TIMEOUT" default:"5s"`
 
 	Debug bool `envconfig:"DEBUG" default:"false"`
 }
@@ -68,28 +106,127 @@ func configureCache(config *Config) *cache.Cache {
 	return cache
 }
 
+// configureKubeClient sets up the client for the Kubernetes API, from the
+// kubeconfig if there is one, or else the service account. Returns nil if we
+// can't talk to Kubernetes.
+func configureKubeClient(config *Config) *KubeClient {
+	if config.KubeConfig == "" {
+		return NewKubeClient(
+			config.KubeHost, config.KubePort, config.KubeTimeout, config.KubeCredsPath,
+		)
+	}
+
+	client, err := NewKubeClientFromKubeconfig(config.KubeConfig, config.KubeTimeout)
+	if err != nil {
+		log.Fatalf("Invalid KUBECONFIG: %s", err)
+	}
+
+	log.Infof("Using the Kubernetes API at %s:%d from KUBECONFIG", client.KubeHost, client.KubePort)
+	return client
+}
+
+// configureDiscovery sets up the Discoverer. When watching is enabled we find
+// out about new pods as soon as their logs appear, and DISCO_INTERVAL polling
+// only serves to reconcile anything we missed. Host logs are added on if any
+// are configured. The pod metadata, if we have it, is kept up to date from
+// Kubernetes discovery, or else used to name services after their label.
+func configureDiscovery(config *Config, client *KubeClient, metadata *PodMetadataCache) Discoverer {
+	var disco Discoverer = NewDirListDiscoverer(config.BasePath, config.Environment)
+
+	// Ask Kubernetes which pods are on this node instead of parsing dir names
+	if config.DiscoMode == "kubernetes" {
+		disco = configureK8sDiscovery(config, client, disco, metadata)
+	} else if metadata != nil {
+		disco = NewMetadataDiscoverer(disco, metadata, config.ServiceLabel)
+	}
+
+	if config.DiscoWatch {
+		watcher, err := NewWatchingDiscoverer(disco, config.BasePath)
+		if err != nil {
+			log.Warnf("Unable to watch %s, falling back to polling only: %s", config.BasePath, err)
+		} else {
+			watcher.Run()
+			disco = watcher
+		}
+	}
+
+	if len(config.HostLogs) == 0 {
+		return disco
+	}
+
+	// Plain log files on the host, tailed alongside the pods
+	sources, err := ParseHostLogSources(config.HostLogs)
+	if err != nil {
+		log.Fatalf("Invalid HOST_LOGS: %s", err)
+	}
+
+	multi := NewMultiDiscoverer(disco, NewGlobDiscoverer(sources, config.Environment))
+	multi.Run()
+
+	return multi
+}
+
+// configureK8sDiscovery sets up a K8sDiscoverer for this node. If we can't
+// talk to Kubernetes, we fall back to the fallback Discoverer.
+func configureK8sDiscovery(config *Config, client *KubeClient, fallback Discoverer, metadata *PodMetadataCache) Discoverer {
+	nodeName := getNodeName(config)
+
+	if client == nil {
+		log.Warn("Failed to configure Kubernetes discovery, using directory discovery...")
+		return fallback
+	}
+
+	log.Infof("Discovering pods on node %s from the Kubernetes API", nodeName)
+	disco := NewK8sDiscoverer(client, nodeName, config.BasePath, config.Environment)
+	disco.Metadata = metadata
+	disco.ServiceLabel = config.ServiceLabel
+	disco.Run()
+
+	return disco
+}
+
 // NewTailerWithUDPSyslog is passed to PodTracker to generate new Tailers with
 // UDP Syslog output. It uses a closure to pass in cache, address, and hostname.
-func NewTailerWithUDPSyslog(c *cache.Cache, hostname string,
-	config *Config, rptr *reporter.LimitExceededReporter) NewTailerFunc {
+// The extra fields for each pod come from outputFields, and changes to the
+// token limits from overrides. Either may be nil.
+func NewTailerWithUDPSyslog(c *cache.Cache, hostname string, config *Config,
+	rptr *reporter.LimitExceededReporter, outputFields *OutputFields, overrides *Overrides) NewTailerFunc {
 
 	return func(pod *Pod) LogTailer {
-		// Configure the fields we log to Syslog
-		udpLogger := NewUDPSyslogger(map[string]string{
-			"ServiceName": pod.ServiceName,
-			"Environment": pod.Environment,
-			"PodName":     pod.Name,
-			"Hostname":    hostname,
-		}, config.SyslogAddress, config.EnableRegexLogLevelParsing)
+		// Configure the fields we log to Syslog. Ours win over any extra ones
+		// that happen to have the same name.
+		labels := outputFields.For(pod)
+		labels["ServiceName"] = pod.ServiceName
+		labels["Environment"] = pod.Environment
+		labels["PodName"] = pod.Name
+		labels["Hostname"] = hostname
+
+		udpLogger := NewUDPSyslogger(
+			labels, config.SyslogAddress, config.EnableRegexLogLevelParsing, config.IncludeIngestTimestamp,
+		)
 
 		// Inject the UDPSyslogger into the RateLimitingLogger
 		limitingLogger := NewRateLimitingLogger(rptr, config.TokenLimit, config.LimitInterval, pod.ServiceName, udpLogger)
+		limitingLogger.Overrides = overrides
+
+		tailer := NewTailer(pod, c, limitingLogger)
+		tailer.MaxLineSize = config.MaxLineSize
+		tailer.PartialFlushTimeout = config.PartialFlushTimeout
 
 		// Wrap the return value from NewTailer as an interface
-		return NewTailer(pod, c, limitingLogger)
+		return tailer
 	}
 }
 
+// getNodeName returns the name of the Kubernetes node we are running on
+func getNodeName(config *Config) string {
+	if config.NodeName != "" {
+		return config.NodeName
+	}
+
+	return getHostname()
+}
+
 // getHostname figures out what the hostname is that we should use for log records
 func getHostname() string {
 	// This allows us to override the hostname for running inside a container and having the
@@ -118,10 +255,10 @@ func configureService() *Config {
 		log.Fatal(err.Error())
 	}
 
-	// Redact the secret key
+	// Redact the secrets
 	var redacted = "[REDACTED]"
 	maskFunc := func(argument string) *string {
-		if argument == "NewRelicKey" {
+		if argument == "NewRelicKey" || argument == "AdminToken" || argument == "StateToken" {
 			return &redacted
 		}
 		return nil
@@ -137,16 +274,73 @@ func configureService() *Config {
 	return &config
 }
 
+// configureFilter builds the DiscoveryFilter from the FILTER configuration.
+// If we can't talk to Kubernetes, the filters that need it follow the
+// failure policy: they accept everything if we fail open, and otherwise fail.
+func configureFilter(config *Config, podFilter *PodFilter, metadata *PodMetadataCache) DiscoveryFilter {
+	named := make(map[string]DiscoveryFilter)
+
+	switch {
+	case podFilter != nil:
+		namespaceFilter := NewNamespaceAnnotationFilter(podFilter.KubeClient, podFilter.Keys, config.MetadataTTL)
+		namespaceFilter.Metadata = metadata
+
+		named["pod-annotation"] = podFilter
+		named["namespace-annotation"] = namespaceFilter
+	case config.FilterFailurePolicy == FailOpen:
+		log.Warn("Failed to configure filter, failing open and tailing everything...")
+		named["pod-annotation"] = &StubFilter{}
+		named["namespace-annotation"] = &StubFilter{}
+	default:
+		log.Errorf("Failed to configure filter, failure policy is %s", config.FilterFailurePolicy)
+		named["pod-annotation"] = &UnavailableFilter{}
+		named["namespace-annotation"] = &UnavailableFilter{}
+	}
+
+	filter, err := ParseFilter(config.Filter, named)
+	if err != nil {
+		log.Fatalf("Invalid FILTER: %s", err)
+	}
+
+	return filter
+}
+
 func main() {
 	config := configureService()
-	var filter DiscoveryFilter
+	if err := ValidFailurePolicy(config.FilterFailurePolicy); err != nil {
+		log.Fatalf("Invalid FILTER_FAILURE_POLICY: %s", err)
+	}
+
+	// The state server, where everything but pprof is served
+	stateServer := NewHTTPServer("state", config.StateAddress)
+	stateServer.Token = config.StateToken
+	stateServer.CertFile = config.StateTLSCertFile
+	stateServer.KeyFile = config.StateTLSKeyFile
+	if err := stateServer.Validate(); err != nil {
+		log.Fatalf("Invalid STATE_TLS_CERT_FILE or STATE_TLS_KEY_FILE: %s", err)
+	}
 
 	// Some deps for injection
 	cache := configureCache(config)
-	podFilter := NewPodFilter(
-		config.KubeHost, config.KubePort, config.KubeTimeout, config.KubeCredsPath,
-	)
-	disco := NewDirListDiscoverer(config.BasePath, config.Environment)
+	client := configureKubeClient(config)
+	keys := &FilterKeys{
+		ServiceLabel: config.ServiceLabel,
+		Annotation:   config.TailAnnotation,
+		Values:       config.TailAnnotationValues,
+	}
+	var podFilter *PodFilter
+	var metadata *PodMetadataCache
+	if client != nil {
+		// One list of the pods on the node rather than one per pod
+		metadata = NewPodMetadataCache(client, getNodeName(config), config.MetadataTTL)
+		podFilter = &PodFilter{KubeClient: client, Metadata: metadata, Keys: keys}
+		stateServer.Handle("/metadata", metadata)
+	}
+	disco := configureDiscovery(config, client, metadata)
+	rules, err := NewDiscoveryRules(config.IncludeRules, WithSelfExclusion(config.ExcludeRules))
+	if err != nil {
+		log.Fatalf("Invalid discovery rules: %s", err)
+	}
 	rptr := reporter.NewLimitExceededReporter(
 		NewRelicBaseURL, config.NewRelicKey, config.NewRelicAccount,
 	)
@@ -156,45 +350,62 @@ func main() {
 	cacheLooper := director.NewTimedLooper(
 		director.FOREVER, config.CacheFlushInterval, make(chan error))
 
-	// In the event our filter can't find the right creds, etc, we fail open
-	if podFilter != nil {
-		filter = podFilter
-	} else {
-		log.Warn("Failed to configure filter, proceeding anyway using stub...")
-		filter = &StubFilter{}
-	}
+	filter := configureFilter(config, podFilter, metadata)
 
 	// Set up and run the tracker
-	newTailerFunc := NewTailerWithUDPSyslog(cache, getHostname(), config, rptr)
+	outputFields := NewOutputFields(
+		config.OutputLabels, config.OutputAnnotations, config.OutputFieldNames, metadata,
+	)
+	overrides := NewOverrides(cache)
+	newTailerFunc := NewTailerWithUDPSyslog(cache, getHostname(), config, rptr, outputFields, overrides)
 	tracker := NewPodTracker(podDiscoveryLooper, disco, newTailerFunc, filter)
+	tracker.DrainGrace = config.DrainGrace
+	tracker.RecheckInterval = config.FilterRecheck
+	tracker.FailurePolicy = config.FilterFailurePolicy
+	tracker.RetryBackoff = config.FilterRetryBackoff
+	tracker.MaxRetryBackoff = config.FilterMaxRetryBackoff
+	tracker.MaxTrackedLogs = config.MaxTrackedLogs
+	tracker.Priority = &TailPriority{
+		Keys:       keys,
+		Namespaces: config.PriorityNamespaces,
+		Metadata:   metadata,
+	}
+	tracker.Rules = rules
+	tracker.Overrides = overrides
 	go tracker.Run()
 	// Set up the state server for debugging
-	tracker.ServeHTTP()
+	tracker.RegisterHandlers(stateServer)
+
+	// The admin API is only there if it has a token. It checks its own.
+	if config.AdminToken != "" {
+		stateServer.HandlePublic("/admin/", NewAdminAPI(config.AdminToken, overrides))
+	}
+
+	// Health checks for Kubernetes
+	health := NewHealth()
+	health.Add("discovery", true, tracker.CheckDiscovery(config.DiscoveryMaxAge))
+	health.Add("cache", false, tracker.CheckCache())
+	health.Add("outputs", false, CheckOutputs)
+	if metadata != nil {
+		health.Add("filter", false, metadata.Check)
+	}
+	// The probes can't send the token
+	stateServer.HandlePublic("/healthz", health.Liveness())
+	stateServer.HandlePublic("/readyz", health.Readiness())
+	stateServer.Start()
 
 	// Run the reporter
 	go rptr.Run()
 
 	// Persist the cache on a timer
 	go cacheLooper.Loop(func() error {
-		// Get the latest offsets into the main cache
-		tracker.FlushOffsets()
-
-		// Write them out
-		err := cache.Persist()
-		if err != nil {
-			log.Errorf("Persisting offsets failed: %s", err)
-		}
+		// Get the latest offsets into the main cache and write them out
+		tracker.PersistOffsets(cache)
 		return nil
 	})
 
 	if config.Debug {
-		log.Info("Staring pprof server on port 8081")
-		go func() {
-			log.Infof("Starting pprof server on :8081")
-			if err := http.ListenAndServe("localhost:8081", nil); err != nil {
-				log.Fatalf("pprof server failed: %v", err)
-			}
-		}()
+		NewPprofServer(config.PprofAddress).Start()
 	}
 
 	// Block waiting on signal
@@ -203,7 +414,10 @@ func main() {
 	podDiscoveryLooper.Quit()
 	cacheLooper.Quit()
 
-	// Let these shut down properly, including flushing offsets
+	// Let these shut down properly
 	podDiscoveryLooper.WaitWithoutError()
 	cacheLooper.WaitWithoutError()
+
+	// Deliver what we've read and write the final offsets
+	tracker.Shutdown(config.ShutdownTimeout, cache)
 }
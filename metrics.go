@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The Metrics for the whole pipeline, served on /metrics by the state server
+var metrics = NewMetrics()
+
+// DefaultDurationBuckets are the histogram buckets for the durations we time,
+// in seconds
+var DefaultDurationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics are the counters and histograms we keep for Prometheus. They are
+// written out in the Prometheus text format, so we don't need the client
+// library for the handful we have.
+type Metrics struct {
+	DiscoveryDuration    *Histogram
+	DiscoveryErrors      *Counter
+	FilterDuration       *Histogram
+	FilterResults        *CounterVec // by result: tail, skip or error
+	LinesRead            *CounterVec // by service
+	LinesSent            *CounterVec // by service
+	LinesDropped         *CounterVec // by service
+	LinesRateLimited     *CounterVec // by service
+	CachePersistFailures *Counter
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		DiscoveryDuration: NewHistogram("logtailer_discovery_duration_seconds",
+			"How long each discovery pass took.", DefaultDurationBuckets),
+		DiscoveryErrors: NewCounter("logtailer_discovery_errors_total",
+			"Discovery passes that failed."),
+		FilterDuration: NewHistogram("logtailer_filter_duration_seconds",
+			"How long the filter took to decide whether to tail a pod.", DefaultDurationBuckets),
+		FilterResults: NewCounterVec("logtailer_filter_results_total",
+			"What the filter decided about pods, or whether it failed.", "result"),
+		LinesRead: NewCounterVec("logtailer_lines_read_total",
+			"Lines read from the logs.", "service"),
+		LinesSent: NewCounterVec("logtailer_lines_sent_total",
+			"Lines sent to the syslog output.", "service"),
+		LinesDropped: NewCounterVec("logtailer_lines_dropped_total",
+			"Lines dropped because they couldn't be sent in time.", "service"),
+		LinesRateLimited: NewCounterVec("logtailer_lines_rate_limited_total",
+			"Lines dropped because the service was over its rate limit.", "service"),
+		CachePersistFailures: NewCounter("logtailer_cache_persist_failures_total",
+			"Times we failed to persist the offset cache."),
+	}
+}
+
+// Write writes out all the metrics in the Prometheus text format
+func (m *Metrics) Write(w io.Writer) {
+	m.DiscoveryDuration.Write(w)
+	m.DiscoveryErrors.Write(w)
+	m.FilterDuration.Write(w)
+	m.FilterResults.Write(w)
+	m.LinesRead.Write(w)
+	m.LinesSent.Write(w)
+	m.LinesDropped.Write(w)
+	m.LinesRateLimited.Write(w)
+	m.CachePersistFailures.Write(w)
+}
+
+// serviceLines are the line counters for one service, so that the Tailers
+// don't have to look them up for every line
+type serviceLines struct {
+	read        *int64
+	sent        *int64
+	dropped     *int64
+	rateLimited *int64
+}
+
+// linesFor returns the line counters for a service
+func (m *Metrics) linesFor(service string) *serviceLines {
+	return &serviceLines{
+		read:        m.LinesRead.With(service),
+		sent:        m.LinesSent.With(service),
+		dropped:     m.LinesDropped.With(service),
+		rateLimited: m.LinesRateLimited.With(service),
+	}
+}
+
+// A Counter only goes up
+type Counter struct {
+	name  string
+	help  string
+	value int64 // atomic
+}
+
+func NewCounter(name, help string) *Counter {
+	return &Counter{name: name, help: help}
+}
+
+func (c *Counter) Inc() {
+	atomic.AddInt64(&c.value, 1)
+}
+
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+func (c *Counter) Write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, c.Value())
+}
+
+// A CounterVec is a set of Counters told apart by the value of one label
+type CounterVec struct {
+	name   string
+	help   string
+	label  string
+	lock   sync.RWMutex
+	values map[string]*int64
+}
+
+func NewCounterVec(name, help, label string) *CounterVec {
+	return &CounterVec{name: name, help: help, label: label, values: make(map[string]*int64)}
+}
+
+// With returns the counter for a label value, to be updated atomically
+func (c *CounterVec) With(value string) *int64 {
+	c.lock.RLock()
+	counter, ok := c.values[value]
+	c.lock.RUnlock()
+	if ok {
+		return counter
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if counter, ok := c.values[value]; ok {
+		return counter
+	}
+
+	counter = new(int64)
+	c.values[value] = counter
+
+	return counter
+}
+
+// Inc adds one to the counter for a label value
+func (c *CounterVec) Inc(value string) {
+	atomic.AddInt64(c.With(value), 1)
+}
+
+// Value returns the count for a label value
+func (c *CounterVec) Value(value string) int64 {
+	return atomic.LoadInt64(c.With(value))
+}
+
+func (c *CounterVec) Write(w io.Writer) {
+	c.lock.RLock()
+	values := make([]string, 0, len(c.values))
+	for value := range c.values {
+		values = append(values, value)
+	}
+	c.lock.RUnlock()
+	sort.Strings(values)
+
+	writeHeader(w, c.name, c.help, "counter")
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=%s} %d\n", c.name, c.label, quoteLabel(value), c.Value(value))
+	}
+}
+
+// A Histogram counts observations in buckets, in the way Prometheus expects
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	lock    sync.Mutex
+	counts  []int64 // Not cumulative, the last is for anything bigger
+	sum     float64
+	count   int64
+}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return &Histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]int64, len(buckets)+1),
+	}
+}
+
+// Observe records a value
+func (h *Histogram) Observe(value float64) {
+	bucket := sort.SearchFloat64s(h.buckets, value)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.counts[bucket]++
+	h.sum += value
+	h.count++
+}
+
+// Since records the time since start, in seconds
+func (h *Histogram) Since(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Count returns how many values were recorded
+func (h *Histogram) Count() int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.count
+}
+
+func (h *Histogram) Write(w io.Writer) {
+	h.lock.Lock()
+	counts := append([]int64(nil), h.counts...)
+	sum, count := h.sum, h.count
+	h.lock.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+
+	var cumulative int64
+	for i, bound := range h.buckets {
+		cumulative += counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, count)
+}
+
+// writeGauge writes out a gauge that we work out when we are scraped
+func writeGauge(w io.Writer, name, help string, value int64) {
+	writeHeader(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// quoteLabel quotes a label value, escaping it as Prometheus expects
+func quoteLabel(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+
+	return `"` + value + `"`
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	director "github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Metrics(t *testing.T) {
+	Convey("Metrics", t, func() {
+		Convey("writes counters by label, in order and quoted", func() {
+			lines := NewCounterVec("test_lines_total", "Lines.", "service")
+			lines.Inc("zebra")
+			lines.Inc(`say "hi"`)
+			lines.Inc("zebra")
+
+			var out bytes.Buffer
+			lines.Write(&out)
+
+			So(out.String(), ShouldEqual, "# HELP test_lines_total Lines.\n"+
+				"# TYPE test_lines_total counter\n"+
+				`test_lines_total{service="say \"hi\""} 1`+"\n"+
+				`test_lines_total{service="zebra"} 2`+"\n",
+			)
+		})
+
+		Convey("writes histograms with cumulative buckets", func() {
+			durations := NewHistogram("test_seconds", "Durations.", []float64{0.1, 1})
+			durations.Observe(0.05)
+			durations.Observe(0.1)
+			durations.Observe(0.5)
+			durations.Observe(3)
+
+			var out bytes.Buffer
+			durations.Write(&out)
+
+			So(out.String(), ShouldEqual, "# HELP test_seconds Durations.\n"+
+				"# TYPE test_seconds histogram\n"+
+				`test_seconds_bucket{le="0.1"} 2`+"\n"+
+				`test_seconds_bucket{le="1"} 3`+"\n"+
+				`test_seconds_bucket{le="+Inf"} 4`+"\n"+
+				"test_seconds_sum 3.65\n"+
+				"test_seconds_count 4\n",
+			)
+		})
+
+		Convey("are updated as we discover and filter pods", func() {
+			looper := director.NewFreeLooper(director.ONCE, make(chan error))
+			disco := newMockDisco()
+			disco.Pods = []*Pod{&Pod{Name: "metrics_pod"}, &Pod{Name: "metrics_skipped"}}
+
+			filter := &mockFilter{ShouldNotTailFor: map[string]bool{"metrics_skipped": true}}
+			tracker := NewPodTracker(looper, disco, NewMockTailerFunc(&MockTailer{}), filter)
+
+			passes := metrics.DiscoveryDuration.Count()
+			tailed := metrics.FilterResults.Value("tail")
+			skipped := metrics.FilterResults.Value("skip")
+
+			_ = LogCapture(func() {
+				go tracker.Run()
+				So(looper.Wait(), ShouldBeNil)
+			})
+
+			So(metrics.DiscoveryDuration.Count(), ShouldEqual, passes+1)
+			So(metrics.FilterResults.Value("tail"), ShouldEqual, tailed+1)
+			So(metrics.FilterResults.Value("skip"), ShouldEqual, skipped+1)
+
+			Convey("and served on /metrics", func() {
+				recorder := httptest.NewRecorder()
+				tracker.serveMetrics(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+				So(recorder.Code, ShouldEqual, 200)
+				So(recorder.Header().Get("Content-Type"), ShouldStartWith, "text/plain; version=0.0.4")
+
+				body := recorder.Body.String()
+				So(body, ShouldContainSubstring, "# TYPE logtailer_discovery_duration_seconds histogram\n")
+				So(body, ShouldContainSubstring, `logtailer_filter_results_total{result="tail"}`)
+				So(body, ShouldContainSubstring, "logtailer_cache_persist_failures_total ")
+				So(body, ShouldContainSubstring, "logtailer_tracked_pods 0\n")
+				So(body, ShouldContainSubstring, "logtailer_log_pumps ")
+			})
+		})
+	})
+}
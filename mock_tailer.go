@@ -1,16 +1,50 @@
 package main
 
+import (
+	"sync"
+	"time"
+)
+
 // MockTailer implements the LogTailer interface, for testing, and for services
 // we will not follow.
 type MockTailer struct {
 	FlushOffsetsWasCalled bool
 	RunWasCalled          bool
+	DrainWasCalled        bool
+	StartAtEndWasCalled   bool
 	StopWasCalled         bool
+	ShutdownWasCalled     bool
+
+	PodTailed  *Pod
+	SkipReason string `json:",omitempty"` // Why we aren't tailing the pod
 
-	PodTailed *Pod
+	lock sync.Mutex // The PodTracker calls some of these in the background
 }
 
 func (t *MockTailer) TailLogs(logFiles []string) error { return nil }
-func (t *MockTailer) Run()                             { t.RunWasCalled = true }
-func (t *MockTailer) FlushOffsets()                    { t.FlushOffsetsWasCalled = true }
-func (t *MockTailer) Stop()                            { t.StopWasCalled = true }
+func (t *MockTailer) Run()                             { t.called(&t.RunWasCalled) }
+func (t *MockTailer) FlushOffsets()                    { t.called(&t.FlushOffsetsWasCalled) }
+func (t *MockTailer) Drain(grace time.Duration)        { t.called(&t.DrainWasCalled) }
+func (t *MockTailer) StartAtEnd()                      { t.called(&t.StartAtEndWasCalled) }
+func (t *MockTailer) Stop()                            { t.called(&t.StopWasCalled) }
+
+func (t *MockTailer) Shutdown(deadline time.Time) (int64, int64) {
+	t.called(&t.ShutdownWasCalled)
+	return 0, 0
+}
+
+// WasCalled returns one of the flags, safe to use while the methods may be
+// called from another goroutine
+func (t *MockTailer) WasCalled(flag *bool) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return *flag
+}
+
+func (t *MockTailer) called(flag *bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	*flag = true
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputFields picks the extra fields to add to every record we send for a
+// pod: the pod's UID, namespace and owner kind, and any of its labels and
+// annotations on the allowlists. The labels and annotations come from the pod
+// metadata the filter already fetches. Each is sent under its own name unless
+// Names renames it.
+type OutputFields struct {
+	Labels      []string
+	Annotations []string
+	Names       map[string]string // Label or annotation to field name
+
+	Metadata *PodMetadataCache
+}
+
+func NewOutputFields(labels, annotations []string, names map[string]string, metadata *PodMetadataCache) *OutputFields {
+	return &OutputFields{
+		Labels:      labels,
+		Annotations: annotations,
+		Names:       names,
+		Metadata:    metadata,
+	}
+}
+
+// For returns the extra fields for a pod. Safe to call on a nil OutputFields,
+// in which case only what we know from discovery is used.
+func (o *OutputFields) For(pod *Pod) map[string]string {
+	fields := make(map[string]string)
+
+	uid, ownerKind := pod.UID, pod.OwnerKind
+	labels := pod.Labels
+	var annotations map[string]string
+
+	if o != nil && o.Metadata != nil && !pod.HostLog {
+		item, ok, err := o.Metadata.Lookup(pod.Name)
+		if err != nil {
+			log.Warnf("Unable to get pod metadata for %s, sending fewer fields: %s", pod.Name, err)
+		}
+
+		if ok {
+			uid = item.Metadata.UID
+			ownerKind, _ = item.Owner()
+			labels = item.Metadata.Labels
+			annotations = item.Metadata.Annotations
+		}
+	}
+
+	addField(fields, "PodUID", uid)
+	addField(fields, "Namespace", pod.Namespace)
+	addField(fields, "OwnerKind", ownerKind)
+
+	if o == nil {
+		return fields
+	}
+
+	for _, key := range o.Labels {
+		addField(fields, o.nameFor(key), labels[key])
+	}
+
+	for _, key := range o.Annotations {
+		addField(fields, o.nameFor(key), annotations[key])
+	}
+
+	return fields
+}
+
+// nameFor returns the field name for a label or annotation
+func (o *OutputFields) nameFor(key string) string {
+	if name, ok := o.Names[key]; ok && name != "" {
+		return name
+	}
+
+	return key
+}
+
+// addField adds a field if it has a value and isn't already there
+func addField(fields map[string]string, name, value string) {
+	if value == "" {
+		return
+	}
+
+	if _, ok := fields[name]; ok {
+		return
+	}
+
+	fields[name] = value
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Shimmur/logtailer/cache"
+	"github.com/Shimmur/logtailer/reporter"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const outputFieldsFixture = `{"items":[
+	{"metadata":{"name":"chopper-f5b66c6bf-cgslk","namespace":"default","uid":"9df92617-0407-470e-8182-a506aa7e0499",
+		"labels":{"ServiceName":"chopper","team":"platform","app.kubernetes.io/version":"1.2.3"},
+		"annotations":{"community.com/TailLogs":"true","example.com/tier":"gold"},
+		"ownerReferences":[{"kind":"ReplicaSet","name":"chopper-f5b66c6bf","controller":true}]},
+	 "spec":{"nodeName":"beowulf"}}
+]}`
+
+func Test_OutputFields(t *testing.T) {
+	Convey("OutputFields", t, func() {
+		server, client := fakeKubeAPI(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, outputFieldsFixture)
+		})
+		Reset(server.Close)
+
+		metadata := NewPodMetadataCache(client, "beowulf", time.Minute)
+		fields := NewOutputFields(
+			[]string{"team", "app.kubernetes.io/version", "missing"},
+			[]string{"example.com/tier"},
+			map[string]string{"app.kubernetes.io/version": "Version", "example.com/tier": "Tier"},
+			metadata,
+		)
+
+		pod := &Pod{
+			Name:        "default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499",
+			Namespace:   "default",
+			ServiceName: "chopper",
+		}
+
+		Convey("adds the pod fields and the allowed labels and annotations, renamed", func() {
+			So(fields.For(pod), ShouldResemble, map[string]string{
+				"PodUID":    "9df92617-0407-470e-8182-a506aa7e0499",
+				"Namespace": "default",
+				"OwnerKind": "ReplicaSet",
+				"team":      "platform",
+				"Version":   "1.2.3",
+				"Tier":      "gold",
+			})
+		})
+
+		Convey("uses what discovery knows when there is no metadata", func() {
+			pod.UID = "9df92617-0407-470e-8182-a506aa7e0499"
+			pod.OwnerKind = "StatefulSet"
+			pod.Labels = map[string]string{"team": "data"}
+			server.Close()
+
+			var found map[string]string
+			capture := LogCapture(func() {
+				found = fields.For(pod)
+			})
+
+			So(capture, ShouldContainSubstring, "sending fewer fields")
+			So(found, ShouldResemble, map[string]string{
+				"PodUID":    "9df92617-0407-470e-8182-a506aa7e0499",
+				"Namespace": "default",
+				"OwnerKind": "StatefulSet",
+				"team":      "data",
+			})
+
+			var none *OutputFields
+			So(none.For(pod), ShouldResemble, map[string]string{
+				"PodUID":    "9df92617-0407-470e-8182-a506aa7e0499",
+				"Namespace": "default",
+				"OwnerKind": "StatefulSet",
+			})
+		})
+
+		Convey("never replaces the fields we always send", func() {
+			fields.Names["team"] = "ServiceName"
+
+			cacheFile, err := os.CreateTemp("", "seekInfoCache*")
+			So(err, ShouldBeNil)
+			Reset(func() { os.Remove(cacheFile.Name()) })
+
+			config := &Config{SyslogAddress: "127.0.0.1", TokenLimit: 300, LimitInterval: time.Minute}
+			newTailer := NewTailerWithUDPSyslog(
+				cache.NewCache(5, cacheFile.Name()), "beowulf", config, reporter.NewLimitExceededReporter("", "", ""), fields, nil,
+			)
+
+			tailer := newTailer(pod).(*Tailer)
+			udpLogger := tailer.logger.(*RateLimitingLogger).output.(*UDPSyslogger)
+
+			So(udpLogger.syslogger.Data["ServiceName"], ShouldEqual, "chopper")
+			So(udpLogger.syslogger.Data["Tier"], ShouldEqual, "gold")
+			So(udpLogger.syslogger.Data["OwnerKind"], ShouldEqual, "ReplicaSet")
+		})
+	})
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shimmur/logtailer/cache"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// OverridePause stops tailing the pods it matches
+	OverridePause = "pause"
+	// OverrideLimit changes the token limit for a service
+	OverrideLimit = "limit"
+
+	ScopePod       = "pod"
+	ScopeService   = "service"
+	ScopeNamespace = "namespace"
+
+	// The name the overrides are kept under in the cache
+	overridesMeta = "overrides"
+)
+
+// An Override changes how we treat some pods until it expires. A pause
+// matches a pod by its name, service or namespace, and a limit matches a
+// service.
+type Override struct {
+	Kind       string
+	Scope      string
+	Target     string
+	TokenLimit int `json:",omitempty"`
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+}
+
+// key is how we tell overrides apart. A new one replaces an old one with the
+// same key.
+func (o *Override) key() string {
+	return o.Kind + "/" + o.Scope + "/" + o.Target
+}
+
+func (o *Override) expired(now time.Time) bool {
+	return !now.Before(o.ExpiresAt)
+}
+
+// matches returns true if a pause applies to the pod. Pods can be named by
+// their log directory or, when we know it, their name in Kubernetes.
+func (o *Override) matches(pod *Pod) bool {
+	switch o.Scope {
+	case ScopePod:
+		return o.Target == pod.Name || (pod.PodName != "" && o.Target == pod.PodName)
+	case ScopeService:
+		return o.Target == pod.ServiceName
+	case ScopeNamespace:
+		return o.Target == pod.Namespace
+	}
+
+	return false
+}
+
+// ValidScope returns an error if a scope isn't one we know about
+func ValidScope(scope string) error {
+	switch scope {
+	case ScopePod, ScopeService, ScopeNamespace:
+		return nil
+	}
+
+	return fmt.Errorf("unknown scope '%s', expected %s, %s or %s", scope, ScopePod, ScopeService, ScopeNamespace)
+}
+
+// Overrides are the changes made at runtime through the AdminAPI. They are
+// kept in the cache, so that they last across restarts until they expire.
+// The lookups are safe to use on nil Overrides, in which case there aren't
+// any.
+type Overrides struct {
+	lock      sync.RWMutex
+	overrides map[string]*Override // by key
+	cache     *cache.Cache
+}
+
+// overridesFile is how the overrides are stored in the cache
+type overridesFile struct {
+	Overrides []*Override
+}
+
+// NewOverrides returns the Overrides stored in the cache, leaving out any that
+// have expired
+func NewOverrides(cache *cache.Cache) *Overrides {
+	o := &Overrides{
+		overrides: make(map[string]*Override),
+		cache:     cache,
+	}
+
+	if cache == nil {
+		return o
+	}
+
+	stored := cache.Meta(overridesMeta)
+	if stored == nil {
+		return o
+	}
+
+	var file overridesFile
+	err := json.Unmarshal(stored, &file)
+	if err != nil {
+		log.Warnf("Unable to load the overrides from the cache, starting without them: %s", err)
+		return o
+	}
+
+	now := time.Now()
+	for _, override := range file.Overrides {
+		if override.expired(now) {
+			continue
+		}
+
+		log.Infof("Restoring %s override for %s %s until %s",
+			override.Kind, override.Scope, override.Target, override.ExpiresAt.Format(time.RFC3339))
+		o.overrides[override.key()] = override
+	}
+
+	return o
+}
+
+// Pause stops tailing the pods in a scope for the ttl
+func (o *Overrides) Pause(scope, target string, ttl time.Duration) (*Override, error) {
+	err := ValidScope(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	return o.add(&Override{Kind: OverridePause, Scope: scope, Target: target}, ttl)
+}
+
+// Resume removes a pause, returning false if there wasn't one
+func (o *Overrides) Resume(scope, target string) bool {
+	return o.remove(&Override{Kind: OverridePause, Scope: scope, Target: target})
+}
+
+// Limit changes the token limit for a service for the ttl
+func (o *Overrides) Limit(service string, tokens int, ttl time.Duration) (*Override, error) {
+	if tokens <= 0 {
+		return nil, fmt.Errorf("the token limit must be more than 0, not %d", tokens)
+	}
+
+	return o.add(&Override{Kind: OverrideLimit, Scope: ScopeService, Target: service, TokenLimit: tokens}, ttl)
+}
+
+// Unlimit goes back to the configured token limit for a service, returning
+// false if it wasn't changed
+func (o *Overrides) Unlimit(service string) bool {
+	return o.remove(&Override{Kind: OverrideLimit, Scope: ScopeService, Target: service})
+}
+
+func (o *Overrides) add(override *Override, ttl time.Duration) (*Override, error) {
+	if override.Target == "" {
+		return nil, fmt.Errorf("no %s given", override.Scope)
+	}
+
+	if ttl <= 0 {
+		return nil, fmt.Errorf("overrides must expire, %s isn't long enough", ttl)
+	}
+
+	override.CreatedAt = time.Now().UTC()
+	override.ExpiresAt = override.CreatedAt.Add(ttl)
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.overrides[override.key()] = override
+	o.store()
+
+	log.Infof("Added %s override for %s %s until %s",
+		override.Kind, override.Scope, override.Target, override.ExpiresAt.Format(time.RFC3339))
+
+	return override, nil
+}
+
+func (o *Overrides) remove(override *Override) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	existing, ok := o.overrides[override.key()]
+	if !ok || existing.expired(time.Now()) {
+		return false
+	}
+
+	delete(o.overrides, override.key())
+	o.store()
+
+	log.Infof("Removed %s override for %s %s", override.Kind, override.Scope, override.Target)
+
+	return true
+}
+
+// List returns the overrides that haven't expired, ordered by when they do
+func (o *Overrides) List() []Override {
+	if o == nil {
+		return nil
+	}
+
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	now := time.Now()
+	active := make([]Override, 0, len(o.overrides))
+	for _, override := range o.overrides {
+		if !override.expired(now) {
+			active = append(active, *override)
+		}
+	}
+
+	sort.Slice(active, func(i, j int) bool {
+		if !active[i].ExpiresAt.Equal(active[j].ExpiresAt) {
+			return active[i].ExpiresAt.Before(active[j].ExpiresAt)
+		}
+		return active[i].key() < active[j].key()
+	})
+
+	return active
+}
+
+// PausedFor returns the pause that applies to a pod, or nil if it isn't
+// paused
+func (o *Overrides) PausedFor(pod *Pod) *Override {
+	if o == nil {
+		return nil
+	}
+
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	now := time.Now()
+	for _, override := range o.overrides {
+		if override.Kind == OverridePause && !override.expired(now) && override.matches(pod) {
+			return override
+		}
+	}
+
+	return nil
+}
+
+// LimitFor returns the token limit for a service, if it was changed
+func (o *Overrides) LimitFor(service string) (int, bool) {
+	if o == nil {
+		return 0, false
+	}
+
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	override, ok := o.overrides[OverrideLimit+"/"+ScopeService+"/"+service]
+	if !ok || override.expired(time.Now()) {
+		return 0, false
+	}
+
+	return override.TokenLimit, true
+}
+
+// store puts the overrides in the cache, to be persisted with the offsets,
+// dropping any that have expired. Must be called with the lock held.
+func (o *Overrides) store() {
+	now := time.Now()
+
+	var file overridesFile
+	for key, override := range o.overrides {
+		if override.expired(now) {
+			delete(o.overrides, key)
+			continue
+		}
+		file.Overrides = append(file.Overrides, override)
+	}
+
+	if o.cache == nil {
+		return
+	}
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		log.Errorf("Unable to store the overrides in the cache: %s", err)
+		return
+	}
+
+	o.cache.SetMeta(overridesMeta, data)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Shimmur/logtailer/cache"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Overrides(t *testing.T) {
+	Convey("Overrides", t, func() {
+		cacheFile, err := os.CreateTemp("", "seekInfoCache*")
+		So(err, ShouldBeNil)
+		Reset(func() { os.Remove(cacheFile.Name()) })
+
+		offsets := cache.NewCache(5, cacheFile.Name())
+		overrides := NewOverrides(offsets)
+
+		web := &Pod{Name: "default_web-5d8f7c9b4-x2x9q", PodName: "web-5d8f7c9b4-x2x9q", ServiceName: "web", Namespace: "default"}
+		dns := &Pod{Name: "kube-system_coredns", ServiceName: "coredns", Namespace: "kube-system"}
+
+		Convey("pause pods by name, service or namespace", func() {
+			_ = LogCapture(func() {
+				_, err := overrides.Pause(ScopePod, "web-5d8f7c9b4-x2x9q", time.Hour)
+				So(err, ShouldBeNil)
+				So(overrides.PausedFor(web), ShouldNotBeNil)
+				So(overrides.PausedFor(dns), ShouldBeNil)
+
+				So(overrides.Resume(ScopePod, "web-5d8f7c9b4-x2x9q"), ShouldBeTrue)
+				So(overrides.PausedFor(web), ShouldBeNil)
+				So(overrides.Resume(ScopePod, "web-5d8f7c9b4-x2x9q"), ShouldBeFalse)
+
+				_, err = overrides.Pause(ScopeService, "coredns", time.Hour)
+				So(err, ShouldBeNil)
+				So(overrides.PausedFor(dns), ShouldNotBeNil)
+
+				_, err = overrides.Pause(ScopeNamespace, "default", time.Hour)
+				So(err, ShouldBeNil)
+				So(overrides.PausedFor(web), ShouldNotBeNil)
+			})
+		})
+
+		Convey("change the token limit for a service", func() {
+			_ = LogCapture(func() {
+				_, err := overrides.Limit("web", 50, time.Hour)
+				So(err, ShouldBeNil)
+			})
+
+			limit, ok := overrides.LimitFor("web")
+			So(ok, ShouldBeTrue)
+			So(limit, ShouldEqual, 50)
+
+			_, ok = overrides.LimitFor("coredns")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("reject what doesn't make sense", func() {
+			_, err := overrides.Pause("cluster", "everything", time.Hour)
+			So(err, ShouldNotBeNil)
+
+			_, err = overrides.Pause(ScopeService, "", time.Hour)
+			So(err, ShouldNotBeNil)
+
+			_, err = overrides.Pause(ScopeService, "web", 0)
+			So(err, ShouldNotBeNil)
+
+			_, err = overrides.Limit("web", 0, time.Hour)
+			So(err, ShouldNotBeNil)
+
+			So(overrides.List(), ShouldBeEmpty)
+		})
+
+		Convey("expire", func() {
+			_ = LogCapture(func() {
+				_, err := overrides.Pause(ScopeService, "web", time.Millisecond)
+				So(err, ShouldBeNil)
+				_, err = overrides.Limit("web", 50, time.Millisecond)
+				So(err, ShouldBeNil)
+			})
+			time.Sleep(2 * time.Millisecond)
+
+			So(overrides.PausedFor(web), ShouldBeNil)
+			_, ok := overrides.LimitFor("web")
+			So(ok, ShouldBeFalse)
+			So(overrides.List(), ShouldBeEmpty)
+		})
+
+		Convey("are listed in the order they expire", func() {
+			_ = LogCapture(func() {
+				_, _ = overrides.Pause(ScopeNamespace, "default", 2*time.Hour)
+				_, _ = overrides.Limit("web", 50, time.Hour)
+			})
+
+			list := overrides.List()
+			So(len(list), ShouldEqual, 2)
+			So(list[0].Kind, ShouldEqual, OverrideLimit)
+			So(list[0].TokenLimit, ShouldEqual, 50)
+			So(list[1].Kind, ShouldEqual, OverridePause)
+			So(list[1].Target, ShouldEqual, "default")
+		})
+
+		Convey("are restored from the cache until they expire", func() {
+			_ = LogCapture(func() {
+				_, _ = overrides.Pause(ScopeService, "web", time.Hour)
+				_, _ = overrides.Limit("coredns", 50, time.Millisecond)
+			})
+			time.Sleep(2 * time.Millisecond)
+			So(offsets.Persist(), ShouldBeNil)
+
+			reloaded := cache.NewCache(5, cacheFile.Name())
+			So(reloaded.Load(), ShouldBeNil)
+
+			var restored *Overrides
+			capture := LogCapture(func() { restored = NewOverrides(reloaded) })
+
+			So(capture, ShouldContainSubstring, "Restoring pause override for service web")
+			So(restored.PausedFor(web), ShouldNotBeNil)
+			_, ok := restored.LimitFor("coredns")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("start empty when the cache has none, or can't be read", func() {
+			So(NewOverrides(offsets).List(), ShouldBeEmpty)
+
+			offsets.SetMeta(overridesMeta, json.RawMessage(`"junk"`))
+			capture := LogCapture(func() { So(NewOverrides(offsets).List(), ShouldBeEmpty) })
+			So(capture, ShouldContainSubstring, "Unable to load the overrides")
+		})
+
+		Convey("are safe to look up when there aren't any", func() {
+			var none *Overrides
+			So(none.PausedFor(web), ShouldBeNil)
+			_, ok := none.LimitFor("web")
+			So(ok, ShouldBeFalse)
+			So(none.List(), ShouldBeEmpty)
+		})
+	})
+}
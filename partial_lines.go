@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// A partialAssembler joins the partial lines container runtimes write when a
+// container logs a line longer than their buffer (16KB) back into a single
+// line. There is one per log file, owned by the logPump, so it is not
+// thread-safe.
+type partialAssembler struct {
+	maxSize int      // Maximum size of a joined message, 0 for unlimited
+	first   *LogLine // The first fragment, which supplies timestamp and stream
+	buf     strings.Builder
+}
+
+func newPartialAssembler(maxSize int) *partialAssembler {
+	return &partialAssembler{maxSize: maxSize}
+}
+
+// Add takes a parsed line from a log file and returns any lines that are now
+// complete. Lines that are not partial pass straight through unless they
+// finish a line we were already assembling.
+func (p *partialAssembler) Add(line *LogLine) []*LogLine {
+	if !line.Partial && !p.Pending() {
+		return []*LogLine{line}
+	}
+
+	if !p.Pending() {
+		p.first = line
+	}
+	p.buf.WriteString(line.Text)
+
+	var complete []*LogLine
+	for p.maxSize > 0 && p.buf.Len() >= p.maxSize {
+		// Too big, ship what we have so far and keep going with the rest
+		joined := p.buf.String()
+		cut := runeBoundary(joined, p.maxSize)
+		p.buf.Reset()
+		p.buf.WriteString(joined[cut:])
+		complete = append(complete, p.assembled(joined[:cut]))
+	}
+
+	if !line.Partial {
+		complete = append(complete, p.Flush()...)
+	}
+
+	return complete
+}
+
+// Flush returns whatever is buffered as a complete line, even if we never saw
+// the end of it. Used when the flush timeout is reached.
+func (p *partialAssembler) Flush() []*LogLine {
+	if !p.Pending() {
+		return nil
+	}
+
+	msg := p.buf.String()
+	p.buf.Reset()
+
+	// We may have already shipped all of it when it hit the max size
+	var joined []*LogLine
+	if len(msg) > 0 {
+		joined = []*LogLine{p.assembled(msg)}
+	}
+	p.first = nil
+
+	return joined
+}
+
+// Pending tells us whether we are in the middle of assembling a line
+func (p *partialAssembler) Pending() bool {
+	return p.first != nil
+}
+
+// assembled returns a complete line with the details of the first fragment
+func (p *partialAssembler) assembled(msg string) *LogLine {
+	line := *p.first
+	line.Text = msg
+	line.Partial = false
+
+	return &line
+}
+
+// runeBoundary returns the last place at or before size where we can cut msg
+// without splitting a UTF-8 character in half
+func runeBoundary(msg string, size int) int {
+	for cut := size; cut > 0; cut-- {
+		if cut == len(msg) || utf8.RuneStart(msg[cut]) {
+			return cut
+		}
+	}
+
+	// Smaller than a single character, so we have to split it
+	return size
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_partialAssembler(t *testing.T) {
+	Convey("partialAssembler", t, func() {
+		partials := newPartialAssembler(0)
+		start := time.Date(2022, 12, 3, 16, 9, 51, 741778906, time.UTC)
+
+		fragment := func(text string, partial bool) *LogLine {
+			return &LogLine{
+				Text: text, Stream: "stderr", Container: "chopper",
+				Timestamp: time.Now(), Partial: partial,
+			}
+		}
+
+		Convey("passes full lines straight through", func() {
+			line := fragment("a whole line", false)
+
+			So(partials.Add(line), ShouldResemble, []*LogLine{line})
+			So(partials.Pending(), ShouldBeFalse)
+		})
+
+		Convey("joins partial lines when the final piece arrives", func() {
+			first := fragment("the beginning ", true)
+			first.Timestamp = start
+
+			So(partials.Add(first), ShouldBeEmpty)
+			So(partials.Pending(), ShouldBeTrue)
+			So(partials.Add(fragment("the middle ", true)), ShouldBeEmpty)
+
+			joined := partials.Add(fragment("the end", false))
+			So(joined, ShouldResemble, []*LogLine{{
+				Text: "the beginning the middle the end", Stream: "stderr",
+				Container: "chopper", Timestamp: start,
+			}})
+			So(partials.Pending(), ShouldBeFalse)
+		})
+
+		Convey("splits joined lines that get too big", func() {
+			partials := newPartialAssembler(10)
+
+			So(partials.Add(fragment("0123456", true)), ShouldBeEmpty)
+			joined := partials.Add(fragment("789abcdef", true))
+			So(len(joined), ShouldEqual, 1)
+			So(joined[0].Text, ShouldEqual, "0123456789")
+			So(joined[0].Partial, ShouldBeFalse)
+			So(partials.Pending(), ShouldBeTrue)
+
+			joined = partials.Add(fragment("ghij", false))
+			So(len(joined), ShouldEqual, 1)
+			So(joined[0].Text, ShouldEqual, "abcdefghij")
+			So(partials.Pending(), ShouldBeFalse)
+		})
+
+		Convey("doesn't split a multi-byte character when a line gets too big", func() {
+			partials := newPartialAssembler(10)
+
+			// Each of these is three bytes, so the fourth would straddle the limit
+			joined := partials.Add(fragment("日本語テ", true))
+			joined = append(joined, partials.Add(fragment("キスト", false))...)
+			So(len(joined), ShouldEqual, 3)
+			So(joined[0].Text, ShouldEqual, "日本語")
+			So(joined[1].Text, ShouldEqual, "テキス")
+			So(joined[2].Text, ShouldEqual, "ト")
+			for _, line := range joined {
+				So(utf8.ValidString(line.Text), ShouldBeTrue)
+			}
+		})
+
+		Convey("flushes whatever it has on demand", func() {
+			So(partials.Add(fragment("xxxxx", true)), ShouldBeEmpty)
+
+			flushed := partials.Flush()
+			So(len(flushed), ShouldEqual, 1)
+			So(flushed[0].Text, ShouldEqual, "xxxxx")
+			So(partials.Pending(), ShouldBeFalse)
+			So(partials.Flush(), ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultMetadataTTL is how long we use the pod metadata before listing
+	// the pods again
+	DefaultMetadataTTL = 30 * time.Second
+
+	// If a pod isn't in the metadata yet, it's probably new, so we list the
+	// pods again unless we only just did
+	metadataMissRefresh = 1 * time.Second
+)
+
+// A PodMetadataCache keeps the metadata for all the pods on this node, from a
+// single list call, so that the PodFilter doesn't have to ask the API about
+// each pod it sees. The K8sDiscoverer can share the list it makes on each
+// discovery pass, so that we don't list them twice.
+type PodMetadataCache struct {
+	NodeName string
+	TTL      time.Duration
+
+	client    *KubeClient
+	lock      sync.Mutex
+	pods      map[string]K8sPod // by log directory, like Pod.Name
+	fetchedAt time.Time
+	failedAt  time.Time // The last time listing the pods failed
+	failure   error
+
+	apiCalls        int64 // atomic count of lists we made
+	apiCallsAvoided int64 // atomic count of lookups that didn't need one
+}
+
+// MetadataStats shows how well the PodMetadataCache is doing
+type MetadataStats struct {
+	Pods            int
+	FetchedAt       time.Time
+	APICalls        int64
+	APICallsAvoided int64
+}
+
+func NewPodMetadataCache(client *KubeClient, nodeName string, ttl time.Duration) *PodMetadataCache {
+	if ttl <= 0 {
+		ttl = DefaultMetadataTTL
+	}
+
+	return &PodMetadataCache{
+		NodeName: nodeName,
+		TTL:      ttl,
+		client:   client,
+		pods:     make(map[string]K8sPod),
+	}
+}
+
+// Store replaces the metadata with a list of the pods on the node that was
+// fetched elsewhere. Safe to call on a nil PodMetadataCache.
+func (c *PodMetadataCache) Store(items []K8sPod) {
+	if c == nil {
+		return
+	}
+
+	pods := make(map[string]K8sPod, len(items))
+	for _, item := range items {
+		pods[item.LogDir()] = item
+	}
+
+	c.lock.Lock()
+	c.pods = pods
+	c.fetchedAt = time.Now()
+	c.lock.Unlock()
+}
+
+// Lookup returns the metadata for a pod by the name of its log directory, and
+// whether we have any
+func (c *PodMetadataCache) Lookup(podName string) (K8sPod, bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	err := c.freshen(podName)
+	if err != nil {
+		return K8sPod{}, false, err
+	}
+
+	item, ok := c.pods[podName]
+	return item, ok, nil
+}
+
+// ServicePods returns the metadata for the pods on this node that belong to
+// the same service as pod, going by the service label
+func (c *PodMetadataCache) ServicePods(pod *Pod, serviceLabel string) ([]K8sPod, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	err := c.freshen(pod.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []K8sPod
+	for _, item := range c.pods {
+		if item.Metadata.Namespace == pod.Namespace && item.Metadata.Labels[serviceLabel] == pod.ServiceName {
+			matching = append(matching, item)
+		}
+	}
+
+	return matching, nil
+}
+
+// freshen lists the pods again if what we have is too old, or doesn't include
+// the named pod. Must be called with the lock held.
+func (c *PodMetadataCache) freshen(podName string) error {
+	age := time.Since(c.fetchedAt)
+	_, known := c.pods[podName]
+
+	if age >= c.TTL || (!known && age >= metadataMissRefresh) {
+		return c.refresh()
+	}
+
+	atomic.AddInt64(&c.apiCallsAvoided, 1)
+	return nil
+}
+
+// refresh lists the pods on this node. Must be called with the lock held.
+func (c *PodMetadataCache) refresh() error {
+	atomic.AddInt64(&c.apiCalls, 1)
+
+	body, err := c.client.makeRequest(
+		"/api/v1/pods?fieldSelector=" + url.QueryEscape("spec.nodeName="+c.NodeName),
+	)
+	if err != nil {
+		return c.failed(fmt.Errorf("unable to list pods for metadata: %w", err))
+	}
+
+	var podList K8sPodList
+	err = json.Unmarshal(body, &podList)
+	if err != nil {
+		return c.failed(fmt.Errorf("unable to decode pod metadata from K8s: %w", err))
+	}
+
+	c.pods = make(map[string]K8sPod, len(podList.Items))
+	for _, item := range podList.Items {
+		c.pods[item.LogDir()] = item
+	}
+	c.fetchedAt = time.Now()
+
+	return nil
+}
+
+// failed records that listing the pods failed, for the health check. Must be
+// called with the lock held.
+func (c *PodMetadataCache) failed(err error) error {
+	c.failedAt = time.Now()
+	c.failure = err
+
+	return err
+}
+
+// Stats returns how many pods we have metadata for, and how many API calls
+// we made and avoided
+func (c *PodMetadataCache) Stats() MetadataStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return MetadataStats{
+		Pods:            len(c.pods),
+		FetchedAt:       c.fetchedAt,
+		APICalls:        atomic.LoadInt64(&c.apiCalls),
+		APICallsAvoided: atomic.LoadInt64(&c.apiCallsAvoided),
+	}
+}
+
+// A MetadataDiscoverer names the pods found by another Discoverer after their
+// service label, from the pod metadata, rather than their log directory. Pods
+// without the label keep the name they had.
+type MetadataDiscoverer struct {
+	Discoverer
+	Metadata     *PodMetadataCache
+	ServiceLabel string
+}
+
+func NewMetadataDiscoverer(disco Discoverer, metadata *PodMetadataCache, serviceLabel string) *MetadataDiscoverer {
+	return &MetadataDiscoverer{
+		Discoverer:   disco,
+		Metadata:     metadata,
+		ServiceLabel: serviceLabel,
+	}
+}
+
+// Discover returns the Pods from the wrapped Discoverer with their service
+// names from the metadata
+func (d *MetadataDiscoverer) Discover() ([]*Pod, error) {
+	pods, err := d.Discoverer.Discover()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pod := range pods {
+		item, ok, err := d.Metadata.Lookup(pod.Name)
+		if err != nil {
+			log.Warnf("Unable to get pod metadata, naming services after their directories: %s", err)
+			break
+		}
+
+		if !ok {
+			continue
+		}
+
+		if name := item.Metadata.Labels[d.ServiceLabel]; name != "" {
+			pod.ServiceName = name
+		}
+	}
+
+	return pods, nil
+}
+
+// ServeHTTP serves the Stats as JSON
+func (c *PodMetadataCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(c.Stats())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const metadataFixture = `{"items":[
+	{"metadata":{"name":"chopper-f5b66c6bf-cgslk","namespace":"default","uid":"9df92617-0407-470e-8182-a506aa7e0499",
+		"labels":{"ServiceName":"chopper"},"annotations":{"community.com/TailLogs":"true"}},
+	 "spec":{"nodeName":"beowulf"}},
+	{"metadata":{"name":"chopper-f5b66c6bf-x7k2p","namespace":"default","uid":"61e7a3bc-5b5e-4b7e-9a52-0f1e6c4b2d11",
+		"labels":{"ServiceName":"chopper"}},
+	 "spec":{"nodeName":"beowulf"}},
+	{"metadata":{"name":"chopper-6d8b9c7f4-abcde","namespace":"staging","uid":"0c1d2e3f-4a5b-6c7d-8e9f-a0b1c2d3e4f5",
+		"labels":{"ServiceName":"chopper"}},
+	 "spec":{"nodeName":"beowulf"}}
+]}`
+
+func Test_PodMetadataCache(t *testing.T) {
+	Convey("PodMetadataCache", t, func() {
+		var requests int
+		var requestedPath string
+
+		server, client := fakeKubeAPI(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			requestedPath = r.URL.String()
+			fmt.Fprint(w, metadataFixture)
+		})
+		Reset(server.Close)
+
+		metadata := NewPodMetadataCache(client, "beowulf", time.Minute)
+
+		pod := &Pod{
+			Name:        "default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499",
+			Namespace:   "default",
+			ServiceName: "chopper",
+		}
+
+		Convey("lists the pods on this node once for many lookups", func() {
+			for i := 0; i < 5; i++ {
+				pods, err := metadata.ServicePods(pod, "ServiceName")
+				So(err, ShouldBeNil)
+				So(pods, ShouldHaveLength, 2)
+			}
+
+			So(requests, ShouldEqual, 1)
+			So(requestedPath, ShouldEqual, "/api/v1/pods?fieldSelector=spec.nodeName%3Dbeowulf")
+
+			stats := metadata.Stats()
+			So(stats.Pods, ShouldEqual, 3)
+			So(stats.APICalls, ShouldEqual, 1)
+			So(stats.APICallsAvoided, ShouldEqual, 4)
+		})
+
+		Convey("lists them again when they are too old", func() {
+			metadata.TTL = time.Nanosecond
+
+			_, err := metadata.ServicePods(pod, "ServiceName")
+			So(err, ShouldBeNil)
+			_, err = metadata.ServicePods(pod, "ServiceName")
+			So(err, ShouldBeNil)
+
+			So(requests, ShouldEqual, 2)
+		})
+
+		Convey("doesn't list them again straight away for a pod it doesn't know", func() {
+			_, err := metadata.ServicePods(pod, "ServiceName")
+			So(err, ShouldBeNil)
+
+			pods, err := metadata.ServicePods(&Pod{Name: "default_new-pod_1234", Namespace: "default", ServiceName: "new-pod"}, "ServiceName")
+			So(err, ShouldBeNil)
+			So(pods, ShouldBeEmpty)
+			So(requests, ShouldEqual, 1)
+		})
+
+		Convey("uses pods stored from elsewhere", func() {
+			var podList K8sPodList
+			So(json.Unmarshal([]byte(metadataFixture), &podList), ShouldBeNil)
+
+			metadata.Store(podList.Items)
+
+			pods, err := metadata.ServicePods(pod, "ServiceName")
+			So(err, ShouldBeNil)
+			So(pods, ShouldHaveLength, 2)
+			So(requests, ShouldEqual, 0)
+		})
+
+		Convey("finds mirror pods by the directory the kubelet logs them in", func() {
+			var podList K8sPodList
+			So(json.Unmarshal([]byte(`{"items":[
+				{"metadata":{"name":"etcd-beowulf","namespace":"kube-system","uid":"5b1a5d6e-3c0c-4d0f-9a38-2f4c8e0f9d11",
+					"annotations":{"kubernetes.io/config.mirror":"8d5e4a9a1b6b3c2f0e7d9c8b7a6f5e4d"}},
+				 "spec":{"nodeName":"beowulf"}}
+			]}`), &podList), ShouldBeNil)
+
+			metadata.Store(podList.Items)
+
+			item, ok, err := metadata.Lookup("kube-system_etcd-beowulf_8d5e4a9a1b6b3c2f0e7d9c8b7a6f5e4d")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(item.Metadata.Name, ShouldEqual, "etcd-beowulf")
+			So(requests, ShouldEqual, 0)
+		})
+
+		Convey("errors when the API does", func() {
+			server.Close()
+
+			_, err := metadata.ServicePods(pod, "ServiceName")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("serves its stats", func() {
+			_, _ = metadata.ServicePods(pod, "ServiceName")
+
+			recorder := httptest.NewRecorder()
+			metadata.ServeHTTP(recorder, httptest.NewRequest("GET", "/metadata", nil))
+
+			var stats MetadataStats
+			So(json.Unmarshal(recorder.Body.Bytes(), &stats), ShouldBeNil)
+			So(stats.APICalls, ShouldEqual, 1)
+		})
+
+		Convey("names services after their label for a MetadataDiscoverer", func() {
+			dirs := newMockDisco()
+			dirs.Pods = []*Pod{
+				{Name: "default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499", ServiceName: "chopper-f5b66c6bf"},
+				{Name: "default_unknown_1234", ServiceName: "unknown"},
+			}
+
+			disco := NewMetadataDiscoverer(dirs, metadata, "ServiceName")
+			pods, err := disco.Discover()
+			So(err, ShouldBeNil)
+			So(pods[0].ServiceName, ShouldEqual, "chopper")
+			So(pods[1].ServiceName, ShouldEqual, "unknown")
+
+			Convey("and keeps the directory names when the API fails", func() {
+				dirs.Pods[0].ServiceName = "chopper-f5b66c6bf"
+				metadata.TTL = time.Nanosecond
+				server.Close()
+
+				capture := LogCapture(func() {
+					pods, err = disco.Discover()
+				})
+				So(err, ShouldBeNil)
+				So(pods[0].ServiceName, ShouldEqual, "chopper-f5b66c6bf")
+				So(capture, ShouldContainSubstring, "naming services after their directories")
+			})
+		})
+
+		Convey("is used by the PodFilter", func() {
+			filter := &PodFilter{KubeClient: client, Metadata: metadata, Keys: DefaultFilterKeys}
+
+			shouldTail, err := filter.ShouldTailLogs(pod)
+			So(err, ShouldBeNil)
+			So(shouldTail, ShouldBeTrue)
+
+			shouldTail, err = filter.ShouldTailLogs(&Pod{Name: "staging_chopper", Namespace: "staging", ServiceName: "chopper"})
+			So(err, ShouldBeNil)
+			So(shouldTail, ShouldBeFalse)
+
+			So(requests, ShouldEqual, 1)
+		})
+	})
+}
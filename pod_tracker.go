@@ -4,7 +4,10 @@ import (
 	"encoding/json"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/Shimmur/logtailer/cache"
 	director "github.com/relistan/go-director"
 	log "github.com/sirupsen/logrus"
 )
@@ -18,12 +21,43 @@ type NewTailerFunc func(pod *Pod) LogTailer
 type PodTracker struct {
 	LogTails map[string]LogTailer
 	Filter   DiscoveryFilter
+	// Rules are checked before the Filter, nil allows everything
+	Rules *DiscoveryRules
+
+	// DrainGrace is how long we keep reading the logs of a pod that has gone
+	// away before we stop tailing them
+	DrainGrace time.Duration
+	// RecheckInterval is how often we ask the Filter again about pods we
+	// already know, in case their annotations changed. 0 never rechecks.
+	RecheckInterval time.Duration
+	// FailurePolicy decides what to do with new pods when the Filter fails.
+	// We ask again after RetryBackoff, doubling up to MaxRetryBackoff.
+	FailurePolicy   string
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	// MaxTrackedLogs is how many log files we tail at once, 0 is unlimited.
+	// Pods that don't fit wait, and are tailed in order of Priority.
+	MaxTrackedLogs int
+	Priority       *TailPriority
+	// Overrides can pause tailing pods at runtime, nil for none
+	Overrides *Overrides
 
 	disco         Discoverer
 	looper        director.Looper
 	newTailerFunc NewTailerFunc
+	decisions     map[string]*filterDecision // Only touched while syncing
+	lastKnown     map[string]bool            // By service, only touched while syncing
+	shuttingDown  bool                       // Only touched while syncing
 
 	tailsLock sync.RWMutex
+	syncLock  sync.Mutex // Only one discovery pass at a time
+
+	// For the health checks
+	createdAt   time.Time
+	syncedAt    int64 // atomic, in Unix nanoseconds
+	persistLock sync.Mutex
+	persistedAt time.Time
+	persistErr  error
 }
 
 // NewPodTracker configures a PodTracker for use, assigning the given Looper
@@ -37,121 +71,455 @@ func NewPodTracker(looper director.Looper, disco Discoverer,
 		disco:         disco,
 		newTailerFunc: newTailerFunc,
 		Filter:        filter,
+		decisions:     make(map[string]*filterDecision, 5),
+		lastKnown:     make(map[string]bool, 5),
+
+		FailurePolicy:   FailClosed,
+		RetryBackoff:    DefaultFilterRetryBackoff,
+		MaxRetryBackoff: DefaultFilterMaxRetryBackoff,
+
+		createdAt: time.Now(),
 	}
 }
 
 // Run invokes the looper to poll discovery and then add or remove Pods from
-// tracking. The work of the actual file tailing is done by the Tailers.
+// tracking. The work of the actual file tailing is done by the Tailers. If
+// the Discoverer can notify us of changes, we also run discovery as soon as
+// they happen, and the looper becomes a periodic reconciliation.
 func (t *PodTracker) Run() {
-	t.looper.Loop(func() error {
-		discovered, err := t.disco.Discover()
-		if err != nil {
-			log.Error(err.Error())
-			return err
-		}
+	if notifier, ok := t.disco.(NotifyingDiscoverer); ok {
+		go t.followChanges(notifier.Changes())
+	}
 
-		newTails := make(map[string]LogTailer, len(t.LogTails))
-
-		for _, pod := range discovered {
-			// Handle existing/known pods
-			var wasKnown bool
-			t.withLock(func() {
-				tailer, ok := t.LogTails[pod.Name]
-
-				if ok {
-					wasKnown = true // Can't continue from in here
-
-					// Copy it over because we still see this pod
-					newTails[pod.Name] = tailer
-
-					// Find all the new files for the pod
-					logFiles, err := t.disco.LogFiles(pod.Name)
-					if err != nil {
-						log.Warnf("Failed to get logs for pod %s: %s", pod.Name, err)
-						return
-					}
-
-					// Update the followed files
-					err = tailer.TailLogs(logFiles)
-					if err != nil {
-						log.Errorf("Failed to tail logs for %s: %s", pod.Name, err)
-						return
-					}
-					// State for debugging
-					pod.Logs = logFiles
-				}
-			})
+	t.looper.Loop(t.syncPods)
+}
 
-			if wasKnown {
-				continue
-			}
+// followChanges runs discovery each time we're notified of a change. Exits
+// when the channel is closed.
+func (t *PodTracker) followChanges(changes <-chan struct{}) {
+	for range changes {
+		// Errors are already logged, and we'll retry on the next change or tick
+		_ = t.syncPods()
+	}
+}
 
-			// Handle newly discovered pods
-			log.Infof("new pod --> %s:%s  [%s]", pod.Namespace, pod.ServiceName, pod.Name)
+// syncPods runs discovery and then adds or removes Pods from tracking
+func (t *PodTracker) syncPods() error {
+	t.syncLock.Lock()
+	defer t.syncLock.Unlock()
 
-			shouldTail, err := t.Filter.ShouldTailLogs(pod)
-			if err != nil {
-				log.Errorf(
-					"Failed to check filter for pod %s, disabling logging: %s", err, pod.Name,
-				)
-				continue
-			}
+	if t.shuttingDown {
+		return nil
+	}
 
-			var tailer LogTailer
+	start := time.Now()
+	defer func() {
+		metrics.DiscoveryDuration.Since(start)
+		atomic.StoreInt64(&t.syncedAt, time.Now().UnixNano())
+	}()
 
-			if shouldTail {
-				// Find the files and actually tail them
-				logFiles, err := t.disco.LogFiles(pod.Name)
+	discovered, err := t.disco.Discover()
+	if err != nil {
+		log.Error(err.Error())
+		metrics.DiscoveryErrors.Inc()
+		return err
+	}
+
+	newTails := make(map[string]LogTailer, len(t.LogTails))
+
+	for _, pod := range discovered {
+		// The annotations on pods we know about may have changed
+		t.recheckPod(pod)
+
+		// Handle existing/known pods
+		var wasKnown bool
+		t.withLock(func() {
+			tailer, ok := t.LogTails[pod.Name]
+
+			if ok {
+				wasKnown = true // Can't continue from in here
+
+				// Copy it over because we still see this pod
+				newTails[pod.Name] = tailer
+
+				// Find all the new files for the pod
+				logFiles, err := t.logFilesFor(pod)
 				if err != nil {
 					log.Warnf("Failed to get logs for pod %s: %s", pod.Name, err)
-					continue
+					return
 				}
 
-				pod.Logs = logFiles
-
-				tailer = t.newTailerFunc(pod)
+				// They count against MaxTrackedLogs
+				if decision, ok := t.decisions[pod.Name]; ok && decision.tailing && !decision.waiting {
+					decision.files = len(logFiles)
+				}
 
+				// Update the followed files
 				err = tailer.TailLogs(logFiles)
 				if err != nil {
-					log.Warnf("Failed to tail logs for pod %s: %s", pod.Name, err)
-					continue
+					log.Errorf("Failed to tail logs for %s: %s", pod.Name, err)
+					return
 				}
-			} else {
-				// We want to keep state on these, so we just use a mock instead
-				log.Infof("Skipping pod %s because filter says to", pod.Name)
-				tailer = &MockTailer{PodTailed: pod}
+				// State for debugging
+				pod.Logs = logFiles
 			}
+		})
+
+		if wasKnown {
+			continue
+		}
+
+		// Handle newly discovered pods
+		log.Infof("new pod --> %s:%s  [%s]", pod.Namespace, pod.ServiceName, pod.Name)
 
-			if _, ok := tailer.(*MockTailer); !ok {
-				log.Infof("Adding and running new tailer for pod %s", pod.Name)
+		decision := &filterDecision{pod: pod}
+
+		shouldTail, reason, err := t.shouldTail(pod)
+		if err != nil {
+			shouldTail, reason = t.decideOnFailure(pod, decision, err)
+			log.Errorf("Failed to check filter for pod %s, retrying in %s: %s",
+				pod.Name, time.Until(decision.retryAt).Round(time.Second), err,
+			)
+		} else {
+			decision.succeeded()
+			t.lastKnown[serviceKey(pod)] = shouldTail
+		}
+
+		decision.tailing = shouldTail
+		t.decisions[pod.Name] = decision
+		pod.Filter = decision.state(t.RecheckInterval)
+
+		var tailer LogTailer
+
+		if shouldTail {
+			if reason != "" {
+				log.Infof("Tailing pod %s: %s", pod.Name, reason)
+				pod.TailReason = reason
 			}
 
-			newTails[pod.Name] = tailer
+			decision.containers, err = t.containerPolicyFor(pod)
+			if err != nil {
+				log.Warnf("Failed to get container annotations for pod %s, tailing all of them: %s", pod.Name, err)
+			}
 
-			// Will exit when the looper is stopped, when Stop() is called on the Tailer
+			// Started by fillSlots, once we've seen all the pods
+			tailer = t.queue(pod, decision, false)
+		} else {
+			// We want to keep state on these, so we just use a mock instead
+			log.Infof("Skipping pod %s: %s", pod.Name, reason)
+			tailer = &MockTailer{PodTailed: pod, SkipReason: reason}
 			tailer.Run()
 		}
 
-		// Swap the new list with the old list
-		var oldTails map[string]LogTailer
-		t.withLock(func() {
-			oldTails = t.LogTails
-			t.LogTails = newTails
-		})
+		newTails[pod.Name] = tailer
+	}
 
-		// Iterate over the old list to remove pods no longer present
-		t.withReadLock(func() {
-			for podName, tailer := range oldTails {
-				if _, ok := t.LogTails[podName]; !ok {
-					// Do some pod dropping
-					log.Infof("drop pod: %s", podName)
-					tailer.Stop()
-				}
+	// Swap the new list with the old list
+	var oldTails map[string]LogTailer
+	t.withLock(func() {
+		oldTails = t.LogTails
+		t.LogTails = newTails
+	})
+
+	// Iterate over the old list to remove pods no longer present
+	t.withReadLock(func() {
+		for podName, tailer := range oldTails {
+			if _, ok := t.LogTails[podName]; !ok {
+				// Do some pod dropping
+				log.Infof("drop pod: %s", podName)
+				delete(t.decisions, podName)
+				go t.retire(tailer)
 			}
-		})
+		}
+	})
 
-		return nil
+	// Stop tailing the pods that were paused, and start tailing the waiting
+	// pods that now fit
+	t.pausePods()
+	t.fillSlots()
+
+	return nil
+}
+
+// startTailer starts tailing a pod's logs. If fromEnd is set, we only ship
+// what is written from now on, rather than everything already in the logs.
+func (t *PodTracker) startTailer(pod *Pod, logFiles []string, fromEnd bool) (LogTailer, error) {
+	pod.Logs = logFiles
+
+	tailer := t.newTailerFunc(pod)
+	if fromEnd {
+		tailer.StartAtEnd()
+	}
+
+	err := tailer.TailLogs(logFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Adding and running new tailer for pod %s", pod.Name)
+
+	// Will exit when the looper is stopped, when Stop() is called on the Tailer
+	tailer.Run()
+
+	return tailer, nil
+}
+
+// recheckPod asks the rules and Filter again about a pod we already know, at
+// most every RecheckInterval, in case its annotations have changed, or sooner
+// if the Filter failed last time. If it should now be tailed, its tailer
+// starts from the end of the logs, so we don't ship everything it wrote while
+// we weren't tailing it, unless it was only skipped because the Filter
+// failed. If it should no longer be tailed, we stop straight away. Changes to
+// which containers are tailed are picked up on the next sync.
+func (t *PodTracker) recheckPod(pod *Pod) {
+	decision, ok := t.decisions[pod.Name]
+	if !ok || !decision.due(t.RecheckInterval) {
+		return
+	}
+
+	shouldTail, reason, err := t.shouldTail(pod)
+	if err != nil {
+		// Whatever the policy, we don't change our mind about known pods
+		decision.failed(err, t.RetryBackoff, t.MaxRetryBackoff)
+		t.publish(decision)
+		log.Warnf("Failed to recheck filter for pod %s, leaving it as it is and retrying in %s: %s",
+			pod.Name, time.Until(decision.retryAt).Round(time.Second), err,
+		)
+		return
+	}
+
+	fromEnd := decision.byPolicy == ""
+	decision.succeeded()
+	t.lastKnown[serviceKey(pod)] = shouldTail
+
+	if shouldTail {
+		policy, err := t.containerPolicyFor(pod)
+		if err != nil {
+			log.Warnf("Failed to recheck container annotations for pod %s, leaving them as they are: %s", pod.Name, err)
+		} else {
+			decision.containers = policy
+		}
+	}
+
+	if shouldTail == decision.tailing {
+		t.publish(decision)
+		return
+	}
+
+	var replacement LogTailer
+	if shouldTail {
+		if fromEnd {
+			log.Infof("Pod %s should now be tailed, starting from the end of its logs", pod.Name)
+		} else {
+			log.Infof("Pod %s should now be tailed", pod.Name)
+		}
+		pod.TailReason = reason
+
+		// Started by fillSlots, at the end of this discovery pass
+		decision.tailing = true
+		replacement = t.queue(pod, decision, fromEnd)
+	} else {
+		log.Infof("Pod %s should no longer be tailed: %s", pod.Name, reason)
+
+		decision.tailing = false
+		decision.waiting = false
+
+		replacement = &MockTailer{PodTailed: pod, SkipReason: reason}
+		replacement.Run()
+	}
+	decision.pod = pod
+	pod.Filter = decision.state(t.RecheckInterval)
+
+	t.replaceTailer(pod.Name, replacement)
+}
+
+// replaceTailer swaps in a new tailer for a pod, and stops the old one
+func (t *PodTracker) replaceTailer(podName string, replacement LogTailer) {
+	var previous LogTailer
+	t.withLock(func() {
+		previous = t.LogTails[podName]
+		t.LogTails[podName] = replacement
+	})
+
+	// Keep the offsets, should it be tailed again after a restart
+	if previous != nil {
+		previous.FlushOffsets()
+		go previous.Stop()
+	}
+}
+
+// shouldTail decides whether to tail a newly discovered pod. The rules are
+// checked first, and only then the Filter, which may be expensive. Host logs
+// were asked for specifically, so neither applies to them. The reason for the
+// decision is returned, when there is one.
+func (t *PodTracker) shouldTail(pod *Pod) (bool, string, error) {
+	if pod.HostLog {
+		return true, "", nil
+	}
+
+	if excluded, reason := t.Rules.ExcludePod(pod); excluded {
+		return false, reason, nil
+	}
+
+	start := time.Now()
+	shouldTail, reason, err := checkFilter(t.Filter, pod)
+	metrics.FilterDuration.Since(start)
+
+	switch {
+	case err != nil:
+		metrics.FilterResults.Inc("error")
+	case shouldTail:
+		metrics.FilterResults.Inc("tail")
+	default:
+		metrics.FilterResults.Inc("skip")
+	}
+
+	return shouldTail, reason, err
+}
+
+// containerPolicyFor asks the Filter which of a pod's containers to tail, if
+// it can tell us. Host logs only have the one.
+func (t *PodTracker) containerPolicyFor(pod *Pod) (*ContainerPolicy, error) {
+	filter, ok := t.Filter.(ContainerFilter)
+	if !ok || pod.HostLog {
+		return nil, nil
+	}
+
+	return filter.ContainerPolicy(pod)
+}
+
+// logFilesFor returns the logs to tail for a pod, leaving out the containers
+// that the rules exclude or that its annotations turn off. Which containers
+// were excluded, and why, is kept on the Pod for the state server.
+func (t *PodTracker) logFilesFor(pod *Pod) ([]string, error) {
+	logFiles, err := t.disco.LogFiles(pod.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if pod.HostLog {
+		return logFiles, nil
+	}
+
+	var policy *ContainerPolicy
+	if decision, ok := t.decisions[pod.Name]; ok {
+		policy = decision.containers
+	}
+
+	var included []string
+	for _, filename := range logFiles {
+		container := containerNameFor(filename)
+
+		excluded, reason := t.Rules.ExcludeContainer(container)
+		if !excluded {
+			var allowed bool
+			allowed, reason = policy.Allows(container)
+			excluded = !allowed
+		}
+
+		if excluded {
+			if pod.ExcludedContainers == nil {
+				pod.ExcludedContainers = make(map[string]string)
+			}
+			pod.ExcludedContainers[container] = reason
+			continue
+		}
+
+		included = append(included, filename)
+	}
+
+	return included, nil
+}
+
+// retire drains whatever is left in the logs of a pod that has gone away and
+// then stops its tailer. Runs in the background so that discovery carries on.
+func (t *PodTracker) retire(tailer LogTailer) {
+	tailer.Drain(t.DrainGrace)
+	tailer.Stop()
+}
+
+// ShutdownSummary says how a Shutdown went
+type ShutdownSummary struct {
+	Tailers   int
+	Delivered int64 // Lines delivered while shutting down
+	Abandoned int64 // Lines read but never delivered
+	Duration  time.Duration
+}
+
+// Shutdown stops all the tailers in an orderly way when we are exiting. No
+// more discovery passes are run. The tailers stop reading their logs and
+// deliver what they have already read to their outputs, until the timeout,
+// and then their offsets are flushed to the cache and it is persisted, so
+// that we carry on from there after a restart.
+func (t *PodTracker) Shutdown(timeout time.Duration, offsets *cache.Cache) ShutdownSummary {
+	// Waits for any discovery pass in progress
+	t.syncLock.Lock()
+	defer t.syncLock.Unlock()
+	t.shuttingDown = true
+
+	start := time.Now()
+	deadline := start.Add(timeout)
+
+	tailers := make(map[string]LogTailer)
+	t.withReadLock(func() {
+		for podName, tailer := range t.LogTails {
+			tailers[podName] = tailer
+		}
 	})
+
+	log.Infof("Shutting down %d tailers, waiting up to %s for their logs to be delivered", len(tailers), timeout)
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	summary := ShutdownSummary{Tailers: len(tailers)}
+	for podName, tailer := range tailers {
+		wg.Add(1)
+		go func(podName string, tailer LogTailer) {
+			defer wg.Done()
+
+			delivered, abandoned := tailer.Shutdown(deadline)
+			if abandoned > 0 {
+				log.Warnf("Abandoned %d lines for pod %s", abandoned, podName)
+			}
+
+			lock.Lock()
+			summary.Delivered += delivered
+			summary.Abandoned += abandoned
+			lock.Unlock()
+		}(podName, tailer)
+	}
+	wg.Wait()
+
+	t.PersistOffsets(offsets)
+
+	summary.Duration = time.Since(start)
+	log.Infof("Shut down %d tailers in %s: delivered %d lines, abandoned %d lines",
+		summary.Tailers, summary.Duration.Round(time.Millisecond), summary.Delivered, summary.Abandoned,
+	)
+
+	return summary
+}
+
+// PersistOffsets flushes the offsets from all the tailers to the cache and
+// writes it out, remembering how that went for the health checks. Safe to
+// call with a nil cache, which only flushes the offsets.
+func (t *PodTracker) PersistOffsets(offsets *cache.Cache) {
+	t.FlushOffsets()
+
+	if offsets == nil {
+		return
+	}
+
+	err := offsets.Persist()
+	if err != nil {
+		log.Errorf("Persisting offsets failed: %s", err)
+		metrics.CachePersistFailures.Inc()
+	}
+
+	t.persistLock.Lock()
+	t.persistedAt = time.Now()
+	t.persistErr = err
+	t.persistLock.Unlock()
 }
 
 func (t *PodTracker) FlushOffsets() {
@@ -174,27 +542,86 @@ func (t *PodTracker) withLock(fn func()) {
 	t.tailsLock.Unlock()
 }
 
-func (t *PodTracker) ServeHTTP() {
-	go func() {
-		// Set up the route and handler.
-		http.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) {
-			t.tailsLock.RLock()
-			defer t.tailsLock.RUnlock()
+// RegisterHandlers adds the endpoints for looking into what we are tailing to
+// the state server
+func (t *PodTracker) RegisterHandlers(server *HTTPServer) {
+	server.HandleFunc("/state", t.serveState)
+	server.HandleFunc("/metrics", t.serveMetrics)
+	server.Handle("/tail", liveTail)
+}
 
-			// Set the Content-Type header.
-			w.Header().Set("Content-Type", "application/json")
+// serveState serves the LogTails as JSON, with the stats for each pod and its
+// logs. They can be narrowed down to a namespace or a service with the query
+// parameters of the same names.
+func (t *PodTracker) serveState(w http.ResponseWriter, r *http.Request) {
+	namespace := r.URL.Query().Get("namespace")
+	service := r.URL.Query().Get("service")
 
-			err := json.NewEncoder(w).Encode(t.LogTails)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+	t.tailsLock.RLock()
+	defer t.tailsLock.RUnlock()
+
+	tails := t.LogTails
+	if namespace != "" || service != "" {
+		tails = make(map[string]LogTailer)
+		for podName, tailer := range t.LogTails {
+			pod := tailedPod(tailer)
+			if pod == nil {
+				continue
 			}
-		})
 
-		// Start the server.
-		log.Println("State server starting on :8080...")
-		err := http.ListenAndServe(":8080", nil)
-		if err != nil {
-			log.Error(err.Error())
+			if namespace != "" && pod.Namespace != namespace {
+				continue
+			}
+
+			if service != "" && pod.ServiceName != service {
+				continue
+			}
+
+			tails[podName] = tailer
 		}
-	}()
+	}
+
+	// Set the Content-Type header.
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(tails)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// tailedPod returns the Pod a LogTailer is for, if we can tell
+func tailedPod(tailer LogTailer) *Pod {
+	switch tailer := tailer.(type) {
+	case *Tailer:
+		return tailer.Pod
+	case *MockTailer:
+		return tailer.PodTailed
+	}
+
+	return nil
+}
+
+// serveMetrics serves the Metrics, and how much we are tailing, in the
+// Prometheus text format
+func (t *PodTracker) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var pods, files int64
+	t.withReadLock(func() {
+		for _, tailer := range t.LogTails {
+			tailer, ok := tailer.(*Tailer)
+			if !ok {
+				continue
+			}
+
+			pods++
+			files += int64(len(tailer.liveLogs()))
+		}
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	metrics.Write(w)
+	writeGauge(w, "logtailer_tracked_pods", "Pods we are tailing.", pods)
+	writeGauge(w, "logtailer_tracked_files", "Log files we are tailing.", files)
+	writeGauge(w, "logtailer_log_pumps", "Active logPump goroutines.", GetActiveGoroutineCount())
 }
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
 
 	"github.com/Shimmur/logtailer/cache"
 	"github.com/Shimmur/logtailer/reporter"
+	"github.com/nxadm/tail"
 	director "github.com/relistan/go-director"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -44,7 +48,7 @@ func Test_Run(t *testing.T) {
 
 		rptr := reporter.NewLimitExceededReporter("", "", "")
 
-		tracker := NewPodTracker(looper, disco, NewTailerWithUDPSyslog(cache, "beowulf", config, rptr), &mockFilter{})
+		tracker := NewPodTracker(looper, disco, NewTailerWithUDPSyslog(cache, "beowulf", config, rptr, nil, nil), &mockFilter{})
 
 		Convey("tails the logs for a newly discovered pod", func() {
 			So(len(tracker.LogTails), ShouldEqual, 0)
@@ -100,6 +104,107 @@ func Test_Run(t *testing.T) {
 			So(ok, ShouldBeTrue)
 		})
 
+		Convey("skips pods excluded by the rules without asking the filter", func() {
+			rules, err := NewDiscoveryRules(nil, []string{"service=chopper"})
+			So(err, ShouldBeNil)
+			tracker.Rules = rules
+			tracker.Filter = &erroringFilter{}
+
+			capture := LogCapture(func() {
+				disco.Pods = []*Pod{
+					&Pod{Name: "default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499", ServiceName: "chopper"},
+				}
+
+				go tracker.Run()
+				err := looper.Wait()
+				So(err, ShouldBeNil)
+			})
+
+			So(capture, ShouldContainSubstring, "Skipping pod default_chopper-f5b66c6bf")
+			So(capture, ShouldNotContainSubstring, "Failed to check filter")
+
+			mock, ok := tracker.LogTails["default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499"].(*MockTailer)
+			So(ok, ShouldBeTrue)
+			So(mock.SkipReason, ShouldEqual, "excluded by rule service=chopper")
+		})
+
+		Convey("doesn't tail containers excluded by the rules", func() {
+			rules, err := NewDiscoveryRules(nil, []string{"container=vault-init"})
+			So(err, ShouldBeNil)
+			tracker.Rules = rules
+
+			pod := &Pod{Name: "default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499"}
+			capture := LogCapture(func() {
+				disco.Pods = []*Pod{pod}
+				disco.Logs = []string{
+					fixturesDir + "/default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499/chopper/0.log",
+					fixturesDir + "/default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499/vault-init/0.log",
+				}
+
+				go tracker.Run()
+				err := looper.Wait()
+				So(err, ShouldBeNil)
+			})
+
+			So(capture, ShouldContainSubstring, "Adding tail on fixtures/pods/default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499/chopper/0.log")
+			So(capture, ShouldNotContainSubstring, "vault-init/0.log")
+			So(pod.Logs, ShouldHaveLength, 1)
+			So(pod.ExcludedContainers["vault-init"], ShouldEqual, "excluded by rule container=vault-init")
+		})
+
+		Convey("doesn't tail containers turned off by their annotations", func() {
+			tracker.Filter = &mockFilter{
+				Policies: map[string]*ContainerPolicy{
+					"default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499": NewContainerPolicy(map[string]string{
+						"community.com/TailLogs.vault-init": "false",
+					}, DefaultFilterKeys),
+				},
+			}
+
+			pod := &Pod{Name: "default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499"}
+			capture := LogCapture(func() {
+				disco.Pods = []*Pod{pod}
+				disco.Logs = []string{
+					fixturesDir + "/default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499/chopper/0.log",
+					fixturesDir + "/default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499/vault-init/0.log",
+				}
+
+				go tracker.Run()
+				err := looper.Wait()
+				So(err, ShouldBeNil)
+			})
+
+			So(capture, ShouldContainSubstring, "Adding tail on fixtures/pods/default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499/chopper/0.log")
+			So(capture, ShouldNotContainSubstring, "vault-init/0.log")
+			So(pod.Logs, ShouldHaveLength, 1)
+			So(pod.ExcludedContainers["vault-init"], ShouldEqual, "turned off by annotation community.com/TailLogs.vault-init")
+		})
+
+		Convey("always tails host logs, whatever the filter says", func() {
+			tracker.Filter = &mockFilter{
+				ShouldNotTailFor: map[string]bool{"host_kubelet_kubelet": true},
+			}
+
+			capture := LogCapture(func() {
+				disco.Pods = []*Pod{
+					&Pod{Name: "host_kubelet_kubelet", ServiceName: "kubelet", Container: "kubelet", HostLog: true},
+				}
+				disco.Logs = []string{
+					fixturesDir + "/default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499/chopper/0.log",
+				}
+
+				go tracker.Run()
+				err := looper.Wait()
+				So(err, ShouldBeNil)
+			})
+
+			So(capture, ShouldNotContainSubstring, "Skipping pod host_kubelet_kubelet")
+			So(capture, ShouldContainSubstring, "Adding tail on fixtures/pods/default_chopper-f5b66c6bf")
+
+			_, ok := tracker.LogTails["host_kubelet_kubelet"].(*Tailer)
+			So(ok, ShouldBeTrue)
+		})
+
 		Convey("continues to track a pod that was already seen", func() {
 			_ = LogCapture(func() {
 				disco.Pods = []*Pod{
@@ -162,6 +267,32 @@ func Test_Run(t *testing.T) {
 			So(ok, ShouldBeFalse)
 		})
 
+		Convey("drains and then stops the tailer for a pod that is no longer present", func() {
+			tailer := &MockTailer{}
+			tracker := NewPodTracker(looper, disco, NewMockTailerFunc(tailer), &mockFilter{})
+			disco.Pods = []*Pod{
+				&Pod{Name: "default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499"},
+			}
+
+			_ = LogCapture(func() {
+				go tracker.Run()
+				err := looper.Wait()
+				So(err, ShouldBeNil)
+			})
+
+			disco.Pods = []*Pod{}
+
+			_ = LogCapture(func() {
+				go tracker.Run()
+				err := looper.Wait()
+				So(err, ShouldBeNil)
+			})
+
+			// This happens in the background
+			So(waitFor(time.Second, func() bool { return tailer.WasCalled(&tailer.StopWasCalled) }), ShouldBeTrue)
+			So(tailer.WasCalled(&tailer.DrainWasCalled), ShouldBeTrue)
+		})
+
 		Convey("handles errors from Discover()", func() {
 			capture := LogCapture(func() {
 				disco.DiscoverShouldError = true
@@ -202,10 +333,263 @@ func Test_Run(t *testing.T) {
 				So(err, ShouldBeNil)
 			})
 
-			// Janky but have to wait for the first run
-			time.Sleep(10 * time.Millisecond)
+			So(waitFor(time.Second, func() bool { return tailer.WasCalled(&tailer.RunWasCalled) }), ShouldBeTrue)
+		})
+
+		Convey("records why the filter accepted or rejected a pod", func() {
+			filter, err := ParseFilter("namespace=default", nil)
+			So(err, ShouldBeNil)
+
+			tracker := NewPodTracker(looper, disco, NewMockTailerFunc(&MockTailer{}), filter)
+			accepted := &Pod{Name: "default_chopper", Namespace: "default"}
+			rejected := &Pod{Name: "kube-system_coredns", Namespace: "kube-system"}
+			disco.Pods = []*Pod{accepted, rejected}
+
+			capture := LogCapture(func() {
+				go tracker.Run()
+				So(looper.Wait(), ShouldBeNil)
+			})
 
-			So(tailer.RunWasCalled, ShouldBeTrue)
+			So(capture, ShouldContainSubstring, "Tailing pod default_chopper: namespace default is allowed")
+			So(accepted.TailReason, ShouldEqual, "namespace default is allowed")
+			So(tracker.LogTails["kube-system_coredns"].(*MockTailer).SkipReason, ShouldEqual, "namespace kube-system is not allowed")
+		})
+
+		Convey("when rechecking the filter for known pods", func() {
+			podName := "default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499"
+			tailer := &MockTailer{}
+			filter := &mockFilter{}
+			tracker := NewPodTracker(looper, disco, NewMockTailerFunc(tailer), filter)
+			tracker.RecheckInterval = time.Nanosecond
+			disco.Pods = []*Pod{&Pod{Name: podName}}
+
+			// Sync directly, so that the second one doesn't depend on the looper
+			syncTwice := func(between func()) string {
+				return LogCapture(func() {
+					So(tracker.syncPods(), ShouldBeNil)
+
+					between()
+
+					So(tracker.syncPods(), ShouldBeNil)
+				})
+			}
+
+			Convey("starts tailing a skipped pod from the end of its logs", func() {
+				filter.ShouldNotTailFor = map[string]bool{podName: true}
+
+				capture := syncTwice(func() {
+					So(tailer.WasCalled(&tailer.RunWasCalled), ShouldBeFalse)
+					filter.ShouldNotTailFor = nil
+				})
+
+				So(capture, ShouldContainSubstring, "should now be tailed")
+				So(tracker.LogTails[podName], ShouldEqual, tailer)
+				So(tailer.WasCalled(&tailer.StartAtEndWasCalled), ShouldBeTrue)
+				So(tailer.WasCalled(&tailer.RunWasCalled), ShouldBeTrue)
+			})
+
+			Convey("stops tailing a pod the filter no longer allows", func() {
+				capture := syncTwice(func() {
+					So(tailer.WasCalled(&tailer.RunWasCalled), ShouldBeTrue)
+					filter.ShouldNotTailFor = map[string]bool{podName: true}
+				})
+
+				So(capture, ShouldContainSubstring, "should no longer be tailed")
+				So(tailer.WasCalled(&tailer.FlushOffsetsWasCalled), ShouldBeTrue)
+
+				// The old tailer is stopped in the background
+				So(waitFor(time.Second, func() bool { return tailer.WasCalled(&tailer.StopWasCalled) }), ShouldBeTrue)
+
+				skipped, ok := tracker.LogTails[podName].(*MockTailer)
+				So(ok, ShouldBeTrue)
+				So(skipped, ShouldNotEqual, tailer)
+				So(skipped.SkipReason, ShouldEqual, "filtered out by the pod filter")
+			})
+
+			Convey("leaves the pod alone if the filter fails", func() {
+				capture := syncTwice(func() {
+					tracker.Filter = &erroringFilter{}
+				})
+
+				So(capture, ShouldContainSubstring, "leaving it as it is")
+				So(tracker.LogTails[podName], ShouldEqual, tailer)
+				So(tailer.WasCalled(&tailer.StopWasCalled), ShouldBeFalse)
+			})
+
+			Convey("doesn't recheck when it is disabled", func() {
+				tracker.RecheckInterval = 0
+
+				syncTwice(func() {
+					filter.ShouldNotTailFor = map[string]bool{podName: true}
+				})
+
+				So(tracker.LogTails[podName], ShouldEqual, tailer)
+				So(tailer.WasCalled(&tailer.StopWasCalled), ShouldBeFalse)
+			})
+		})
+
+		Convey("when the filter fails for new pods", func() {
+			podName := "default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499"
+			tailer := &MockTailer{}
+			tracker := NewPodTracker(looper, disco, NewMockTailerFunc(tailer), &erroringFilter{})
+			pod := &Pod{Name: podName, Namespace: "default", ServiceName: "chopper"}
+			disco.Pods = []*Pod{pod}
+
+			// Sync directly, so that each one doesn't depend on the looper
+			sync := func() string {
+				return LogCapture(func() {
+					So(tracker.syncPods(), ShouldBeNil)
+				})
+			}
+
+			Convey("fails closed by default, and says so in the state", func() {
+				capture := sync()
+
+				So(capture, ShouldContainSubstring, "Failed to check filter for pod "+podName+", retrying in 5s")
+				skipped, ok := tracker.LogTails[podName].(*MockTailer)
+				So(ok, ShouldBeTrue)
+				So(skipped.SkipReason, ShouldEqual, "filter failed, failing closed: intentional test error")
+
+				So(pod.Filter.Tailing, ShouldBeFalse)
+				So(pod.Filter.Failures, ShouldEqual, 1)
+				So(pod.Filter.Policy, ShouldEqual, FailClosed)
+				So(pod.Filter.LastError, ShouldEqual, "intentional test error")
+			})
+
+			Convey("tails the pod when failing open", func() {
+				tracker.FailurePolicy = FailOpen
+				sync()
+
+				So(tracker.LogTails[podName], ShouldEqual, tailer)
+				So(pod.TailReason, ShouldEqual, "filter failed, failing open: intentional test error")
+				So(pod.Filter.Tailing, ShouldBeTrue)
+			})
+
+			Convey("does what it last did for the service", func() {
+				tracker.FailurePolicy = FailLastKnown
+				tracker.lastKnown["default/chopper"] = true
+				sync()
+
+				So(tracker.LogTails[podName], ShouldEqual, tailer)
+				So(pod.Filter.Policy, ShouldEqual, FailLastKnown)
+
+				Convey("and fails closed when there isn't one", func() {
+					other := &Pod{Name: "default_other", Namespace: "default", ServiceName: "other"}
+					disco.Pods = []*Pod{pod, other}
+					sync()
+
+					_, ok := tracker.LogTails["default_other"].(*MockTailer)
+					So(ok, ShouldBeTrue)
+					So(other.Filter.Policy, ShouldEqual, FailClosed)
+				})
+			})
+
+			Convey("retries after the backoff, tailing from the start of the logs", func() {
+				tracker.RetryBackoff = time.Nanosecond
+				sync()
+				So(tailer.WasCalled(&tailer.RunWasCalled), ShouldBeFalse)
+
+				tracker.Filter = &mockFilter{}
+				capture := sync()
+
+				So(capture, ShouldContainSubstring, "Pod "+podName+" should now be tailed")
+				So(tracker.LogTails[podName], ShouldEqual, tailer)
+				So(tailer.WasCalled(&tailer.RunWasCalled), ShouldBeTrue)
+				So(tailer.WasCalled(&tailer.StartAtEndWasCalled), ShouldBeFalse)
+				So(pod.Filter.Failures, ShouldEqual, 0)
+				So(pod.Filter.Policy, ShouldBeEmpty)
+			})
+
+			Convey("doesn't retry before the backoff is up", func() {
+				sync()
+				tracker.Filter = &mockFilter{}
+				sync()
+
+				_, ok := tracker.LogTails[podName].(*MockTailer)
+				So(ok, ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func Test_filterDecision(t *testing.T) {
+	Convey("filterDecision", t, func() {
+		decision := &filterDecision{}
+		err := errors.New("intentional test error")
+
+		Convey("doubles the backoff on each failure, up to the max", func() {
+			var waits []time.Duration
+			for i := 0; i < 5; i++ {
+				decision.failed(err, time.Second, 5*time.Second)
+				waits = append(waits, decision.retryAt.Sub(decision.checkedAt))
+			}
+
+			So(waits, ShouldResemble, []time.Duration{
+				time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second,
+			})
+		})
+
+		Convey("starts again after a success", func() {
+			decision.failed(err, time.Second, time.Minute)
+			decision.failed(err, time.Second, time.Minute)
+			decision.succeeded()
+			decision.failed(err, time.Second, time.Minute)
+
+			So(decision.failures, ShouldEqual, 1)
+			So(decision.retryAt.Sub(decision.checkedAt), ShouldEqual, time.Second)
+		})
+	})
+
+	Convey("ValidFailurePolicy()", t, func() {
+		for _, policy := range []string{FailOpen, FailClosed, FailLastKnown} {
+			So(ValidFailurePolicy(policy), ShouldBeNil)
+		}
+		So(ValidFailurePolicy("sideways"), ShouldNotBeNil)
+	})
+}
+
+func Test_RunWithNotifications(t *testing.T) {
+	Convey("Run() with a NotifyingDiscoverer", t, func() {
+		looper := director.NewFreeLooper(director.ONCE, make(chan error))
+		disco := newMockNotifyingDisco()
+		Reset(func() { close(disco.changes) })
+
+		tracker := NewPodTracker(looper, disco, NewMockTailerFunc(&MockTailer{}), &mockFilter{})
+
+		Convey("runs discovery when notified of a change", func() {
+			_ = LogCapture(func() {
+				go tracker.Run()
+				err := looper.Wait()
+				So(err, ShouldBeNil)
+			})
+			So(len(tracker.LogTails), ShouldEqual, 0)
+
+			disco.Pods = []*Pod{
+				&Pod{Name: "default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499"},
+			}
+
+			capture := LogCapture(func() {
+				// The looper is done, so only a notification will find the pod
+				disco.changes <- struct{}{}
+
+				timeout := time.After(time.Second)
+				for {
+					select {
+					case <-timeout:
+						So("we should have discovered the pod", ShouldBeEmpty)
+					default: // keep going
+					}
+					time.Sleep(1 * time.Millisecond)
+
+					var found bool
+					tracker.withReadLock(func() { found = len(tracker.LogTails) == 1 })
+					if found {
+						break
+					}
+				}
+			})
+
+			So(capture, ShouldContainSubstring, "new pod --> ")
 		})
 	})
 }
@@ -236,3 +620,101 @@ func Test_FlushOffsets(t *testing.T) {
 		})
 	})
 }
+
+func Test_Shutdown(t *testing.T) {
+	Convey("Shutdown()", t, func() {
+		looper := director.NewFreeLooper(director.ONCE, make(chan error))
+		disco := newMockDisco()
+		disco.Pods = []*Pod{&Pod{Name: "default_chopper"}}
+
+		cacheFile, err := os.CreateTemp("", "seekInfoCache*")
+		So(err, ShouldBeNil)
+		Reset(func() { os.Remove(cacheFile.Name()) })
+		offsets := cache.NewCache(5, cacheFile.Name())
+		offsets.Add("chopper/0.log", &tail.SeekInfo{Offset: 1234})
+
+		mockTailer1 := &MockTailer{}
+		mockTailer2 := &MockTailer{}
+
+		tracker := NewPodTracker(looper, disco, NewMockTailerFunc(&MockTailer{}), &mockFilter{})
+		tracker.LogTails = map[string]LogTailer{"pod1": mockTailer1, "pod2": mockTailer2}
+
+		var summary ShutdownSummary
+		capture := LogCapture(func() {
+			summary = tracker.Shutdown(time.Second, offsets)
+		})
+
+		Convey("shuts down and flushes all the tailers", func() {
+			So(mockTailer1.ShutdownWasCalled, ShouldBeTrue)
+			So(mockTailer2.ShutdownWasCalled, ShouldBeTrue)
+			So(mockTailer1.FlushOffsetsWasCalled, ShouldBeTrue)
+			So(mockTailer2.FlushOffsetsWasCalled, ShouldBeTrue)
+			So(mockTailer1.StopWasCalled, ShouldBeFalse)
+		})
+
+		Convey("persists the offsets", func() {
+			data, err := os.ReadFile(cacheFile.Name())
+			So(err, ShouldBeNil)
+			So(string(data), ShouldContainSubstring, "chopper/0.log")
+		})
+
+		Convey("logs a summary", func() {
+			So(summary.Tailers, ShouldEqual, 2)
+			So(capture, ShouldContainSubstring, "Shut down 2 tailers")
+			So(capture, ShouldContainSubstring, "delivered 0 lines, abandoned 0 lines")
+		})
+
+		Convey("doesn't run discovery afterward", func() {
+			_ = LogCapture(func() {
+				go tracker.Run()
+				So(looper.Wait(), ShouldBeNil)
+			})
+
+			So(tracker.LogTails, ShouldNotContainKey, "default_chopper")
+		})
+	})
+}
+
+func Test_serveState(t *testing.T) {
+	Convey("The /state endpoint", t, func() {
+		looper := director.NewFreeLooper(director.ONCE, make(chan error))
+		tracker := NewPodTracker(looper, newMockDisco(), NewMockTailerFunc(&MockTailer{}), &mockFilter{})
+		tracker.LogTails = map[string]LogTailer{
+			"default_chopper": &MockTailer{PodTailed: &Pod{Namespace: "default", ServiceName: "chopper"}},
+			"default_envoy":   &MockTailer{PodTailed: &Pod{Namespace: "default", ServiceName: "envoy"}},
+			"batch_chopper":   &MockTailer{PodTailed: &Pod{Namespace: "batch", ServiceName: "chopper"}},
+		}
+
+		stateFor := func(query string) map[string]json.RawMessage {
+			recorder := httptest.NewRecorder()
+			tracker.serveState(recorder, httptest.NewRequest("GET", "/state"+query, nil))
+			So(recorder.Code, ShouldEqual, 200)
+
+			var state map[string]json.RawMessage
+			So(json.Unmarshal(recorder.Body.Bytes(), &state), ShouldBeNil)
+			return state
+		}
+
+		Convey("serves all the pods", func() {
+			So(len(stateFor("")), ShouldEqual, 3)
+		})
+
+		Convey("filters by namespace", func() {
+			state := stateFor("?namespace=default")
+			So(len(state), ShouldEqual, 2)
+			So(state, ShouldNotContainKey, "batch_chopper")
+		})
+
+		Convey("filters by service", func() {
+			state := stateFor("?service=chopper")
+			So(len(state), ShouldEqual, 2)
+			So(state, ShouldNotContainKey, "default_envoy")
+		})
+
+		Convey("filters by both", func() {
+			state := stateFor("?namespace=batch&service=chopper")
+			So(len(state), ShouldEqual, 1)
+			So(state, ShouldContainKey, "batch_chopper")
+		})
+	})
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nxadm/tail"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Each time a container starts it gets a new log: 0.log, 1.log, ...
+	restartLogRegexp = regexp.MustCompile(`^([0-9]+)\.log$`)
+
+	// The kubelet rotates logs by renaming them with a timestamp suffix,
+	// e.g. 0.log.20221203-160951, and later gzips the older ones
+	rotatedSuffixRegexp = regexp.MustCompile(`^[0-9]{8}-[0-9]{6}(\.gz)?$`)
+
+	// Host logs are rotated by other tools, which add a number or a date,
+	// e.g. audit.log.1, audit.log-20221203 or audit-2022-12-03T16-09-51.000.log
+	hostRotatedSuffixRegexp = regexp.MustCompile(`^[.-][0-9]`)
+)
+
+// shippedLocation is what we record in the cache for a log we have read all
+// of and which will not grow any more: a rotated log, or the log from before
+// a container restarted.
+var shippedLocation = tail.SeekInfo{Offset: 0, Whence: io.SeekEnd}
+
+// isShipped returns true if a cached location is for a log we've finished
+func isShipped(location *tail.SeekInfo) bool {
+	return location != nil && location.Whence == io.SeekEnd
+}
+
+// A logSegment is a log file that we read to the end before moving on to the
+// next one for the container
+type logSegment struct {
+	filename string         // As it is on disk, maybe gzipped
+	key      string         // For the cache, always the uncompressed name
+	location *tail.SeekInfo // Where to start, nil for the beginning
+	last     bool           // The end of a container's log, not a rotation
+}
+
+// restartCount returns which restart of the container a log is for, or -1
+// if it doesn't look like one of the kubelet's logs
+func restartCount(filename string) int {
+	matches := restartLogRegexp.FindStringSubmatch(filepath.Base(filename))
+	if len(matches) < 2 {
+		return -1
+	}
+
+	count, err := strconv.Atoi(matches[1])
+	if err != nil {
+		return -1
+	}
+
+	return count
+}
+
+// logsByContainer groups log files by the container they belong to, with each
+// group ordered by restart count so that the live log comes last. Logs that
+// aren't the kubelet's, e.g. host logs, are each on their own.
+func logsByContainer(logFiles []string) [][]string {
+	groups := make(map[string][]string, len(logFiles))
+	for _, filename := range logFiles {
+		group := logGroup(filename)
+		groups[group] = append(groups[group], filename)
+	}
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ordered := make([][]string, 0, len(groups))
+	for _, name := range names {
+		files := groups[name]
+		sort.SliceStable(files, func(i, j int) bool {
+			return restartCount(files[i]) < restartCount(files[j])
+		})
+		ordered = append(ordered, files)
+	}
+
+	return ordered
+}
+
+// logGroup returns what a log is grouped by: the container's log directory
+// for the kubelet's logs, or the file itself for anything else
+func logGroup(filename string) string {
+	if restartCount(filename) >= 0 {
+		return filepath.Dir(filename)
+	}
+
+	return filename
+}
+
+// rotatedLogsFor returns the rotated copies of a log that are still on disk,
+// oldest first. If a copy is there both plain and gzipped, because we caught
+// the kubelet in the middle of compressing it, the plain one is returned.
+func rotatedLogsFor(filename string) []string {
+	candidates, err := filepath.Glob(filename + ".*")
+	if err != nil {
+		return nil
+	}
+
+	byKey := make(map[string]string, len(candidates))
+	for _, candidate := range candidates {
+		suffix := strings.TrimPrefix(candidate, filename+".")
+		if !rotatedSuffixRegexp.MatchString(suffix) {
+			continue
+		}
+
+		key := strings.TrimSuffix(candidate, ".gz")
+		if existing, ok := byKey[key]; ok && existing == key {
+			continue
+		}
+		byKey[key] = candidate
+	}
+
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	// The timestamps sort in time order
+	sort.Strings(keys)
+
+	rotated := make([]string, 0, len(keys))
+	for _, key := range keys {
+		rotated = append(rotated, byKey[key])
+	}
+
+	return rotated
+}
+
+// isRotatedCopy returns true if a file is named like a rotated copy of a
+// host log, either with something added to the end of the name or before the
+// extension
+func isRotatedCopy(filename string, live string) bool {
+	if filename == live {
+		return false
+	}
+
+	for _, prefix := range []string{live, strings.TrimSuffix(live, filepath.Ext(live))} {
+		suffix, ok := strings.CutPrefix(filename, prefix)
+		if ok && hostRotatedSuffixRegexp.MatchString(suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hostRotatedLogsFor returns the rotated copies of a host log that are in
+// the same directory
+func hostRotatedLogsFor(filename string) []string {
+	entries, err := os.ReadDir(filepath.Dir(filename))
+	if err != nil {
+		return nil
+	}
+
+	var rotated []string
+	for _, entry := range entries {
+		candidate := filepath.Join(filepath.Dir(filename), entry.Name())
+		if isRotatedCopy(candidate, filename) {
+			rotated = append(rotated, candidate)
+		}
+	}
+
+	return rotated
+}
+
+// findRotated returns the rotated copy of a log that is the same file we
+// were tailing, or an empty string if it has gone.
+func findRotated(filename string, info os.FileInfo) string {
+	if info == nil {
+		return ""
+	}
+
+	candidates := rotatedLogsFor(filename)
+	if restartCount(filename) < 0 {
+		candidates = append(candidates, hostRotatedLogsFor(filename)...)
+	}
+
+	for _, rotated := range candidates {
+		rotatedInfo, err := os.Stat(rotated)
+		if err == nil && os.SameFile(info, rotatedInfo) {
+			return rotated
+		}
+	}
+
+	return ""
+}
+
+// offsetFor returns the last location we have for a log, preferring our own
+// over what is in the main cache
+func (t *Tailer) offsetFor(key string) *tail.SeekInfo {
+	t.lock.RLock()
+	seekInfo, ok := t.localCache[key]
+	t.lock.RUnlock()
+
+	if ok {
+		return seekInfo
+	}
+
+	return t.cache.Get(key)
+}
+
+// rotationSet works out which of the rotated copies of a log still need
+// reading, and from where, followed by where to start on the log itself. If
+// the log was rotated while we weren't running, the offset we had for it
+// belongs to the first rotated copy that we haven't seen before.
+func (t *Tailer) rotationSet(filename string) ([]logSegment, *tail.SeekInfo) {
+	location := t.offsetFor(filename)
+	if isShipped(location) {
+		return nil, location
+	}
+
+	var segments []logSegment
+	var rotatedUnseen bool
+
+	for _, rotated := range rotatedLogsFor(filename) {
+		key := strings.TrimSuffix(rotated, ".gz")
+
+		seen := t.offsetFor(key)
+		if isShipped(seen) {
+			continue
+		}
+
+		if seen == nil {
+			seen = location
+			location = nil
+			rotatedUnseen = true
+		}
+
+		segments = append(segments, logSegment{filename: rotated, key: key, location: seen})
+	}
+
+	if rotatedUnseen {
+		return segments, nil
+	}
+
+	// Truncated, or rotated and replaced by a bigger file. We can't tell
+	// which, but either way our offset is no use.
+	if location != nil {
+		if info, err := os.Stat(filename); err == nil && location.Offset > info.Size() {
+			log.Warnf("Offset for %s is past the end of the file, starting from the top", filename)
+			location = nil
+		}
+	}
+
+	return segments, location
+}
+
+// openLogSegment opens a log for reading, decompressing it if needed
+func openLogSegment(filename string) (io.ReadCloser, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasSuffix(filename, ".gz") {
+		return file, nil
+	}
+
+	gzipped, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("unable to decompress %s: %w", filename, err)
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{gzipped, file}, nil
+}
+
+// readSegment reads a log file that isn't growing any more from its location
+// to the end, sending the lines on, and then records it as shipped. The lines
+// are counted in stats. Returns false if we are shutting down.
+func (t *Tailer) readSegment(segment logSegment, stats *fileStats, decoder *logDecoder) bool {
+	if isShipped(segment.location) {
+		return true
+	}
+
+	reader, err := openLogSegment(segment.filename)
+	if err != nil {
+		// Probably cleaned up by the kubelet, nothing we can do about it
+		log.Warnf("Unable to catch up on %s: %s", segment.filename, err)
+		return true
+	}
+	defer reader.Close()
+
+	var offset int64
+	if segment.location != nil {
+		offset = segment.location.Offset
+	}
+
+	// Gzip streams can't seek, so we read up to where we were
+	_, err = io.CopyN(io.Discard, reader, offset)
+	if err != nil {
+		log.Warnf("Unable to skip to offset %d in %s: %s", offset, segment.filename, err)
+		return true
+	}
+
+	log.Infof("  Catching up on %s for pod %s from offset %d", segment.filename, t.Pod.Name, offset)
+
+	buffered := bufio.NewReader(reader)
+	for {
+		// We carry on from the last offset after a restart
+		if t.isStoppingReading() {
+			return false
+		}
+
+		raw, err := buffered.ReadString('\n')
+		if raw != "" {
+			offset += int64(len(raw))
+			stats.read(len(raw))
+
+			for _, line := range decoder.Decode(strings.TrimSuffix(raw, "\n")) {
+				if !t.sendLine(stats, segment.filename, line) {
+					return false
+				}
+			}
+
+			if !decoder.Pending() {
+				t.localCacheAdd(segment.key, &tail.SeekInfo{Offset: offset, Whence: io.SeekStart})
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			log.Warnf("Error catching up on %s: %s", segment.filename, err)
+			break
+		}
+	}
+
+	// A partial line can carry on into the next rotated file, but not past
+	// a container restart
+	if segment.last {
+		for _, line := range decoder.Flush() {
+			if !t.sendLine(stats, segment.filename, line) {
+				return false
+			}
+		}
+	}
+
+	shipped := shippedLocation
+	t.localCacheAdd(segment.key, &shipped)
+
+	return true
+}
+
+// forgetRotated removes the offsets for rotated copies of a log that the
+// kubelet has since cleaned up, so the cache doesn't grow forever
+func (t *Tailer) forgetRotated(filename string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for key := range t.localCache {
+		if !strings.HasPrefix(key, filename+".") && !isRotatedCopy(key, filename) {
+			continue
+		}
+
+		if _, err := os.Stat(key); err == nil {
+			continue
+		}
+		if _, err := os.Stat(key + ".gz"); err == nil {
+			continue
+		}
+
+		delete(t.localCache, key)
+		t.cache.Del(key)
+	}
+}
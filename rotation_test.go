@@ -0,0 +1,277 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shimmur/logtailer/cache"
+	"github.com/nxadm/tail"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// writeLog writes CRI formatted lines to a log file, gzipping it if the name
+// ends in .gz
+func writeLog(filename string, messages ...string) {
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	So(err, ShouldBeNil)
+	defer file.Close()
+
+	var writer io.Writer = file
+	if filepath.Ext(filename) == ".gz" {
+		gzipped := gzip.NewWriter(file)
+		defer gzipped.Close()
+		writer = gzipped
+	}
+
+	for _, message := range messages {
+		_, err := io.WriteString(writer, "2022-12-03T16:09:51.741778906Z stdout F "+message+"\n")
+		So(err, ShouldBeNil)
+	}
+}
+
+// waitForLines waits a short while for the output to have logged n lines and
+// returns the messages in the order they were logged
+func waitForLines(output *mockLogOutput, n int) []string {
+	timeout := time.After(2 * time.Second)
+	for {
+		output.Lock()
+		count := len(output.Logged)
+		output.Unlock()
+
+		if count >= n {
+			break
+		}
+
+		select {
+		case <-timeout:
+			return messagesFrom(output)
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+
+	return messagesFrom(output)
+}
+
+func messagesFrom(output *mockLogOutput) []string {
+	output.Lock()
+	defer output.Unlock()
+
+	var messages []string
+	for _, line := range output.Logged {
+		messages = append(messages, line.Text)
+	}
+
+	return messages
+}
+
+func Test_logsByContainer(t *testing.T) {
+	Convey("logsByContainer()", t, func() {
+		Convey("groups logs by container, in restart order", func() {
+			groups := logsByContainer([]string{
+				"pod/chopper/10.log", "pod/chopper/2.log", "pod/logproxy/0.log", "pod/chopper/1.log",
+			})
+
+			So(groups, ShouldResemble, [][]string{
+				{"pod/chopper/1.log", "pod/chopper/2.log", "pod/chopper/10.log"},
+				{"pod/logproxy/0.log"},
+			})
+		})
+	})
+}
+
+func Test_rotatedLogsFor(t *testing.T) {
+	Convey("rotatedLogsFor()", t, func() {
+		dir, err := os.MkdirTemp("", "rotation")
+		So(err, ShouldBeNil)
+		Reset(func() { os.RemoveAll(dir) })
+
+		live := filepath.Join(dir, "0.log")
+		for _, name := range []string{
+			"0.log", "0.log.20221203-170000", "0.log.20221203-160951.gz",
+			"0.log.20221203-180000", "0.log.20221203-180000.gz", "0.log.20221203-190000.gz.tmp",
+			"1.log",
+		} {
+			So(os.WriteFile(filepath.Join(dir, name), []byte{}, 0644), ShouldBeNil)
+		}
+
+		Convey("returns the rotated logs, oldest first", func() {
+			So(rotatedLogsFor(live), ShouldResemble, []string{
+				live + ".20221203-160951.gz",
+				live + ".20221203-170000",
+				live + ".20221203-180000",
+			})
+		})
+
+		Convey("finds the rotated copy of a file", func() {
+			info, err := os.Stat(live + ".20221203-170000")
+			So(err, ShouldBeNil)
+
+			So(findRotated(live, info), ShouldEqual, live+".20221203-170000")
+		})
+	})
+
+	Convey("isRotatedCopy()", t, func() {
+		live := "/var/log/kube-apiserver-audit.log"
+
+		Convey("spots copies made by logrotate and lumberjack", func() {
+			So(isRotatedCopy(live+".1", live), ShouldBeTrue)
+			So(isRotatedCopy(live+".2.gz", live), ShouldBeTrue)
+			So(isRotatedCopy(live+"-20221203", live), ShouldBeTrue)
+			So(isRotatedCopy("/var/log/kube-apiserver-audit-2022-12-03T16-09-51.000.log", live), ShouldBeTrue)
+		})
+
+		Convey("leaves other logs alone", func() {
+			So(isRotatedCopy(live, live), ShouldBeFalse)
+			So(isRotatedCopy("/var/log/kube-apiserver-audit-other.log", live), ShouldBeFalse)
+			So(isRotatedCopy("/var/log/kube-apiserver.log", live), ShouldBeFalse)
+		})
+	})
+}
+
+func Test_TailRotatedLogs(t *testing.T) {
+	Convey("Tailing rotated and restarted logs", t, func() {
+		dir, err := os.MkdirTemp("", "rotation")
+		So(err, ShouldBeNil)
+
+		containerDir := filepath.Join(dir, "chopper")
+		So(os.Mkdir(containerDir, 0755), ShouldBeNil)
+
+		live := filepath.Join(containerDir, "0.log")
+		oldest := live + ".20221203-160951.gz"
+		older := live + ".20221203-170000"
+
+		offsets := cache.NewCache(5, filepath.Join(dir, "cache.json"))
+		logOutput := &mockLogOutput{}
+		tailer := NewTailer(&Pod{Name: "venerable bede"}, offsets, logOutput)
+
+		Reset(func() {
+			_ = LogCapture(tailer.Stop)
+			os.RemoveAll(dir)
+		})
+
+		start := func(logFiles ...string) {
+			_ = LogCapture(func() {
+				So(tailer.TailLogs(logFiles), ShouldBeNil)
+				tailer.Run()
+			})
+		}
+
+		Convey("reads the rotated logs, including gzipped ones, before the live one", func() {
+			writeLog(oldest, "one", "two")
+			writeLog(older, "three")
+			writeLog(live, "four")
+
+			start(live)
+
+			So(waitForLines(logOutput, 4), ShouldResemble, []string{"one", "two", "three", "four"})
+			So(tailer.offsetFor(oldest[:len(oldest)-3]), ShouldResemble, &shippedLocation)
+			So(tailer.offsetFor(older), ShouldResemble, &shippedLocation)
+		})
+
+		Convey("skips everything already written when starting at the end", func() {
+			writeLog(older, "one")
+			writeLog(live, "two", "three")
+			offsets.Add(live, &tail.SeekInfo{Offset: 0, Whence: io.SeekStart})
+
+			tailer.StartAtEnd()
+			start(live)
+			writeLog(live, "four")
+
+			So(waitForLines(logOutput, 1), ShouldResemble, []string{"four"})
+			So(tailer.offsetFor(older), ShouldBeNil)
+		})
+
+		Convey("doesn't replay rotated logs we already shipped", func() {
+			writeLog(oldest, "one", "two")
+			writeLog(older, "three", "four")
+			writeLog(live, "five")
+
+			firstLine := int64(len("2022-12-03T16:09:51.741778906Z stdout F three\n"))
+			offsets.Add(oldest[:len(oldest)-3], &shippedLocation)
+			offsets.Add(older, &tail.SeekInfo{Offset: firstLine, Whence: io.SeekStart})
+
+			start(live)
+
+			So(waitForLines(logOutput, 2), ShouldResemble, []string{"four", "five"})
+		})
+
+		Convey("picks up from where it was in a log rotated while we were away", func() {
+			writeLog(older, "one", "two")
+			writeLog(live, "three")
+
+			firstLine := int64(len("2022-12-03T16:09:51.741778906Z stdout F one\n"))
+			offsets.Add(live, &tail.SeekInfo{Offset: firstLine, Whence: io.SeekStart})
+
+			start(live)
+
+			So(waitForLines(logOutput, 2), ShouldResemble, []string{"two", "three"})
+		})
+
+		Convey("finishes a log rotated while we're tailing it before moving on", func() {
+			writeLog(live, "one")
+			start(live)
+			So(waitForLines(logOutput, 1), ShouldResemble, []string{"one"})
+
+			// Written and rotated before we get a chance to read it
+			writeLog(live, "two")
+			So(os.Rename(live, older), ShouldBeNil)
+			writeLog(live, "three")
+
+			So(waitForLines(logOutput, 3), ShouldResemble, []string{"one", "two", "three"})
+			So(tailer.offsetFor(older), ShouldResemble, &shippedLocation)
+		})
+
+		Convey("finishes a host log rotated to a new name before moving on", func() {
+			hostLog := filepath.Join(dir, "audit.log")
+			rotated := filepath.Join(dir, "audit-2022-12-03T17-00-00.000.log")
+
+			writeLog(hostLog, "one")
+			start(hostLog)
+			So(waitForLines(logOutput, 1), ShouldResemble, []string{"one"})
+
+			writeLog(hostLog, "two")
+			So(os.Rename(hostLog, rotated), ShouldBeNil)
+			writeLog(hostLog, "three")
+
+			So(waitForLines(logOutput, 3), ShouldResemble, []string{"one", "two", "three"})
+			So(tailer.offsetFor(rotated), ShouldResemble, &shippedLocation)
+		})
+
+		Convey("finishes the log from before a restart before following the new one", func() {
+			restarted := filepath.Join(containerDir, "1.log")
+
+			writeLog(live, "one")
+			start(live)
+			So(waitForLines(logOutput, 1), ShouldResemble, []string{"one"})
+
+			writeLog(restarted, "three")
+			writeLog(live, "two")
+
+			_ = LogCapture(func() {
+				So(tailer.TailLogs([]string{live, restarted}), ShouldBeNil)
+			})
+
+			So(waitForLines(logOutput, 3), ShouldResemble, []string{"one", "two", "three"})
+
+			// Give the old log a moment to be retired
+			time.Sleep(2 * drainCheckInterval)
+			So(tailer.liveLogs(), ShouldResemble, []string{restarted})
+			So(tailer.offsetFor(live), ShouldResemble, &shippedLocation)
+		})
+
+		Convey("reads the log from before a restart first when starting up", func() {
+			restarted := filepath.Join(containerDir, "1.log")
+			writeLog(live, "one", "two")
+			writeLog(restarted, "three")
+
+			start(live, restarted)
+
+			So(waitForLines(logOutput, 3), ShouldResemble, []string{"one", "two", "three"})
+			So(tailer.liveLogs(), ShouldResemble, []string{restarted})
+		})
+	})
+}
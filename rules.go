@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The things about a pod that rules can match on
+const (
+	ruleNamespace = "namespace"
+	ruleService   = "service"
+	ruleContainer = "container"
+)
+
+// We never tail our own logs: anything we log about them would be tailed in turn
+const selfExclusionRule = ruleService + "=logtailer"
+
+// A DiscoveryRule matches a namespace, service name or container name, either
+// exactly or with a regex. Rules are written as <field>=<value> for an exact
+// match or <field>=~<regex> for a regex match, e.g. container=vault-init or
+// namespace=~^kube-.
+type DiscoveryRule struct {
+	Field  string
+	Value  string
+	Regexp *regexp.Regexp // Only set for regex rules
+}
+
+// ParseDiscoveryRules parses a list of rules from their configuration
+func ParseDiscoveryRules(specs []string) ([]*DiscoveryRule, error) {
+	var rules []*DiscoveryRule
+	for _, spec := range specs {
+		field, value, ok := strings.Cut(strings.TrimSpace(spec), "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("rule should be <field>=<value> or <field>=~<regex>, got %q", spec)
+		}
+
+		switch field {
+		case ruleNamespace, ruleService, ruleContainer:
+		default:
+			return nil, fmt.Errorf("unknown field %q in rule %q, expected namespace, service or container", field, spec)
+		}
+
+		rule := &DiscoveryRule{Field: field, Value: value}
+
+		if pattern, isRegex := strings.CutPrefix(value, "~"); isRegex {
+			compiled, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("bad regex in rule %q: %w", spec, err)
+			}
+			rule.Regexp = compiled
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// Matches returns true if the value matches the rule
+func (r *DiscoveryRule) Matches(value string) bool {
+	if r.Regexp != nil {
+		return r.Regexp.MatchString(value)
+	}
+
+	return r.Value == value
+}
+
+func (r *DiscoveryRule) String() string {
+	return r.Field + "=" + r.Value
+}
+
+// DiscoveryRules decide which pods and containers we look at, before any
+// DiscoveryFilter is consulted. Exclude rules always win. If there are any
+// include rules for a field, the value must match one of them.
+type DiscoveryRules struct {
+	Include []*DiscoveryRule
+	Exclude []*DiscoveryRule
+}
+
+// NewDiscoveryRules parses the include and exclude rules from their
+// configuration
+func NewDiscoveryRules(include []string, exclude []string) (*DiscoveryRules, error) {
+	includeRules, err := ParseDiscoveryRules(include)
+	if err != nil {
+		return nil, err
+	}
+
+	excludeRules, err := ParseDiscoveryRules(exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DiscoveryRules{Include: includeRules, Exclude: excludeRules}, nil
+}
+
+// WithSelfExclusion adds the rule excluding logtailer itself to the configured
+// exclude rules, unless they already have it
+func WithSelfExclusion(exclude []string) []string {
+	for _, spec := range exclude {
+		if strings.TrimSpace(spec) == selfExclusionRule {
+			return exclude
+		}
+	}
+
+	return append(exclude, selfExclusionRule)
+}
+
+// ExcludePod checks the namespace and service name of a pod against the
+// rules, and returns the reason when it is excluded
+func (r *DiscoveryRules) ExcludePod(pod *Pod) (bool, string) {
+	if excluded, reason := r.check(ruleNamespace, pod.Namespace); excluded {
+		return true, reason
+	}
+
+	return r.check(ruleService, pod.ServiceName)
+}
+
+// ExcludeContainer checks a container name against the rules, and returns the
+// reason when it is excluded
+func (r *DiscoveryRules) ExcludeContainer(container string) (bool, string) {
+	return r.check(ruleContainer, container)
+}
+
+func (r *DiscoveryRules) check(field string, value string) (bool, string) {
+	// No rules, everything goes
+	if r == nil {
+		return false, ""
+	}
+
+	for _, rule := range r.Exclude {
+		if rule.Field == field && rule.Matches(value) {
+			return true, "excluded by rule " + rule.String()
+		}
+	}
+
+	var hasIncludes bool
+	for _, rule := range r.Include {
+		if rule.Field != field {
+			continue
+		}
+
+		hasIncludes = true
+		if rule.Matches(value) {
+			return false, ""
+		}
+	}
+
+	if hasIncludes {
+		return true, "not included by any " + field + " rule"
+	}
+
+	return false, ""
+}
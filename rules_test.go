@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ParseDiscoveryRules(t *testing.T) {
+	Convey("ParseDiscoveryRules()", t, func() {
+		Convey("parses exact and regex rules", func() {
+			rules, err := ParseDiscoveryRules([]string{"container=vault-init", "namespace=~^kube-"})
+			So(err, ShouldBeNil)
+			So(len(rules), ShouldEqual, 2)
+
+			So(rules[0].Field, ShouldEqual, "container")
+			So(rules[0].Regexp, ShouldBeNil)
+			So(rules[0].Matches("vault-init"), ShouldBeTrue)
+			So(rules[0].Matches("vault-init-2"), ShouldBeFalse)
+
+			So(rules[1].Field, ShouldEqual, "namespace")
+			So(rules[1].Regexp, ShouldNotBeNil)
+			So(rules[1].Matches("kube-system"), ShouldBeTrue)
+			So(rules[1].Matches("default"), ShouldBeFalse)
+		})
+
+		Convey("errors on bad rules", func() {
+			for _, spec := range []string{"vault-init", "pod=chopper", "service=", "service=~[chopper"} {
+				_, err := ParseDiscoveryRules([]string{spec})
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
+
+func Test_DiscoveryRules(t *testing.T) {
+	Convey("DiscoveryRules", t, func() {
+		pod := &Pod{Namespace: "default", ServiceName: "chopper"}
+
+		Convey("allow everything when there are none", func() {
+			var rules *DiscoveryRules
+
+			excluded, _ := rules.ExcludePod(pod)
+			So(excluded, ShouldBeFalse)
+
+			excluded, _ = rules.ExcludeContainer("vault-init")
+			So(excluded, ShouldBeFalse)
+		})
+
+		Convey("exclude matching pods and containers, with a reason", func() {
+			rules, err := NewDiscoveryRules(nil, []string{"service=chopper", "container=~^(vault-init|logproxy)$"})
+			So(err, ShouldBeNil)
+
+			excluded, reason := rules.ExcludePod(pod)
+			So(excluded, ShouldBeTrue)
+			So(reason, ShouldEqual, "excluded by rule service=chopper")
+
+			excluded, reason = rules.ExcludeContainer("logproxy")
+			So(excluded, ShouldBeTrue)
+			So(reason, ShouldEqual, "excluded by rule container=~^(vault-init|logproxy)$")
+
+			excluded, _ = rules.ExcludeContainer("chopper")
+			So(excluded, ShouldBeFalse)
+		})
+
+		Convey("only include what matches the include rules for a field", func() {
+			rules, err := NewDiscoveryRules([]string{"namespace=default", "namespace=prod"}, nil)
+			So(err, ShouldBeNil)
+
+			excluded, _ := rules.ExcludePod(pod)
+			So(excluded, ShouldBeFalse)
+
+			excluded, reason := rules.ExcludePod(&Pod{Namespace: "kube-system", ServiceName: "chopper"})
+			So(excluded, ShouldBeTrue)
+			So(reason, ShouldEqual, "not included by any namespace rule")
+
+			// No container rules, so all the containers are in
+			excluded, _ = rules.ExcludeContainer("vault-init")
+			So(excluded, ShouldBeFalse)
+		})
+
+		Convey("let exclude rules win", func() {
+			rules, err := NewDiscoveryRules([]string{"namespace=default"}, []string{"namespace=default"})
+			So(err, ShouldBeNil)
+
+			excluded, _ := rules.ExcludePod(pod)
+			So(excluded, ShouldBeTrue)
+		})
+	})
+}
+
+func Test_WithSelfExclusion(t *testing.T) {
+	Convey("WithSelfExclusion()", t, func() {
+		Convey("adds the rule excluding logtailer to custom rules", func() {
+			So(WithSelfExclusion(nil), ShouldResemble, []string{"service=logtailer"})
+			So(
+				WithSelfExclusion([]string{"container=vault-init"}),
+				ShouldResemble, []string{"container=vault-init", "service=logtailer"},
+			)
+		})
+
+		Convey("doesn't add it twice", func() {
+			So(
+				WithSelfExclusion([]string{" service=logtailer", "namespace=kube-system"}),
+				ShouldResemble, []string{" service=logtailer", "namespace=kube-system"},
+			)
+		})
+	})
+}
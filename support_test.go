@@ -5,6 +5,7 @@ import (
 	"errors"
 	"os"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -51,6 +52,37 @@ func (d *mockDisco) LogFiles(pod string) ([]string, error) {
 	return d.Logs, nil
 }
 
+// mockNotifyingDisco is a mockDisco that also implements NotifyingDiscoverer
+type mockNotifyingDisco struct {
+	*mockDisco
+	changes chan struct{}
+}
+
+func newMockNotifyingDisco() *mockNotifyingDisco {
+	return &mockNotifyingDisco{
+		mockDisco: newMockDisco(),
+		changes:   make(chan struct{}),
+	}
+}
+
+func (d *mockNotifyingDisco) Changes() <-chan struct{} {
+	return d.changes
+}
+
+// waitFor polls until the condition is met, returning false if it isn't met
+// within the timeout
+func waitFor(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	return true
+}
+
 // NewMockTailerFunc is injected into a PodTracker get it to use MockTailers
 func NewMockTailerFunc(tailer *MockTailer) NewTailerFunc {
 	return func(pod *Pod) LogTailer {
@@ -59,9 +91,10 @@ func NewMockTailerFunc(tailer *MockTailer) NewTailerFunc {
 	}
 }
 
-// mockFilter implements the DiscoveryFilter interface
+// mockFilter implements the ContainerFilter interface
 type mockFilter struct {
 	ShouldNotTailFor map[string]bool
+	Policies         map[string]*ContainerPolicy
 }
 
 func (m *mockFilter) ShouldTailLogs(pod *Pod) (bool, error) {
@@ -73,9 +106,21 @@ func (m *mockFilter) ShouldTailLogs(pod *Pod) (bool, error) {
 	return true, nil
 }
 
+func (m *mockFilter) ContainerPolicy(pod *Pod) (*ContainerPolicy, error) {
+	return m.Policies[pod.Name], nil
+}
+
+// erroringFilter is a DiscoveryFilter that always fails
+type erroringFilter struct{}
+
+func (m *erroringFilter) ShouldTailLogs(pod *Pod) (bool, error) {
+	return false, errors.New("intentional test error")
+}
+
 // mockLogOutput implements the LogOutput interface
 type mockLogOutput struct {
 	LastLogged    *LogLine
+	Logged        []*LogLine
 	WasCalled     bool
 	CallCount     int
 	StopWasCalled bool
@@ -86,6 +131,7 @@ func (m *mockLogOutput) Log(line *LogLine) {
 	m.Lock()
 	m.WasCalled = true
 	m.LastLogged = line
+	m.Logged = append(m.Logged, line)
 	m.CallCount += 1
 	m.Unlock()
 }
@@ -93,3 +139,11 @@ func (m *mockLogOutput) Log(line *LogLine) {
 func (m *mockLogOutput) Stop() {
 	m.StopWasCalled = true
 }
+
+// blockingLogOutput is a LogOutput that doesn't return until it is released
+type blockingLogOutput struct {
+	release chan struct{}
+}
+
+func (m *blockingLogOutput) Log(line *LogLine) { <-m.release }
+func (m *blockingLogOutput) Stop()             {}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A TailPriority decides which pods are tailed first when there are more log
+// files than we are allowed to tail: pods with a higher priority annotation,
+// then pods in the namespaces listed earlier in Namespaces, and then the ones
+// we found first.
+type TailPriority struct {
+	Keys       *FilterKeys
+	Namespaces []string
+	Metadata   *PodMetadataCache
+}
+
+// For returns the priority from the pod's annotation, 0 if there isn't one,
+// and where its namespace is in Namespaces, after all of them if it isn't
+// listed. Safe to call on a nil TailPriority.
+func (p *TailPriority) For(pod *Pod) (int, int) {
+	if p == nil {
+		return 0, 0
+	}
+
+	rank := len(p.Namespaces)
+	for i, namespace := range p.Namespaces {
+		if namespace == pod.Namespace {
+			rank = i
+			break
+		}
+	}
+
+	if p.Metadata == nil || pod.HostLog {
+		return 0, rank
+	}
+
+	item, ok, err := p.Metadata.Lookup(pod.Name)
+	if err != nil {
+		log.Warnf("Unable to get pod metadata for %s, using the default priority: %s", pod.Name, err)
+		return 0, rank
+	}
+
+	value, found := item.Metadata.Annotations[p.Keys.PriorityAnnotation()]
+	if !ok || !found {
+		return 0, rank
+	}
+
+	priority, err := strconv.Atoi(value)
+	if err != nil {
+		log.Warnf("Bad %s annotation on pod %s, using the default priority: %s",
+			p.Keys.PriorityAnnotation(), pod.Name, err)
+		return 0, rank
+	}
+
+	return priority, rank
+}
+
+// before returns true if the pod waiting on d should be tailed before the one
+// waiting on other. Host logs were asked for specifically, so they go first.
+func (d *filterDecision) before(other *filterDecision) bool {
+	if d.pod.HostLog != other.pod.HostLog {
+		return d.pod.HostLog
+	}
+
+	if d.priority != other.priority {
+		return d.priority > other.priority
+	}
+
+	if d.namespaceRank != other.namespaceRank {
+		return d.namespaceRank < other.namespaceRank
+	}
+
+	if !d.queuedAt.Equal(other.queuedAt) {
+		return d.queuedAt.Before(other.queuedAt)
+	}
+
+	return d.pod.Name < other.pod.Name
+}
+
+// queue marks a pod that should be tailed as waiting for fillSlots to start
+// it, and returns a stand-in for its tailer until then
+func (t *PodTracker) queue(pod *Pod, decision *filterDecision, fromEnd bool) LogTailer {
+	decision.pod = pod
+	decision.waiting = true
+	decision.waitingSince = time.Time{}
+	decision.fromEnd = fromEnd
+	decision.queuedAt = time.Now()
+	decision.priority, decision.namespaceRank = t.Priority.For(pod)
+
+	placeholder := &MockTailer{PodTailed: pod, SkipReason: "waiting for a free slot"}
+	placeholder.Run()
+
+	return placeholder
+}
+
+// fillSlots starts tailing the waiting pods, in order of priority, for as long
+// as their log files fit in MaxTrackedLogs. A pod that doesn't fit holds up the
+// ones after it, so that it isn't starved by smaller pods, unless it could
+// never fit at all. Pods we are already tailing are never stopped to make room.
+func (t *PodTracker) fillSlots() {
+	var used int
+	var waiting []*filterDecision
+	for _, decision := range t.decisions {
+		switch {
+		case decision.waiting:
+			waiting = append(waiting, decision)
+		case decision.tailing:
+			used += decision.files
+		}
+	}
+
+	sort.Slice(waiting, func(i, j int) bool { return waiting[i].before(waiting[j]) })
+
+	full := false
+	for _, decision := range waiting {
+		pod := decision.pod
+
+		// Paused pods don't hold up the others. What they log while they are
+		// paused is skipped.
+		if paused := t.Overrides.PausedFor(pod); paused != nil {
+			decision.paused = true
+			decision.fromEnd = true
+			t.wait(decision, "paused until %s", paused.ExpiresAt.Format(time.RFC3339))
+			continue
+		}
+
+		resumed := decision.paused
+		decision.paused = false
+
+		if full {
+			t.wait(decision, "waiting for a free slot, %d of %d log files are tailed", used, t.MaxTrackedLogs)
+			continue
+		}
+
+		logFiles, err := t.logFilesFor(pod)
+		if err != nil {
+			log.Warnf("Failed to tail logs for pod %s: %s", pod.Name, err)
+			t.forget(pod.Name)
+			continue
+		}
+
+		if t.MaxTrackedLogs > 0 && len(logFiles) > t.MaxTrackedLogs {
+			t.wait(decision, "has %d log files, more than the %d we can tail", len(logFiles), t.MaxTrackedLogs)
+			continue
+		}
+
+		if t.MaxTrackedLogs > 0 && used+len(logFiles) > t.MaxTrackedLogs {
+			full = true
+			t.wait(decision, "waiting for a free slot, %d of %d log files are tailed", used, t.MaxTrackedLogs)
+			continue
+		}
+
+		switch {
+		case resumed:
+			log.Infof("Resuming pod %s after it was paused for %s, from the end of its logs",
+				pod.Name, time.Since(decision.waitingSince).Round(time.Second))
+		case !decision.waitingSince.IsZero():
+			log.Infof("Promoting pod %s after waiting %s for a free slot",
+				pod.Name, time.Since(decision.waitingSince).Round(time.Second))
+		}
+
+		tailer, err := t.startTailer(pod, logFiles, decision.fromEnd)
+		if err != nil {
+			log.Warnf("Failed to tail logs for pod %s: %s", pod.Name, err)
+			t.forget(pod.Name)
+			continue
+		}
+
+		decision.waiting = false
+		decision.waitingSince = time.Time{}
+		decision.files = len(logFiles)
+		used += decision.files
+
+		t.replaceTailer(pod.Name, tailer)
+		t.publish(decision)
+	}
+}
+
+// pausePods stops tailing the pods that have been paused. They wait, like pods
+// that don't fit, until fillSlots finds they have been resumed.
+func (t *PodTracker) pausePods() {
+	for podName, decision := range t.decisions {
+		if !decision.tailing || decision.waiting {
+			continue
+		}
+
+		paused := t.Overrides.PausedFor(decision.pod)
+		if paused == nil {
+			continue
+		}
+
+		log.Infof("Pausing pod %s until %s", podName, paused.ExpiresAt.Format(time.RFC3339))
+		t.replaceTailer(podName, t.queue(decision.pod, decision, true))
+	}
+}
+
+// wait leaves a pod waiting, logging why the first time
+func (t *PodTracker) wait(decision *filterDecision, format string, args ...interface{}) {
+	reason := fmt.Sprintf(format, args...)
+
+	if decision.waitingSince.IsZero() {
+		decision.waitingSince = time.Now()
+		log.Infof("Not tailing pod %s yet: %s", decision.pod.Name, reason)
+	}
+
+	t.withLock(func() {
+		if placeholder, ok := t.LogTails[decision.pod.Name].(*MockTailer); ok {
+			placeholder.SkipReason = reason
+		}
+	})
+	t.publish(decision)
+}
+
+// forget drops a pod we couldn't start tailing, so that it's treated as new
+// on the next discovery pass
+func (t *PodTracker) forget(podName string) {
+	delete(t.decisions, podName)
+	t.withLock(func() {
+		delete(t.LogTails, podName)
+	})
+}
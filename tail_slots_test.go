@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	director "github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_fillSlots(t *testing.T) {
+	Convey("When limiting the log files we tail", t, func() {
+		looper := director.NewFreeLooper(director.ONCE, make(chan error))
+		disco := newMockDisco()
+		disco.Logs = []string{"app/0.log", "envoy/0.log"}
+
+		started := make(map[string]*MockTailer)
+		newTailer := func(pod *Pod) LogTailer {
+			tailer := &MockTailer{PodTailed: pod}
+			started[pod.Name] = tailer
+			return tailer
+		}
+
+		tracker := NewPodTracker(looper, disco, newTailer, &mockFilter{})
+		tracker.MaxTrackedLogs = 4
+		tracker.Priority = &TailPriority{Namespaces: []string{"kube-system", "default"}}
+
+		batch := &Pod{Name: "batch_cruncher", Namespace: "batch"}
+		web := &Pod{Name: "default_web", Namespace: "default"}
+		dns := &Pod{Name: "kube-system_coredns", Namespace: "kube-system"}
+		disco.Pods = []*Pod{batch, web, dns}
+
+		sync := func() string {
+			return LogCapture(func() {
+				go tracker.Run()
+				So(looper.Wait(), ShouldBeNil)
+			})
+		}
+
+		tailed := func(pod *Pod) bool {
+			tailer, ok := started[pod.Name]
+			return ok && tracker.LogTails[pod.Name] == tailer
+		}
+
+		capture := sync()
+
+		Convey("tails the pods that fit, in order of priority", func() {
+			So(tailed(dns), ShouldBeTrue)
+			So(tailed(web), ShouldBeTrue)
+			So(tailed(batch), ShouldBeFalse)
+		})
+
+		Convey("shows the pods that are waiting", func() {
+			So(capture, ShouldContainSubstring, "Not tailing pod batch_cruncher yet")
+
+			placeholder, ok := tracker.LogTails["batch_cruncher"].(*MockTailer)
+			So(ok, ShouldBeTrue)
+			So(placeholder.SkipReason, ShouldEqual, "waiting for a free slot, 4 of 4 log files are tailed")
+			So(batch.Filter.Waiting, ShouldBeTrue)
+			So(batch.Filter.WaitingSince, ShouldNotBeZeroValue)
+			So(web.Filter.Waiting, ShouldBeFalse)
+		})
+
+		Convey("promotes waiting pods when a slot frees up", func() {
+			disco.Pods = []*Pod{batch, dns}
+			capture := sync()
+
+			So(capture, ShouldContainSubstring, "Promoting pod batch_cruncher")
+			So(tailed(batch), ShouldBeTrue)
+			So(started["batch_cruncher"].StartAtEndWasCalled, ShouldBeFalse)
+			So(batch.Filter.Waiting, ShouldBeFalse)
+		})
+
+		Convey("promotes waiting pods when another stops being tailed", func() {
+			tracker.RecheckInterval = time.Nanosecond
+			tracker.Filter = &mockFilter{ShouldNotTailFor: map[string]bool{"default_web": true}}
+			sync()
+
+			So(tailed(web), ShouldBeFalse)
+			So(tailed(batch), ShouldBeTrue)
+		})
+
+		Convey("doesn't stop pods it is tailing for higher priority ones", func() {
+			apiServer := &Pod{Name: "kube-system_apiserver", Namespace: "kube-system"}
+			disco.Pods = []*Pod{batch, web, dns, apiServer}
+			sync()
+
+			So(tailed(web), ShouldBeTrue)
+			So(tailed(apiServer), ShouldBeFalse)
+
+			Convey("but tails them first when there's room", func() {
+				disco.Pods = []*Pod{batch, apiServer, dns}
+				sync()
+
+				So(tailed(apiServer), ShouldBeTrue)
+				So(tailed(batch), ShouldBeFalse)
+			})
+		})
+
+		Convey("doesn't let a pod that can never fit hold up the others", func() {
+			tracker := NewPodTracker(looper, disco, newTailer, &mockFilter{})
+			tracker.MaxTrackedLogs = 3
+
+			small := &Pod{Name: "default_small", Namespace: "default"}
+			disco.Pods = []*Pod{small}
+			disco.Logs = []string{"app/0.log"}
+			_ = LogCapture(func() {
+				go tracker.Run()
+				So(looper.Wait(), ShouldBeNil)
+			})
+
+			big := &Pod{Name: "default_big", Namespace: "default"}
+			disco.Pods = []*Pod{big, small}
+			disco.Logs = []string{"app/0.log", "envoy/0.log", "vault/0.log", "worker/0.log"}
+			_ = LogCapture(func() {
+				go tracker.Run()
+				So(looper.Wait(), ShouldBeNil)
+			})
+
+			So(tracker.LogTails["default_big"].(*MockTailer).SkipReason, ShouldEqual,
+				"has 4 log files, more than the 3 we can tail")
+			So(tracker.LogTails["default_small"], ShouldEqual, started["default_small"])
+		})
+
+		Convey("pauses pods while they are overridden", func() {
+			overrides := NewOverrides(nil)
+			tracker.Overrides = overrides
+
+			capture := LogCapture(func() {
+				_, err := overrides.Pause(ScopeNamespace, "default", time.Hour)
+				So(err, ShouldBeNil)
+			})
+			capture += sync()
+
+			So(capture, ShouldContainSubstring, "Pausing pod default_web")
+			So(tailed(web), ShouldBeFalse)
+			So(tracker.LogTails["default_web"].(*MockTailer).SkipReason, ShouldStartWith, "paused until")
+			So(web.Filter.Paused, ShouldBeTrue)
+
+			Convey("without holding up the others", func() {
+				So(tailed(batch), ShouldBeTrue)
+			})
+
+			Convey("and resumes them from the end of their logs", func() {
+				disco.Pods = []*Pod{web, dns}
+				capture := LogCapture(func() {
+					So(overrides.Resume(ScopeNamespace, "default"), ShouldBeTrue)
+				})
+				capture += sync()
+
+				So(capture, ShouldContainSubstring, "Resuming pod default_web")
+				So(tailed(web), ShouldBeTrue)
+				So(started["default_web"].StartAtEndWasCalled, ShouldBeTrue)
+				So(web.Filter.Paused, ShouldBeFalse)
+			})
+		})
+
+		Convey("tails everything when there is no limit", func() {
+			tracker.MaxTrackedLogs = 0
+			sync()
+
+			So(tailed(batch), ShouldBeTrue)
+		})
+	})
+}
+
+func Test_TailPriority(t *testing.T) {
+	Convey("TailPriority", t, func() {
+		server, client := fakeKubeAPI(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"items":[
+				{"metadata":{"name":"important","namespace":"default","uid":"1234",
+					"annotations":{"community.com/TailLogsPriority":"10"}}},
+				{"metadata":{"name":"confused","namespace":"default","uid":"5678",
+					"annotations":{"community.com/TailLogsPriority":"high"}}}
+			]}`)
+		})
+		Reset(server.Close)
+
+		priority := &TailPriority{
+			Keys:       DefaultFilterKeys,
+			Namespaces: []string{"kube-system", "default"},
+			Metadata:   NewPodMetadataCache(client, "beowulf", time.Minute),
+		}
+
+		Convey("uses the priority annotation and the namespace order", func() {
+			value, rank := priority.For(&Pod{Name: "default_important_1234", Namespace: "default"})
+			So(value, ShouldEqual, 10)
+			So(rank, ShouldEqual, 1)
+
+			value, rank = priority.For(&Pod{Name: "batch_cruncher_9999", Namespace: "batch"})
+			So(value, ShouldEqual, 0)
+			So(rank, ShouldEqual, 2)
+		})
+
+		Convey("ignores annotations it can't understand", func() {
+			var value int
+			capture := LogCapture(func() {
+				value, _ = priority.For(&Pod{Name: "default_confused_5678", Namespace: "default"})
+			})
+
+			So(value, ShouldEqual, 0)
+			So(capture, ShouldContainSubstring, "Bad community.com/TailLogsPriority annotation")
+		})
+
+		Convey("ranks every pod the same when there isn't one", func() {
+			var none *TailPriority
+			value, rank := none.For(&Pod{Name: "default_important_1234", Namespace: "default"})
+			So(value, ShouldEqual, 0)
+			So(rank, ShouldEqual, 0)
+		})
+	})
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -13,6 +15,20 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// DefaultMaxLineSize is the largest line we'll assemble from partials
+	DefaultMaxLineSize = 256 * 1024
+	// DefaultPartialFlushTimeout is how long we'll wait for the rest of a
+	// partial line before sending what we have
+	DefaultPartialFlushTimeout = 5 * time.Second
+
+	// How often we check on progress while draining
+	drainCheckInterval = 100 * time.Millisecond
+	// When we can't see the files any more, how long without new lines before
+	// we decide we've drained everything
+	drainQuietPeriod = 500 * time.Millisecond
+)
+
 // Global counter for active goroutines (for monitoring)
 var activeGoroutines int64
 
@@ -26,7 +42,10 @@ type LogTailer interface {
 	TailLogs(logFiles []string) error
 	Run()
 	FlushOffsets()
+	Drain(grace time.Duration)
+	StartAtEnd()
 	Stop()
+	Shutdown(deadline time.Time) (delivered int64, abandoned int64)
 }
 
 // A Tailer watches all the logs for a Pod
@@ -35,17 +54,32 @@ type Tailer struct {
 	Pod          *Pod
 	LogChan      chan *LogLine `json:"-"`
 	shutdownChan chan struct{} `json:"-"`
+	stopReading  chan struct{} // Closed when we are exiting, see Shutdown()
+
+	// MaxLineSize caps the size of lines joined from partials, 0 is unlimited
+	MaxLineSize int `json:"-"`
+	// PartialFlushTimeout is how long a partial line may wait for its end
+	PartialFlushTimeout time.Duration `json:"-"`
 
 	logger LogOutput
 
 	looper             director.Looper
 	cache              *cache.Cache
 	localCache         map[string]*tail.SeekInfo
-	lock               sync.RWMutex
-	logChanClosed      int32          // atomic flag to prevent double channel close
-	shutdownChanClosed int32          // atomic flag to prevent double shutdown channel close
-	stopCalled         int32          // atomic flag to prevent multiple Stop() calls
-	pumpWg             sync.WaitGroup // tracks active logPump goroutines
+	chains             map[string]*logChain  // by live log, like LogTails
+	stats              map[string]*fileStats // by container
+	lock               sync.RWMutex          // for LogTails, chains, stats and localCache
+	startAtEnd         bool                  // Skip what is already in the logs
+	logChanClosed      int32                 // atomic flag to prevent double channel close
+	shutdownChanClosed int32                 // atomic flag to prevent double shutdown channel close
+	stopCalled         int32                 // atomic flag to prevent multiple Stop() calls
+	stopReadingClosed  int32                 // atomic flag to prevent double stopReading close
+	pumpWg             sync.WaitGroup        // tracks active logPump goroutines
+
+	sentLines      int64 // atomic count of lines handed to LogChan
+	deliveredLines int64 // atomic count of lines handed to the logger
+	drainedLines   int64 // atomic count of lines delivered while draining
+	lostLines      int64 // atomic count of lines read but never delivered
 }
 
 // NewTailer returns a properly configured Tailer for a Pod
@@ -55,10 +89,16 @@ func NewTailer(pod *Pod, cache *cache.Cache, logger LogOutput) *Tailer {
 		Pod:          pod,
 		LogChan:      make(chan *LogLine),
 		shutdownChan: make(chan struct{}),
+		stopReading:  make(chan struct{}),
 		looper:       director.NewFreeLooper(director.FOREVER, make(chan error)),
 		cache:        cache,
 		localCache:   make(map[string]*tail.SeekInfo, 5),
+		chains:       make(map[string]*logChain, 5),
+		stats:        make(map[string]*fileStats, 5),
 		logger:       logger,
+
+		MaxLineSize:         DefaultMaxLineSize,
+		PartialFlushTimeout: DefaultPartialFlushTimeout,
 	}
 }
 
@@ -75,25 +115,105 @@ func containerNameFor(filename string) string {
 	return fields[len(fields)-2 : len(fields)-1][0]
 }
 
-// TailLogs takes a list of filenames and opens a tail on them. The logs from
-// the tail are copied into the main LogChan. This is then processed when Run()
-// is invoked. The channels are all unbuffered.
+// containerFor returns the name of the container a log belongs to
+func (t *Tailer) containerFor(filename string) string {
+	if t.Pod.Container != "" {
+		return t.Pod.Container
+	}
+
+	return containerNameFor(filename)
+}
+
+// A logChain is everything we read for one container, in order: the logs we
+// need to catch up on, and then the live log that we follow. If the live log
+// is rotated we finish the rotated file before following the new one.
+type logChain struct {
+	filename  string          // The live log
+	container string          // The container it belongs to
+	catchUp   []logSegment    // Read these first, oldest first
+	after     <-chan struct{} // Closed when the chain before this one is done
+
+	tailed *tail.Tail
+	info   os.FileInfo // The live log we are following, to spot rotation
+	offset int64       // How far we have read into the live log
+
+	finish  chan struct{} // Closed when the container has restarted
+	dropped chan struct{} // Closed when we no longer want the log
+	done    chan struct{} // Closed when the logPump exits
+}
+
+func newLogChain(filename string, container string) *logChain {
+	return &logChain{
+		filename:  filename,
+		container: container,
+		finish:    make(chan struct{}),
+		dropped:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// TailLogs takes a list of filenames and opens a tail on the live log for
+// each container. Rotated logs and the logs from before a container
+// restarted are read first, in order. The logs from the tail are copied into
+// the main LogChan. This is then processed when Run() is invoked. The
+// channels are all unbuffered.
 func (t *Tailer) TailLogs(logFiles []string) error {
-	for _, filename := range logFiles {
+	// Only applies to the logs that are there now
+	fromEnd := t.startAtEnd
+	t.startAtEnd = false
+
+	for _, files := range logsByContainer(logFiles) {
+		live := files[len(files)-1]
+
 		// Files we already know about
-		if _, ok := t.LogTails[filename]; ok {
+		if t.chainFor(live) != nil {
 			continue
 		}
 
 		// Files we didn't know about, add a tail
-		tailed, err := t.tailOneLog(filename)
+		chain := newLogChain(live, t.containerFor(live))
+
+		var location *tail.SeekInfo
+		if fromEnd {
+			// Whatever was written while we weren't tailing is skipped,
+			// including any offset left over from the last time we were
+			location = endOf(live)
+			if location != nil {
+				t.localCacheAdd(live, location)
+			}
+		} else {
+			// Anything older is from before the container restarted, so it
+			// has to be finished before we start on the new one
+			for _, older := range files[:len(files)-1] {
+				if previous := t.chainFor(older); previous != nil {
+					previous.Finish()
+					chain.after = previous.done
+					continue
+				}
+
+				segments, location := t.rotationSet(older)
+				chain.catchUp = append(chain.catchUp, segments...)
+				chain.catchUp = append(chain.catchUp,
+					logSegment{filename: older, key: older, location: location, last: true},
+				)
+			}
 
+			var segments []logSegment
+			segments, location = t.rotationSet(live)
+			chain.catchUp = append(chain.catchUp, segments...)
+		}
+
+		err := t.tailOneLog(chain, location, true)
 		if err != nil {
 			// We have to clean up all the tails that started already
+			t.lock.RLock()
 			for _, tailed := range t.LogTails {
 				_ = tailed.Stop() // Ignore any errors
 			}
-			close(t.shutdownChan)
+			t.lock.RUnlock()
+			if atomic.CompareAndSwapInt32(&t.shutdownChanClosed, 0, 1) {
+				close(t.shutdownChan)
+			}
 			// Close the channel only once using atomic operation
 			if atomic.CompareAndSwapInt32(&t.logChanClosed, 0, 1) {
 				close(t.LogChan)
@@ -104,18 +224,18 @@ func (t *Tailer) TailLogs(logFiles []string) error {
 		// Copy into the main channel. These will exit when the tail is
 		// stopped.
 		t.pumpWg.Add(1)
-		go func(fname string, containerName string, tail *tail.Tail) {
+		go func(chain *logChain) {
 			defer t.pumpWg.Done()
-			t.logPump(fname, containerName, tail)
-		}(filename, containerNameFor(filename), tailed)
-		continue
+			t.logPump(chain)
+		}(chain)
 	}
 
-	var droppedTails []string
+	t.lock.Lock()
+	defer t.lock.Unlock()
 
 	// Clean up files we don't need to tail any more
 OUTER:
-	for existingFname, tail := range t.LogTails {
+	for existingFname, chain := range t.chains {
 		// See if the existing file is in the new list
 		for _, newFname := range logFiles {
 			// It is? Ok, skip
@@ -125,68 +245,225 @@ OUTER:
 		}
 
 		// It's not in the new files, so stop tailing it
-		err := tail.Stop()
+		close(chain.dropped)
+		if stats := t.stats[logGroup(existingFname)]; stats != nil && stats.following() == existingFname {
+			delete(t.stats, logGroup(existingFname))
+		}
+		err := chain.tailed.Stop()
 		if err != nil {
 			log.Errorf("Failed to stop tail for file %s", existingFname)
 		}
-		droppedTails = append(droppedTails, existingFname)
+		delete(t.chains, existingFname)
+		delete(t.LogTails, existingFname)
 		log.Infof("  Dropping tail on %s", existingFname)
 	}
 
-	// Remove them from LogTails map in a separate loop
-	for _, fname := range droppedTails {
-		delete(t.LogTails, fname)
+	return nil
+}
+
+// StartAtEnd makes the next call to TailLogs() start from the end of the logs
+// that are already there, rather than from the beginning or the offset we
+// have. Used when we start tailing a pod that we had been skipping.
+func (t *Tailer) StartAtEnd() {
+	t.startAtEnd = true
+}
+
+// endOf returns the location of the end of a log, or nil for the beginning
+// if we can't tell
+func endOf(filename string) *tail.SeekInfo {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil
 	}
 
-	return nil
+	return &tail.SeekInfo{Offset: info.Size(), Whence: io.SeekStart}
+}
+
+// Finish tells the logPump that the live log won't grow any more, because the
+// container has restarted. It stops once it has read to the end.
+func (c *logChain) Finish() {
+	select {
+	case <-c.finish:
+	default:
+		close(c.finish)
+	}
+}
+
+// isDropped returns true once we no longer want the log
+func (c *logChain) isDropped() bool {
+	select {
+	case <-c.dropped:
+		return true
+	default:
+		return false
+	}
+}
+
+// chainFor returns the logChain following a live log, if there is one
+func (t *Tailer) chainFor(filename string) *logChain {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.chains[filename]
 }
 
-// tailOneLog will setup a tailer for a logfile.
-func (t *Tailer) tailOneLog(filename string) (*tail.Tail, error) {
+// tailOneLog will setup a tailer for the live log of a chain, starting from
+// location. If mustExist is false, the tail will wait for the file to appear.
+func (t *Tailer) tailOneLog(chain *logChain, location *tail.SeekInfo, mustExist bool) error {
+	// We handle rotation ourselves, so that we don't miss the end of the
+	// rotated file
 	tailConfig := tail.Config{
-		ReOpen: true, Follow: true, Logger: log.StandardLogger(), Location: nil,
-		MustExist: true, Poll: true,
+		ReOpen: false, Follow: true, Logger: log.StandardLogger(), Location: nil,
+		MustExist: mustExist, Poll: true,
 	}
 
-	// Try to get an existing offset from the main cache
-	if sought := t.cache.Get(filename); sought != nil {
-		log.Infof("  Found existing offset for %s, skipping to position", filename)
-		tailConfig.Location = sought
+	if location != nil {
+		log.Infof("  Found existing offset for %s, skipping to position", chain.filename)
+		tailConfig.Location = location
+		chain.offset = location.Offset
+	} else {
+		chain.offset = 0
 	}
 
-	tailed, err := tail.TailFile(filename, tailConfig)
+	tailed, err := tail.TailFile(chain.filename, tailConfig)
 	if err != nil {
-		log.Warnf("Error tailing %s for pod %s: %s", filename, t.Pod.Name, err)
-		return nil, err
+		log.Warnf("Error tailing %s for pod %s: %s", chain.filename, t.Pod.Name, err)
+		return err
 	}
 
-	log.Infof("  Adding tail on %s for pod %s", filename, t.Pod.Name)
-	t.LogTails[filename] = tailed
+	// If it isn't there yet, we'll find out what it is when we read from it
+	chain.info, _ = os.Stat(chain.filename)
+	t.statsFor(chain.filename).follow(chain.filename, chain.offset)
 
-	return tailed, nil
+	log.Infof("  Adding tail on %s for pod %s", chain.filename, t.Pod.Name)
+	t.lock.Lock()
+	chain.tailed = tailed
+	t.LogTails[chain.filename] = tailed
+	t.chains[chain.filename] = chain
+	t.lock.Unlock()
+
+	return nil
 }
 
-// logPump runs in a goroutine for each log file, copying logs into the main
-// channel.
-func (t *Tailer) logPump(filename string, containerName string, tailed *tail.Tail) {
+// logPump runs in a goroutine for each container, copying logs into the main
+// channel. It catches up on older logs first, then follows the live one. The
+// log format is detected from the file contents, and partial lines are
+// assembled here before being sent on.
+func (t *Tailer) logPump(chain *logChain) {
 	atomic.AddInt64(&activeGoroutines, 1)
 	defer atomic.AddInt64(&activeGoroutines, -1)
-	defer log.Debugf("logPump goroutine exiting for %s", filename)
+	defer close(chain.done)
+	defer log.Debugf("logPump goroutine exiting for %s", chain.filename)
 
-	for l := range tailed.Lines {
-		// Use select block with timeout to prevent blocking
+	filename := chain.filename
+	format := formatUnknown
+	if t.Pod.HostLog {
+		format = formatPlain
+	}
+	decoder := newLogDecoder(filename, chain.container, format, t.MaxLineSize)
+	stats := t.statsFor(filename)
+
+	// Don't start until the log from before a restart is finished
+	if chain.after != nil {
 		select {
-		case t.LogChan <- &LogLine{Text: l.Text, Container: containerName}:
-			// Successfully sent
+		case <-chain.after:
 		case <-t.shutdownChan:
-			// Shutdown requested, exit immediately
 			return
-		case <-time.After(5 * time.Second):
-			// Timeout sending log, drop the line and continue
-			log.Warnf("Timeout sending log for %s, dropping line", filename)
-			continue
+		case <-t.stopReading:
+			return
+		}
+	}
+
+	for _, segment := range chain.catchUp {
+		if !t.readSegment(segment, stats, decoder) {
+			return
+		}
+	}
+
+	// Only set while we're holding on to part of a line
+	var flushTimeout <-chan time.Time
+	// Only set once the container has restarted
+	var finishCheck <-chan time.Time
+
+	finish := chain.finish
+
+PUMP:
+	for {
+		// Anything we haven't read yet is read again after a restart
+		if t.isStoppingReading() {
+			return
+		}
+
+		select {
+		case <-t.stopReading:
+			return
+
+		case l, ok := <-chain.tailed.Lines:
+			if !ok {
+				if t.isShuttingDown() {
+					break PUMP
+				}
+
+				if chain.isDropped() {
+					return
+				}
+
+				// The tail ends by itself when the file is rotated
+				if !t.followRotation(chain, decoder) {
+					return
+				}
+				continue
+			}
+
+			if chain.info == nil {
+				chain.info, _ = os.Stat(filename)
+			}
+			chain.offset = l.SeekInfo.Offset
+			stats.read(len(l.Text) + 1)
+			stats.setOffset(filename, chain.offset)
+
+			for _, complete := range decoder.Decode(l.Text) {
+				if !t.sendLine(stats, filename, complete) {
+					return
+				}
+			}
+
+			if decoder.Pending() {
+				if flushTimeout == nil {
+					flushTimeout = time.After(t.PartialFlushTimeout)
+				}
+				// Don't record the offset until we have shipped the whole line
+				continue
+			}
+
+			flushTimeout = nil
+			t.localCacheAdd(filename, &(l.SeekInfo))
+
+		case <-flushTimeout:
+			flushTimeout = nil
+			log.Warnf("Partial line in %s never finished, sending what we have", filename)
+
+			for _, complete := range decoder.Flush() {
+				if !t.sendLine(stats, filename, complete) {
+					return
+				}
+			}
+
+		case <-finish:
+			finish = nil
+			ticker := time.NewTicker(drainCheckInterval)
+			defer ticker.Stop()
+			finishCheck = ticker.C
+
+		case <-finishCheck:
+			info, err := os.Stat(filename)
+			if err == nil && chain.offset < info.Size() {
+				continue
+			}
+
+			t.finishChain(chain, decoder)
+			return
 		}
-		t.localCacheAdd(filename, &(l.SeekInfo))
 	}
 
 	// Close the channel only once using atomic operation
@@ -197,6 +474,124 @@ func (t *Tailer) logPump(filename string, containerName string, tailed *tail.Tai
 	log.Infof("  Closing tail on %s for pod %s", filename, t.Pod.Name)
 }
 
+// followRotation picks up after the kubelet rotates the live log. We finish
+// reading the rotated file from where we got to, and then start on the new
+// live log from the beginning. Returns false if we are shutting down.
+func (t *Tailer) followRotation(chain *logChain, decoder *logDecoder) bool {
+	rotated := findRotated(chain.filename, chain.info)
+	if rotated == "" {
+		log.Warnf("Lost track of %s for pod %s, it was removed", chain.filename, t.Pod.Name)
+	} else {
+		log.Infof("  %s was rotated to %s, finishing it", chain.filename, rotated)
+
+		segment := logSegment{
+			filename: rotated,
+			key:      rotated,
+			location: &tail.SeekInfo{Offset: chain.offset, Whence: io.SeekStart},
+		}
+		if !t.readSegment(segment, t.statsFor(chain.filename), decoder) {
+			return false
+		}
+	}
+
+	t.localCacheAdd(chain.filename, &tail.SeekInfo{Offset: 0, Whence: io.SeekStart})
+	t.forgetRotated(chain.filename)
+
+	err := t.tailOneLog(chain, nil, false)
+	if err != nil {
+		log.Errorf("Unable to follow %s after rotation: %s", chain.filename, err)
+		return false
+	}
+
+	// Stop() may have missed the new tail, or we may have been dropped
+	if t.isShuttingDown() || chain.isDropped() {
+		_ = chain.tailed.Stop()
+		t.removeChain(chain)
+		return false
+	}
+
+	return true
+}
+
+// finishChain stops following a live log once the container has restarted
+// and we have read all of it
+func (t *Tailer) finishChain(chain *logChain, decoder *logDecoder) {
+	stats := t.statsFor(chain.filename)
+	for _, line := range decoder.Flush() {
+		if !t.sendLine(stats, chain.filename, line) {
+			return
+		}
+	}
+
+	err := chain.tailed.Stop()
+	if err != nil {
+		log.Errorf("Failed to stop tail for file %s", chain.filename)
+	}
+
+	shipped := shippedLocation
+	t.localCacheAdd(chain.filename, &shipped)
+
+	t.removeChain(chain)
+
+	log.Infof("  Finished %s for pod %s, the container restarted", chain.filename, t.Pod.Name)
+}
+
+// removeChain stops tracking a chain, if a newer one hasn't replaced it
+func (t *Tailer) removeChain(chain *logChain) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.chains[chain.filename] != chain {
+		return
+	}
+
+	delete(t.chains, chain.filename)
+	delete(t.LogTails, chain.filename)
+}
+
+// isShuttingDown returns true once Stop() has been called
+func (t *Tailer) isShuttingDown() bool {
+	select {
+	case <-t.shutdownChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// isStoppingReading returns true once Shutdown() has been called
+func (t *Tailer) isStoppingReading() bool {
+	select {
+	case <-t.stopReading:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendLine copies a line into the main channel, to be counted in stats. It
+// returns false if we are shutting down and the pump should exit.
+func (t *Tailer) sendLine(stats *fileStats, filename string, line *LogLine) bool {
+	line.stats = stats
+
+	// Use select block with timeout to prevent blocking
+	select {
+	case t.LogChan <- line:
+		// Successfully sent
+		atomic.AddInt64(&t.sentLines, 1)
+	case <-t.shutdownChan:
+		// Shutdown requested, exit immediately
+		atomic.AddInt64(&t.lostLines, 1)
+		return false
+	case <-time.After(5 * time.Second):
+		// Timeout sending log, drop the line and continue
+		log.Warnf("Timeout sending log for %s, dropping line", filename)
+		stats.dropped()
+	}
+
+	return true
+}
+
 // Run processes all the logs currently pending, and then writes the current
 // seek info for each log to the main cache for persistence.
 func (t *Tailer) Run() {
@@ -204,6 +599,8 @@ func (t *Tailer) Run() {
 		log.Infof("Following logs for '%s'", t.Pod.Name)
 		for line := range t.LogChan {
 			t.logger.Log(line)
+			atomic.AddInt64(&t.deliveredLines, 1)
+			line.stats.delivered(line)
 		}
 		return nil
 	})
@@ -221,6 +618,111 @@ func (t *Tailer) FlushOffsets() {
 	}
 }
 
+// Drain waits for the Tailer to read and deliver everything left in its log
+// files, for up to the grace period. It is used when a pod has gone away so
+// that we don't lose the last things it wrote, e.g. a crash stack trace.
+// Stop() should be called afterward.
+func (t *Tailer) Drain(grace time.Duration) {
+	if grace <= 0 {
+		return
+	}
+
+	startDelivered := atomic.LoadInt64(&t.deliveredLines)
+	lastDelivered := startDelivered
+	lastProgress := time.Now()
+
+	deadline := time.After(grace)
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+
+DRAIN:
+	for {
+		// The offsets are recorded once a line is handed over, so we also
+		// wait for the Run loop to finish logging what it was given
+		caughtUp, known := t.caughtUp()
+		if caughtUp && t.allDelivered() {
+			break
+		}
+
+		select {
+		case <-deadline:
+			log.Warnf("Gave up draining logs for pod %s after %s", t.Pod.Name, grace)
+			break DRAIN
+		case <-ticker.C:
+		}
+
+		delivered := atomic.LoadInt64(&t.deliveredLines)
+		if delivered != lastDelivered {
+			lastDelivered = delivered
+			lastProgress = time.Now()
+			continue
+		}
+
+		// If the files are gone, all we can do is wait for the lines to stop
+		if !known && time.Since(lastProgress) > drainQuietPeriod {
+			break
+		}
+	}
+
+	drained := atomic.LoadInt64(&t.deliveredLines) - startDelivered
+	atomic.AddInt64(&t.drainedLines, drained)
+	log.Infof("Drained %d lines for pod %s", drained, t.Pod.Name)
+}
+
+// allDelivered reports whether every line handed to LogChan has been passed
+// to the LogOutput
+func (t *Tailer) allDelivered() bool {
+	return atomic.LoadInt64(&t.deliveredLines) >= atomic.LoadInt64(&t.sentLines)
+}
+
+// caughtUp reports whether we have shipped everything up to the end of every
+// log file. If any of the files can no longer be seen, known is false.
+func (t *Tailer) caughtUp() (caughtUp bool, known bool) {
+	caughtUp = true
+	known = true
+
+	for _, filename := range t.liveLogs() {
+		info, err := os.Stat(filename)
+		if err != nil {
+			known = false
+			caughtUp = false
+			continue
+		}
+
+		if t.unreadBytes(filename, info.Size()) > 0 {
+			caughtUp = false
+		}
+	}
+
+	return caughtUp, known
+}
+
+// unreadBytes returns how far short of size we are in shipping a file
+func (t *Tailer) unreadBytes(filename string, size int64) int64 {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	var offset int64
+	if seekInfo, ok := t.localCache[filename]; ok {
+		if isShipped(seekInfo) {
+			return 0
+		}
+		offset = seekInfo.Offset
+	}
+
+	if offset >= size {
+		return 0
+	}
+
+	return size - offset
+}
+
+// DrainStats returns the number of lines that were delivered while draining
+// and the number that were read but never delivered
+func (t *Tailer) DrainStats() (drained int64, lost int64) {
+	return atomic.LoadInt64(&t.drainedLines), atomic.LoadInt64(&t.lostLines)
+}
+
 func (t *Tailer) Stop() {
 	// Prevent multiple Stop() calls
 	if !atomic.CompareAndSwapInt32(&t.stopCalled, 0, 1) {
@@ -233,7 +735,14 @@ func (t *Tailer) Stop() {
 	}
 
 	// Stop all tails
+	t.lock.RLock()
+	tails := make([]*tail.Tail, 0, len(t.LogTails))
 	for _, entry := range t.LogTails {
+		tails = append(tails, entry)
+	}
+	t.lock.RUnlock()
+
+	for _, entry := range tails {
 		err := entry.Stop()
 		if err != nil {
 			log.Errorf("Failed to stop tail for pod %s: %s", t.Pod.Name, err)
@@ -255,6 +764,19 @@ func (t *Tailer) Stop() {
 		log.Warnf("Timeout waiting for goroutines to stop for pod %s", t.Pod.Name)
 	}
 
+	// Whatever we didn't get to is gone now
+	var lostBytes int64
+	for _, filename := range t.liveLogs() {
+		if info, err := os.Stat(filename); err == nil {
+			lostBytes += t.unreadBytes(filename, info.Size())
+		}
+	}
+	drained, lost := t.DrainStats()
+	log.Infof(
+		"Stopped tailing pod %s: drained %d lines, lost %d lines and %d unread bytes",
+		t.Pod.Name, drained, lost, lostBytes,
+	)
+
 	// Remove our offsets from the persisted cache
 	t.lock.RLock()
 	for filename, _ := range t.localCache {
@@ -266,6 +788,89 @@ func (t *Tailer) Stop() {
 	t.logger.Stop()
 }
 
+// Shutdown is for when we are exiting, rather than when the pod has gone away.
+// We stop reading the logs, and wait until the deadline for the lines we have
+// already read to be delivered to the LogOutput. Unlike Stop(), our offsets
+// are kept, so that we carry on from where we got to after a restart. Returns
+// the number of lines delivered during shutdown and the number abandoned.
+func (t *Tailer) Shutdown(deadline time.Time) (delivered int64, abandoned int64) {
+	startDelivered := atomic.LoadInt64(&t.deliveredLines)
+	startLost := atomic.LoadInt64(&t.lostLines)
+
+	if atomic.CompareAndSwapInt32(&t.stopReadingClosed, 0, 1) {
+		close(t.stopReading)
+	}
+
+	// The pumps exit once they've handed over the line they were on, and then
+	// we wait for the last of them to be delivered
+	pumpsDone := make(chan struct{})
+	go func() {
+		t.pumpWg.Wait()
+		close(pumpsDone)
+	}()
+
+	timeout := time.After(time.Until(deadline))
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+
+	waitForPumps := pumpsDone
+WAIT:
+	for {
+		if waitForPumps == nil && t.allDelivered() {
+			break
+		}
+
+		select {
+		case <-waitForPumps:
+			waitForPumps = nil
+		case <-timeout:
+			log.Warnf("Gave up delivering logs for pod %s at the shutdown deadline", t.Pod.Name)
+			break WAIT
+		case <-ticker.C:
+		}
+	}
+
+	// Whatever is still waiting to be sent is abandoned
+	if atomic.CompareAndSwapInt32(&t.shutdownChanClosed, 0, 1) {
+		close(t.shutdownChan)
+	}
+
+	t.lock.RLock()
+	for _, entry := range t.LogTails {
+		_ = entry.Stop() // Ignore any errors, we're exiting
+		entry.Cleanup()
+	}
+	t.lock.RUnlock()
+
+	select {
+	case <-pumpsDone:
+	case <-time.After(drainQuietPeriod):
+	}
+
+	// Any line still being logged is included in what was abandoned
+	delivered = atomic.LoadInt64(&t.deliveredLines) - startDelivered
+	abandoned = atomic.LoadInt64(&t.lostLines) - startLost +
+		atomic.LoadInt64(&t.sentLines) - atomic.LoadInt64(&t.deliveredLines)
+
+	t.looper.Quit()
+	t.logger.Stop()
+
+	return delivered, abandoned
+}
+
+// liveLogs returns the names of the logs we are following
+func (t *Tailer) liveLogs() []string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	filenames := make([]string, 0, len(t.LogTails))
+	for filename := range t.LogTails {
+		filenames = append(filenames, filename)
+	}
+
+	return filenames
+}
+
 func (t *Tailer) localCacheAdd(filename string, seekInfo *tail.SeekInfo) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// When any Tailer last dropped a line because it couldn't be sent in time,
+// atomic, in Unix nanoseconds
+var lastDroppedAt int64
+
+// FileStats are the counters for one live log in a Tailer. The lines from
+// rotated logs, and from before the container restarted, count towards the
+// live log that came after them.
+type FileStats struct {
+	File      string `json:",omitempty"` // The live log
+	Container string `json:",omitempty"`
+
+	LinesRead        int64
+	BytesRead        int64
+	LinesDelivered   int64
+	LinesDropped     int64 // Timed out waiting to be sent
+	LinesRateLimited int64
+
+	LastLine *time.Time `json:",omitempty"` // When we last read a line
+
+	Offset   int64 // How far we have read into the live log
+	Size     int64 // How big the live log is now
+	LagBytes int64 // How much of the live log we have still to read
+}
+
+// fileStats keeps the counts for a FileStats while we are tailing
+type fileStats struct {
+	container string
+	lines     *serviceLines // The metrics for the whole service
+
+	linesRead        int64 // atomic
+	bytesRead        int64 // atomic
+	linesDelivered   int64 // atomic
+	linesDropped     int64 // atomic
+	linesRateLimited int64 // atomic
+	lastLine         int64 // atomic, in Unix nanoseconds
+
+	lock   sync.Mutex // for file and offset
+	file   string
+	offset int64
+}
+
+// read counts a line read from one of the logs
+func (s *fileStats) read(bytes int) {
+	atomic.AddInt64(&s.linesRead, 1)
+	atomic.AddInt64(&s.bytesRead, int64(bytes))
+	atomic.AddInt64(s.lines.read, 1)
+	atomic.StoreInt64(&s.lastLine, time.Now().UnixNano())
+}
+
+// delivered counts a line handed to the LogOutput, which may have rate
+// limited it
+func (s *fileStats) delivered(line *LogLine) {
+	if line.RateLimited {
+		atomic.AddInt64(&s.linesRateLimited, 1)
+		atomic.AddInt64(s.lines.rateLimited, 1)
+		return
+	}
+
+	atomic.AddInt64(&s.linesDelivered, 1)
+	atomic.AddInt64(s.lines.sent, 1)
+}
+
+// dropped counts a line we gave up trying to send
+func (s *fileStats) dropped() {
+	atomic.AddInt64(&s.linesDropped, 1)
+	atomic.AddInt64(s.lines.dropped, 1)
+	atomic.StoreInt64(&lastDroppedAt, time.Now().UnixNano())
+}
+
+// follow starts tracking the offset in a new live log
+func (s *fileStats) follow(file string, offset int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.file = file
+	s.offset = offset
+}
+
+// setOffset records how far we have read into a live log, unless we have
+// moved on to a newer one
+func (s *fileStats) setOffset(file string, offset int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.file == file {
+		s.offset = offset
+	}
+}
+
+// following returns the live log we are following
+func (s *fileStats) following() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.file
+}
+
+// snapshot returns the FileStats as they are now, looking at the live log to
+// see how far behind we are
+func (s *fileStats) snapshot() FileStats {
+	s.lock.Lock()
+	file, offset := s.file, s.offset
+	s.lock.Unlock()
+
+	stats := FileStats{
+		File:             file,
+		Container:        s.container,
+		LinesRead:        atomic.LoadInt64(&s.linesRead),
+		BytesRead:        atomic.LoadInt64(&s.bytesRead),
+		LinesDelivered:   atomic.LoadInt64(&s.linesDelivered),
+		LinesDropped:     atomic.LoadInt64(&s.linesDropped),
+		LinesRateLimited: atomic.LoadInt64(&s.linesRateLimited),
+		Offset:           offset,
+	}
+
+	if lastLine := atomic.LoadInt64(&s.lastLine); lastLine != 0 {
+		at := time.Unix(0, lastLine).UTC()
+		stats.LastLine = &at
+	}
+
+	// The log may have gone already, in which case there's nothing left
+	if info, err := os.Stat(file); err == nil {
+		stats.Size = info.Size()
+		if stats.Size > offset {
+			stats.LagBytes = stats.Size - offset
+		}
+	}
+
+	return stats
+}
+
+// add adds the counts from another FileStats, for the totals for a pod
+func (s *FileStats) add(other FileStats) {
+	s.LinesRead += other.LinesRead
+	s.BytesRead += other.BytesRead
+	s.LinesDelivered += other.LinesDelivered
+	s.LinesDropped += other.LinesDropped
+	s.LinesRateLimited += other.LinesRateLimited
+	s.Offset += other.Offset
+	s.Size += other.Size
+	s.LagBytes += other.LagBytes
+
+	if other.LastLine != nil && (s.LastLine == nil || other.LastLine.After(*s.LastLine)) {
+		s.LastLine = other.LastLine
+	}
+}
+
+// statsFor returns the counters for a live log, starting them if they are
+// new. The kubelet's logs for a container share their counters across
+// restarts, while each host log has its own, even though they all have the
+// same container.
+func (t *Tailer) statsFor(filename string) *fileStats {
+	key := logGroup(filename)
+
+	t.lock.RLock()
+	stats, ok := t.stats[key]
+	t.lock.RUnlock()
+	if ok {
+		return stats
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// Someone else may have got here first
+	if stats, ok := t.stats[key]; ok {
+		return stats
+	}
+
+	stats = &fileStats{container: t.containerFor(filename), lines: metrics.linesFor(t.Pod.ServiceName)}
+	t.stats[key] = stats
+
+	return stats
+}
+
+// Stats returns the counters for each live log we are following, ordered by
+// their names
+func (t *Tailer) Stats() []FileStats {
+	t.lock.RLock()
+	following := make([]*fileStats, 0, len(t.stats))
+	for _, stats := range t.stats {
+		following = append(following, stats)
+	}
+	t.lock.RUnlock()
+
+	all := make([]FileStats, 0, len(following))
+	for _, stats := range following {
+		all = append(all, stats.snapshot())
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].File < all[j].File })
+
+	return all
+}
+
+// MarshalJSON adds the stats for the pod, and for each of its logs, for the
+// state server
+func (t *Tailer) MarshalJSON() ([]byte, error) {
+	files := t.Stats()
+
+	var total FileStats
+	for _, stats := range files {
+		total.add(stats)
+	}
+
+	return json.Marshal(struct {
+		Pod   *Pod
+		Stats FileStats
+		Files []FileStats
+	}{t.Pod, total, files})
+}
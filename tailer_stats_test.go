@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shimmur/logtailer/cache"
+	"github.com/Shimmur/logtailer/reporter"
+	director "github.com/relistan/go-director"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_TailerStats(t *testing.T) {
+	Convey("Tailer stats", t, func() {
+		disco := NewDirListDiscoverer(fixturesDir, "dev")
+		pod := &Pod{Name: "venerable bede", Namespace: "default", ServiceName: "chopper"}
+		cache := cache.NewCache(5, "/tmp/testcache")
+		logOutput := &mockLogOutput{}
+
+		// Lets two lines through a minute
+		limiter := NewRateLimitingLogger(
+			reporter.NewLimitExceededReporter("", "", ""), 2, time.Minute, "chopper", logOutput,
+		)
+		tailer := NewTailer(pod, cache, limiter)
+
+		logFiles, err := disco.LogFiles("default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499")
+		So(err, ShouldBeNil)
+
+		_ = LogCapture(func() {
+			So(tailer.TailLogs(logFiles), ShouldBeNil)
+			tailer.Run()
+		})
+
+		live := fixturesDir + "/default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499/chopper/1.log"
+		line := "2022-12-03T16:09:51.741778906Z stdout F counting\n"
+
+		Reset(func() {
+			_ = LogCapture(tailer.Stop)
+
+			// Empty the fixture file
+			_ = ioutil.WriteFile(live, []byte{}, 0644)
+		})
+
+		statsFor := func(container string) FileStats {
+			for _, stats := range tailer.Stats() {
+				if stats.Container == container {
+					return stats
+				}
+			}
+			return FileStats{}
+		}
+
+		readBefore := metrics.LinesRead.Value("chopper")
+		limitedBefore := metrics.LinesRateLimited.Value("chopper")
+
+		logF, err := os.OpenFile(live, os.O_APPEND|os.O_WRONLY, 0644)
+		So(err, ShouldBeNil)
+		for i := 0; i < 3; i++ {
+			logF.WriteString(line)
+		}
+		logF.Close()
+
+		_ = LogCapture(func() { tailer.Drain(5 * time.Second) })
+
+		Convey("has stats for each container", func() {
+			stats := tailer.Stats()
+			So(len(stats), ShouldEqual, 3)
+			So(statsFor("chopper").File, ShouldEqual, live)
+		})
+
+		Convey("counts what was read and delivered", func() {
+			stats := statsFor("chopper")
+			So(stats.LinesRead, ShouldEqual, 3)
+			So(stats.BytesRead, ShouldEqual, 3*len(line))
+			So(stats.LinesDelivered, ShouldEqual, 2)
+			So(stats.LinesRateLimited, ShouldEqual, 1)
+			So(stats.LinesDropped, ShouldEqual, 0)
+			So(stats.LastLine, ShouldNotBeNil)
+
+			So(statsFor("envoy").LinesRead, ShouldEqual, 0)
+			So(statsFor("envoy").LastLine, ShouldBeNil)
+		})
+
+		Convey("counts the lines for the service in the metrics", func() {
+			So(metrics.LinesRead.Value("chopper"), ShouldEqual, readBefore+3)
+			So(metrics.LinesRateLimited.Value("chopper"), ShouldEqual, limitedBefore+1)
+		})
+
+		Convey("knows how far behind the live log we are", func() {
+			stats := statsFor("chopper")
+			So(stats.Size, ShouldEqual, 3*len(line))
+			So(stats.Offset, ShouldEqual, stats.Size)
+			So(stats.LagBytes, ShouldEqual, 0)
+
+			tailer.statsFor(live).setOffset(live, 10)
+			So(statsFor("chopper").LagBytes, ShouldEqual, 3*len(line)-10)
+		})
+
+		Convey("adds them up for the pod in the JSON", func() {
+			data, err := json.Marshal(tailer)
+			So(err, ShouldBeNil)
+
+			var decoded struct {
+				Pod   *Pod
+				Stats FileStats
+				Files []FileStats
+			}
+			So(json.Unmarshal(data, &decoded), ShouldBeNil)
+
+			So(decoded.Pod.Name, ShouldEqual, "venerable bede")
+			So(decoded.Stats.LinesRead, ShouldEqual, 3)
+			So(decoded.Stats.LinesDelivered, ShouldEqual, 2)
+			So(decoded.Stats.LastLine, ShouldNotBeNil)
+			So(len(decoded.Files), ShouldEqual, 3)
+		})
+	})
+}
+
+func Test_HostLogStats(t *testing.T) {
+	Convey("Stats for a host log source with several files", t, func() {
+		dir, err := os.MkdirTemp("", "hostlogs")
+		So(err, ShouldBeNil)
+
+		source := &HostLogSource{ServiceName: "auditd", Container: "audit", Pattern: filepath.Join(dir, "*.log")}
+		disco := NewGlobDiscoverer([]*HostLogSource{source}, "dev")
+
+		for _, name := range []string{"login.log", "sudo.log"} {
+			So(os.WriteFile(filepath.Join(dir, name), []byte{}, 0644), ShouldBeNil)
+		}
+
+		pod := &Pod{Name: source.PodName(), ServiceName: "auditd", Container: "audit", HostLog: true}
+		tailer := NewTailer(pod, cache.NewCache(5, filepath.Join(dir, "cache.json")), &mockLogOutput{})
+
+		Reset(func() {
+			_ = LogCapture(tailer.Stop)
+			os.RemoveAll(dir)
+		})
+
+		logFiles, err := disco.LogFiles(source.PodName())
+		So(err, ShouldBeNil)
+
+		_ = LogCapture(func() {
+			So(tailer.TailLogs(logFiles), ShouldBeNil)
+			tailer.Run()
+		})
+
+		So(os.WriteFile(filepath.Join(dir, "login.log"), []byte("one\ntwo\n"), 0644), ShouldBeNil)
+		So(os.WriteFile(filepath.Join(dir, "sudo.log"), []byte("three\n"), 0644), ShouldBeNil)
+		_ = LogCapture(func() { tailer.Drain(5 * time.Second) })
+
+		looper := director.NewFreeLooper(director.ONCE, make(chan error))
+		tracker := NewPodTracker(looper, disco, NewMockTailerFunc(&MockTailer{}), &mockFilter{})
+		tracker.LogTails = map[string]LogTailer{pod.Name: tailer}
+
+		recorder := httptest.NewRecorder()
+		tracker.serveState(recorder, httptest.NewRequest("GET", "/state", nil))
+		So(recorder.Code, ShouldEqual, 200)
+
+		var state map[string]struct {
+			Stats FileStats
+			Files []FileStats
+		}
+		So(json.Unmarshal(recorder.Body.Bytes(), &state), ShouldBeNil)
+
+		Convey("reports each file on its own", func() {
+			files := state[pod.Name].Files
+			So(len(files), ShouldEqual, 2)
+
+			So(files[0].File, ShouldEqual, filepath.Join(dir, "login.log"))
+			So(files[0].Container, ShouldEqual, "audit")
+			So(files[0].LinesRead, ShouldEqual, 2)
+			So(files[0].Offset, ShouldEqual, len("one\ntwo\n"))
+
+			So(files[1].File, ShouldEqual, filepath.Join(dir, "sudo.log"))
+			So(files[1].Container, ShouldEqual, "audit")
+			So(files[1].LinesRead, ShouldEqual, 1)
+			So(files[1].Offset, ShouldEqual, len("three\n"))
+
+			So(state[pod.Name].Stats.LinesRead, ShouldEqual, 3)
+		})
+	})
+}
@@ -35,6 +35,7 @@ func Test_TailLogs(t *testing.T) {
 		logOutput := &mockLogOutput{}
 
 		tailer := NewTailer(pod, cache, logOutput)
+		restartedLog := "fixtures/pods/default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499/chopper/0.log"
 
 		pods, err := disco.Discover()
 		So(err, ShouldBeNil)
@@ -51,8 +52,8 @@ func Test_TailLogs(t *testing.T) {
 
 		Reset(func() {
 			// Empty the fixture files
-			for _, tail := range tailer.LogTails {
-				_ = ioutil.WriteFile(tail.Filename, []byte{}, 0644)
+			for _, filename := range tailer.liveLogs() {
+				_ = ioutil.WriteFile(filename, []byte{}, 0644)
 			}
 		})
 
@@ -62,61 +63,53 @@ func Test_TailLogs(t *testing.T) {
 				So(err, ShouldBeNil)
 			})
 
-			// Make sure we are tracking more than one file
-			So(len(tailer.LogTails), ShouldEqual, 4)
-			So(
-				tailer.LogTails["fixtures/pods/default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499/chopper/0.log"],
-				ShouldNotBeNil,
-			)
-			So(
-				tailer.LogTails["fixtures/pods/default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499/chopper/1.log"],
-				ShouldNotBeNil,
-			)
-			So(
-				tailer.LogTails["fixtures/pods/default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499/logproxy/0.log"],
-				ShouldNotBeNil,
-			)
-			So(
-				tailer.LogTails["fixtures/pods/default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499/vault-init/0.log"],
-				ShouldNotBeNil,
-			)
+			// Make sure we are tracking more than one file. The chopper
+			// container restarted, so we only follow its newest log.
+			liveLogs := tailer.liveLogs()
+			So(len(liveLogs), ShouldEqual, 3)
+			So(liveLogs, ShouldNotContain, restartedLog)
+			So(liveLogs, ShouldContain, "fixtures/pods/default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499/chopper/1.log")
+			So(liveLogs, ShouldContain, "fixtures/pods/default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499/logproxy/0.log")
+			So(liveLogs, ShouldContain, "fixtures/pods/default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499/vault-init/0.log")
 
 			tailer.Run()
 			Reset(tailer.Stop)
 
-			// Nothing should be cached yet
-			So(len(tailer.localCache), ShouldEqual, 0)
+			// Nothing should be cached yet for the logs we follow
+			for _, filename := range tailer.liveLogs() {
+				So(tailer.offsetFor(filename), ShouldBeNil)
+			}
 
 			// Put something into the logfiles
-			for _, tail := range tailer.LogTails {
-				logF, err := os.OpenFile(tail.Filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			for _, filename := range tailer.liveLogs() {
+				logF, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 				So(err, ShouldBeNil)
-				logF.WriteString("this is a test message\n")
+				logF.WriteString("2022-12-03T16:09:51.741778906Z stdout F this is a test message\n")
 				logF.Close()
 			}
 
-			timeout := time.After(300 * time.Millisecond)
 			// We have to wait for the files to flush to the tail
-			for {
-				select {
-				case <-timeout:
-					So("we should have received something", ShouldNotBeEmpty)
-				default: // keep going
+			So(len(waitForLines(logOutput, 3)), ShouldEqual, 3)
+
+			// Now we should know about all of their offsets, and that we
+			// finished the log from before the restart. The offsets are
+			// recorded after the lines are handed over, so they may lag.
+			So(waitFor(2*time.Second, func() bool {
+				if tailer.offsetFor(restartedLog) == nil {
+					return false
 				}
-				time.Sleep(1 * time.Millisecond)
-				if logOutput.LastLogged != nil {
-					break
+				for _, filename := range tailer.liveLogs() {
+					if tailer.offsetFor(filename) == nil {
+						return false
+					}
 				}
-			}
-
-			// Now we should know about all of their offsets
-			tailer.lock.RLock()
-			So(len(tailer.localCache), ShouldEqual, 4)
-			tailer.lock.RUnlock()
+				return true
+			}), ShouldBeTrue)
+			So(tailer.offsetFor(restartedLog), ShouldResemble, &shippedLocation)
 
 			logOutput.Lock()
 			defer logOutput.Unlock()
-			So(logOutput.CallCount, ShouldEqual, 4)
+			So(logOutput.CallCount, ShouldEqual, 3)
 		})
 
 		Convey("passes on shutdown message to the log output", func() {
@@ -126,13 +119,125 @@ func Test_TailLogs(t *testing.T) {
 			So(logOutput.StopWasCalled, ShouldBeTrue)
 		})
 
+		Convey("drains what is left in the logs", func() {
+			_ = LogCapture(func() {
+				err := tailer.TailLogs(logFiles)
+				So(err, ShouldBeNil)
+
+				tailer.Run()
+			})
+			Reset(tailer.Stop)
+
+			for _, filename := range tailer.liveLogs() {
+				logF, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+				So(err, ShouldBeNil)
+				for i := 0; i < 5; i++ {
+					logF.WriteString("2022-12-03T16:09:51.741778906Z stdout F famous last words\n")
+				}
+				logF.Close()
+			}
+
+			capture := LogCapture(func() {
+				tailer.Drain(5 * time.Second)
+			})
+
+			logOutput.Lock()
+			So(logOutput.CallCount, ShouldEqual, 15)
+			logOutput.Unlock()
+
+			drained, lost := tailer.DrainStats()
+			So(drained, ShouldBeGreaterThan, 0)
+			So(lost, ShouldEqual, 0)
+			So(capture, ShouldContainSubstring, "Drained")
+			So(capture, ShouldNotContainSubstring, "Gave up draining")
+		})
+
+		Convey("when shutting down", func() {
+			writeLines := func(tailer *Tailer, count int) {
+				for _, filename := range tailer.liveLogs() {
+					logF, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+					So(err, ShouldBeNil)
+					for i := 0; i < count; i++ {
+						logF.WriteString("2022-12-03T16:09:51.741778906Z stdout F shutting down\n")
+					}
+					logF.Close()
+				}
+			}
+
+			Convey("delivers what it read and keeps the offsets", func() {
+				_ = LogCapture(func() {
+					So(tailer.TailLogs(logFiles), ShouldBeNil)
+					tailer.Run()
+				})
+
+				writeLines(tailer, 5)
+				_ = LogCapture(func() { tailer.Drain(5 * time.Second) })
+
+				var delivered, abandoned int64
+				_ = LogCapture(func() {
+					delivered, abandoned = tailer.Shutdown(time.Now().Add(2 * time.Second))
+				})
+				So(abandoned, ShouldEqual, 0)
+				So(delivered, ShouldBeGreaterThanOrEqualTo, 0)
+				So(logOutput.StopWasCalled, ShouldBeTrue)
+
+				logOutput.Lock()
+				So(logOutput.CallCount, ShouldEqual, 15)
+				logOutput.Unlock()
+
+				// Unlike Stop(), we want to carry on from here after a restart
+				tailer.FlushOffsets()
+				for _, filename := range tailer.liveLogs() {
+					So(cache.Get(filename), ShouldNotBeNil)
+				}
+
+				Convey("and stops reading", func() {
+					writeLines(tailer, 1)
+					time.Sleep(50 * time.Millisecond)
+
+					logOutput.Lock()
+					So(logOutput.CallCount, ShouldEqual, 15)
+					logOutput.Unlock()
+				})
+			})
+
+			Convey("abandons what it can't deliver by the deadline", func() {
+				blocking := &blockingLogOutput{release: make(chan struct{})}
+				Reset(func() { close(blocking.release) })
+
+				tailer = NewTailer(pod, cache, blocking)
+				_ = LogCapture(func() {
+					So(tailer.TailLogs(logFiles), ShouldBeNil)
+					tailer.Run()
+				})
+
+				writeLines(tailer, 2)
+				time.Sleep(50 * time.Millisecond)
+
+				var delivered, abandoned int64
+				capture := LogCapture(func() {
+					delivered, abandoned = tailer.Shutdown(time.Now().Add(100 * time.Millisecond))
+				})
+				So(capture, ShouldContainSubstring, "Gave up delivering logs for pod venerable bede")
+				So(delivered, ShouldEqual, 0)
+				So(abandoned, ShouldBeGreaterThan, 0)
+			})
+		})
+
+		Convey("doesn't drain when there is no grace period", func() {
+			start := time.Now()
+			tailer.Drain(0)
+
+			So(time.Since(start), ShouldBeLessThan, drainCheckInterval)
+		})
+
 		Convey("removes logs we're no longer seeing", func() {
 			_ = LogCapture(func() {
 				err := tailer.TailLogs(logFiles)
 				So(err, ShouldBeNil)
 			})
 
-			So(len(tailer.LogTails), ShouldEqual, 4)
+			So(len(tailer.liveLogs()), ShouldEqual, 3)
 
 			logFiles = logFiles[1:3]
 			capture := LogCapture(func() {
@@ -141,11 +246,11 @@ func Test_TailLogs(t *testing.T) {
 			})
 
 			numberOfDroppedLogs := strings.Count(capture, "Dropping tail")
-			So(numberOfDroppedLogs, ShouldEqual, 2)
-			So(len(tailer.LogTails), ShouldEqual, 2)
+			So(numberOfDroppedLogs, ShouldEqual, 1)
+			So(len(tailer.liveLogs()), ShouldEqual, 2)
 		})
 
-		Convey("extracts and logs the container name", func() {
+		Convey("joins partial lines before logging them", func() {
 			_ = LogCapture(func() {
 				err := tailer.TailLogs(logFiles)
 				So(err, ShouldBeNil)
@@ -154,33 +259,111 @@ func Test_TailLogs(t *testing.T) {
 			})
 			Reset(tailer.Stop)
 
-			// Only send on one of the logs, so we can check the resulting container name
-			for _, tail := range tailer.LogTails {
-				if strings.Contains(tail.Filename, "vault-init") {
-					logF, err := os.OpenFile(tail.Filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			for _, filename := range tailer.liveLogs() {
+				if strings.Contains(filename, "vault-init") {
+					logF, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 					So(err, ShouldBeNil)
-					logF.WriteString("this is a test message\n")
+					logF.WriteString("2022-12-03T16:09:51.741778906Z stdout P this is a \n")
+					logF.WriteString("2022-12-03T16:09:51.741779906Z stdout F test message\n")
 					logF.Close()
 				}
 			}
 
 			// We have to wait for the files to flush to the tail
-			timeout := time.After(300 * time.Millisecond)
-			for {
-				select {
-				case <-timeout:
-					So("we should have received something", ShouldNotBeEmpty)
-				default: // keep going
+			So(waitForLines(logOutput, 1), ShouldNotBeEmpty)
+
+			logOutput.Lock()
+			defer logOutput.Unlock()
+			So(logOutput.CallCount, ShouldEqual, 1)
+			So(logOutput.LastLogged.Text, ShouldEqual, "this is a test message")
+		})
+
+		Convey("handles Docker json-file logs", func() {
+			_ = LogCapture(func() {
+				err := tailer.TailLogs(logFiles)
+				So(err, ShouldBeNil)
+
+				tailer.Run()
+			})
+			Reset(tailer.Stop)
+
+			for _, filename := range tailer.liveLogs() {
+				if strings.Contains(filename, "vault-init") {
+					logF, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+					So(err, ShouldBeNil)
+					logF.WriteString(`{"log":"this is a test message\n","stream":"stderr","time":"2022-12-03T16:09:51.741778906Z"}` + "\n")
+					logF.Close()
 				}
-				time.Sleep(1 * time.Millisecond)
-				if logOutput.LastLogged != nil {
-					break
+			}
+
+			// We have to wait for the files to flush to the tail
+			So(waitForLines(logOutput, 1), ShouldNotBeEmpty)
+
+			logOutput.Lock()
+			defer logOutput.Unlock()
+			So(logOutput.LastLogged.Text, ShouldEqual, "this is a test message")
+			So(logOutput.LastLogged.Stream, ShouldEqual, "stderr")
+			So(logOutput.LastLogged.Container, ShouldEqual, "vault-init")
+		})
+
+		Convey("sends host logs as they are, with their configured container", func() {
+			tailer.Pod = &Pod{Name: "host_kubelet_kubelet", Container: "kubelet", HostLog: true}
+
+			_ = LogCapture(func() {
+				err := tailer.TailLogs(logFiles)
+				So(err, ShouldBeNil)
+
+				tailer.Run()
+			})
+			Reset(tailer.Stop)
+
+			for _, filename := range tailer.liveLogs() {
+				if strings.Contains(filename, "vault-init") {
+					logF, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+					So(err, ShouldBeNil)
+					logF.WriteString("I1203 16:09:51.741778    1234 kubelet.go:123] this is a test message\n")
+					logF.Close()
 				}
 			}
 
-			So(logOutput.LastLogged, ShouldNotBeNil)
+			// We have to wait for the files to flush to the tail
+			So(waitForLines(logOutput, 1), ShouldNotBeEmpty)
+
+			logOutput.Lock()
+			defer logOutput.Unlock()
+			So(logOutput.LastLogged.Text, ShouldEqual, "I1203 16:09:51.741778    1234 kubelet.go:123] this is a test message")
+			So(logOutput.LastLogged.Container, ShouldEqual, "kubelet")
+			So(logOutput.LastLogged.Timestamp, ShouldNotBeZeroValue)
+		})
+
+		Convey("extracts and logs the container name", func() {
+			_ = LogCapture(func() {
+				err := tailer.TailLogs(logFiles)
+				So(err, ShouldBeNil)
+
+				tailer.Run()
+			})
+			Reset(tailer.Stop)
+
+			// Only send on one of the logs, so we can check the resulting container name
+			for _, filename := range tailer.liveLogs() {
+				if strings.Contains(filename, "vault-init") {
+					logF, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+					So(err, ShouldBeNil)
+					logF.WriteString("2022-12-03T16:09:51.741778906Z stdout F this is a test message\n")
+					logF.Close()
+				}
+			}
+
+			// We have to wait for the files to flush to the tail
+			So(waitForLines(logOutput, 1), ShouldNotBeEmpty)
+
+			logOutput.Lock()
+			defer logOutput.Unlock()
 			So(logOutput.LastLogged.Text, ShouldEqual, "this is a test message")
 			So(logOutput.LastLogged.Container, ShouldEqual, "vault-init")
+			So(logOutput.LastLogged.Stream, ShouldEqual, "stdout")
+			So(logOutput.LastLogged.Timestamp, ShouldEqual, time.Date(2022, 12, 3, 16, 9, 51, 741778906, time.UTC))
 		})
 	})
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How deep the pod log tree goes: <pod>/<container>/<n>.log
+	podDirDepth       = 1
+	containerDirDepth = 2
+	logFileDepth      = 3
+)
+
+// A WatchingDiscoverer wraps another Discoverer and watches the logs
+// filesystem with fsnotify, notifying on the Changes channel whenever pod
+// directories or log files come and go. Discovery itself is still done by
+// the wrapped Discoverer, and its own changes are passed on if it has any.
+type WatchingDiscoverer struct {
+	Discoverer
+
+	Dir string
+
+	watcher *fsnotify.Watcher
+	changeNotifier
+}
+
+// NewWatchingDiscoverer returns a WatchingDiscoverer watching the directory
+// tree under path. Returns an error if the watches can't be set up, e.g. when
+// we are out of inotify watches.
+func NewWatchingDiscoverer(disco Discoverer, path string) (*WatchingDiscoverer, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create watcher: %w", err)
+	}
+
+	d := &WatchingDiscoverer{
+		Discoverer: disco,
+		Dir:        path,
+		watcher:    watcher,
+
+		changeNotifier: newChangeNotifier(),
+	}
+
+	err = d.watchTree(path, 0)
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Run processes filesystem events until Stop() is called. It runs in the
+// background and returns immediately.
+func (d *WatchingDiscoverer) Run() {
+	// Pass on changes from the Discoverer we wrap, if it has any
+	var upstream <-chan struct{}
+	if notifier, ok := d.Discoverer.(NotifyingDiscoverer); ok {
+		upstream = notifier.Changes()
+	}
+
+	go func() {
+		defer d.closeChanges()
+
+		for {
+			select {
+			case _, ok := <-upstream:
+				if !ok {
+					upstream = nil
+					continue
+				}
+				d.notify()
+
+			case event, ok := <-d.watcher.Events:
+				if !ok {
+					return
+				}
+				d.handleEvent(event)
+
+			case err, ok := <-d.watcher.Errors:
+				if !ok {
+					return
+				}
+				// Usually means the event queue overflowed, so go look
+				log.Warnf("Error watching %s: %s", d.Dir, err)
+				d.notify()
+			}
+		}
+	}()
+}
+
+// Stop shuts down the watcher, which will close the Changes channel
+func (d *WatchingDiscoverer) Stop() {
+	err := d.watcher.Close()
+	if err != nil {
+		log.Errorf("Failed to close watcher on %s: %s", d.Dir, err)
+	}
+}
+
+func (d *WatchingDiscoverer) handleEvent(event fsnotify.Event) {
+	// Writes are the Tailers' business, not ours
+	if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Remove) && !event.Has(fsnotify.Rename) {
+		return
+	}
+
+	depth := d.depthOf(event.Name)
+	if depth < podDirDepth || depth > logFileDepth {
+		return
+	}
+
+	log.Debugf("Discovery change: %s", event)
+
+	// New directories need watching too. Removed ones are dropped by
+	// fsnotify on its own.
+	if event.Has(fsnotify.Create) && depth < logFileDepth {
+		info, err := os.Stat(event.Name)
+		if err == nil && info.IsDir() {
+			err := d.watchTree(event.Name, depth)
+			if err != nil {
+				log.Warnf("Unable to watch %s: %s", event.Name, err)
+			}
+		}
+	}
+
+	d.notify()
+}
+
+// watchTree adds a watch on a directory and any directories below it that
+// are part of the pod log tree. They may have been created before we got the
+// watch in place.
+func (d *WatchingDiscoverer) watchTree(path string, depth int) error {
+	err := d.watcher.Add(path)
+	if err != nil {
+		return fmt.Errorf("unable to watch %s: %w", path, err)
+	}
+
+	if depth >= containerDirDepth {
+		return nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %w", path, err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		err := d.watchTree(filepath.Join(path, entry.Name()), depth+1)
+		if err != nil {
+			// The pod may be on its way out, keep going with the others
+			log.Warnf("Unable to watch %s: %s", entry.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// depthOf returns how far below the watched directory a path is
+func (d *WatchingDiscoverer) depthOf(path string) int {
+	rel, err := filepath.Rel(d.Dir, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return 0
+	}
+
+	return strings.Count(rel, string(filepath.Separator)) + 1
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// waitForChange waits a short while for a notification from the discoverer
+func waitForChange(changes <-chan struct{}) bool {
+	select {
+	case <-changes:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func Test_WatchingDiscoverer(t *testing.T) {
+	Convey("WatchingDiscoverer", t, func() {
+		baseDir, err := os.MkdirTemp("", "watchdisco")
+		So(err, ShouldBeNil)
+
+		disco, err := NewWatchingDiscoverer(NewDirListDiscoverer(baseDir, "dev"), baseDir)
+		So(err, ShouldBeNil)
+		disco.Run()
+
+		Reset(func() {
+			disco.Stop()
+			os.RemoveAll(baseDir)
+		})
+
+		podDir := filepath.Join(baseDir, "default_chopper-f5b66c6bf-cgslk_9df92617-0407-470e-8182-a506aa7e0499")
+
+		Convey("notifies when a new pod appears", func() {
+			So(os.Mkdir(podDir, 0755), ShouldBeNil)
+			So(waitForChange(disco.Changes()), ShouldBeTrue)
+
+			pods, err := disco.Discover()
+			So(err, ShouldBeNil)
+			So(len(pods), ShouldEqual, 1)
+			So(pods[0].ServiceName, ShouldEqual, "chopper")
+		})
+
+		Convey("notifies when a new log file appears in a new container", func() {
+			So(os.MkdirAll(filepath.Join(podDir, "chopper"), 0755), ShouldBeNil)
+			So(waitForChange(disco.Changes()), ShouldBeTrue)
+
+			// Give the watch on the new directories a moment to be added
+			time.Sleep(50 * time.Millisecond)
+			select {
+			case <-disco.Changes():
+			default:
+			}
+
+			So(os.WriteFile(filepath.Join(podDir, "chopper", "0.log"), []byte{}, 0644), ShouldBeNil)
+			So(waitForChange(disco.Changes()), ShouldBeTrue)
+
+			logs, err := disco.LogFiles(filepath.Base(podDir))
+			So(err, ShouldBeNil)
+			So(len(logs), ShouldEqual, 1)
+		})
+
+		Convey("notifies when a pod goes away", func() {
+			So(os.Mkdir(podDir, 0755), ShouldBeNil)
+			So(waitForChange(disco.Changes()), ShouldBeTrue)
+
+			So(os.RemoveAll(podDir), ShouldBeNil)
+			So(waitForChange(disco.Changes()), ShouldBeTrue)
+		})
+
+		Convey("doesn't notify on writes to log files", func() {
+			So(os.MkdirAll(filepath.Join(podDir, "chopper"), 0755), ShouldBeNil)
+			logFile := filepath.Join(podDir, "chopper", "0.log")
+			So(os.WriteFile(logFile, []byte{}, 0644), ShouldBeNil)
+
+			// Soak up the notifications for the setup
+			for waitForChange(disco.Changes()) {
+			}
+
+			logF, err := os.OpenFile(logFile, os.O_APPEND|os.O_WRONLY, 0644)
+			So(err, ShouldBeNil)
+			logF.WriteString("this is a test message\n")
+			logF.Close()
+
+			So(waitForChange(disco.Changes()), ShouldBeFalse)
+		})
+
+		Convey("closes the channel when stopped", func() {
+			disco.Stop()
+
+			_, ok := <-disco.Changes()
+			So(ok, ShouldBeFalse)
+		})
+	})
+}